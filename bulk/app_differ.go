@@ -20,15 +20,23 @@ type AppDiffer interface {
 
 type appDiffer struct {
 	existingSchedulingInfos map[string]*models.DesiredLRPSchedulingInfo
+	deep                    bool
+	shard                   Shard
 
 	stale   chan []cc_messages.CCDesiredAppFingerprint
 	missing chan []cc_messages.CCDesiredAppFingerprint
 	deleted chan []string
 }
 
-func NewAppDiffer(existing map[string]*models.DesiredLRPSchedulingInfo) AppDiffer {
+// NewAppDiffer returns a differ that reports LRPs as stale when their ETag
+// does not match CC's. In deep mode every existing LRP is reported as stale,
+// so that the full desired app can be compared against what is in BBS.
+// Only LRPs whose process guid is in the shard are considered.
+func NewAppDiffer(existing map[string]*models.DesiredLRPSchedulingInfo, deep bool, shard Shard) AppDiffer {
 	return &appDiffer{
-		existingSchedulingInfos: copySchedulingInfoMap(existing),
+		existingSchedulingInfos: copySchedulingInfoMap(existing, shard),
+		deep:                    deep,
+		shard:                   shard,
 
 		stale:   make(chan []cc_messages.CCDesiredAppFingerprint, 1),
 		missing: make(chan []cc_messages.CCDesiredAppFingerprint, 1),
@@ -71,6 +79,10 @@ func (d *appDiffer) Diff(
 				stale := []cc_messages.CCDesiredAppFingerprint{}
 
 				for _, fingerprint := range batch {
+					if !d.shard.Owns(fingerprint.ProcessGuid) {
+						continue
+					}
+
 					desiredLRP, found := d.existingSchedulingInfos[fingerprint.ProcessGuid]
 					if !found {
 						logger.Info("found-missing-desired-lrp", lager.Data{
@@ -90,6 +102,8 @@ func (d *appDiffer) Diff(
 							"etag": fingerprint.ETag,
 						})
 
+						stale = append(stale, fingerprint)
+					} else if d.deep {
 						stale = append(stale, fingerprint)
 					}
 				}
@@ -116,10 +130,12 @@ func (d *appDiffer) Diff(
 	return errc
 }
 
-func copySchedulingInfoMap(schedulingInfoMap map[string]*models.DesiredLRPSchedulingInfo) map[string]*models.DesiredLRPSchedulingInfo {
+func copySchedulingInfoMap(schedulingInfoMap map[string]*models.DesiredLRPSchedulingInfo, shard Shard) map[string]*models.DesiredLRPSchedulingInfo {
 	clone := map[string]*models.DesiredLRPSchedulingInfo{}
 	for k, v := range schedulingInfoMap {
-		clone[k] = v
+		if shard.Owns(k) {
+			clone[k] = v
+		}
 	}
 	return clone
 }
@@ -27,10 +27,14 @@ var _ = Describe("Differ", func() {
 
 		logger *lagertest.TestLogger
 		differ bulk.AppDiffer
+		deep   bool
+		shard  bulk.Shard
 	)
 
 	BeforeEach(func() {
 		logger = lagertest.NewTestLogger("test")
+		deep = false
+		shard = bulk.Shard{}
 
 		existingSchedulingInfo = &models.DesiredLRPSchedulingInfo{
 			DesiredLRPKey: models.NewDesiredLRPKey("process-guid", "domain", "log-guid"),
@@ -51,7 +55,7 @@ var _ = Describe("Differ", func() {
 		existingSchedulingInfoMap = map[string]*models.DesiredLRPSchedulingInfo{
 			existingSchedulingInfo.ProcessGuid: existingSchedulingInfo,
 		}
-		differ = bulk.NewAppDiffer(existingSchedulingInfoMap)
+		differ = bulk.NewAppDiffer(existingSchedulingInfoMap, deep, shard)
 
 		staleChan = differ.Stale()
 		missingChan = differ.Missing()
@@ -68,6 +72,33 @@ var _ = Describe("Differ", func() {
 		Eventually(errorsChan).Should(BeClosed())
 	})
 
+	Context("when sharded", func() {
+		var ownedFingerprint, otherFingerprint cc_messages.CCDesiredAppFingerprint
+
+		BeforeEach(func() {
+			shard = bulk.Shard{Index: 1, Count: 2}
+
+			existingSchedulingInfo = &models.DesiredLRPSchedulingInfo{
+				DesiredLRPKey: models.NewDesiredLRPKey(guidInShard("excess", shard, false), "domain", "log-guid"),
+				Annotation:    "some-etag-1",
+			}
+
+			ownedFingerprint = cc_messages.CCDesiredAppFingerprint{ProcessGuid: guidInShard("missing", shard, true), ETag: "etag"}
+			otherFingerprint = cc_messages.CCDesiredAppFingerprint{ProcessGuid: guidInShard("missing", shard, false), ETag: "etag"}
+
+			desiredChan <- []cc_messages.CCDesiredAppFingerprint{ownedFingerprint, otherFingerprint}
+			close(desiredChan)
+		})
+
+		It("only reports apps in the shard as missing", func() {
+			Eventually(missingChan).Should(Receive(ConsistOf(ownedFingerprint)))
+		})
+
+		It("does not delete LRPs outside the shard", func() {
+			Consistently(deletedChan).ShouldNot(Receive())
+		})
+	})
+
 	Context("when desired apps come in from CC", func() {
 		var desiredAppFingerprints []cc_messages.CCDesiredAppFingerprint
 
@@ -90,6 +121,22 @@ var _ = Describe("Differ", func() {
 			})
 		})
 
+		Context("in deep mode", func() {
+			BeforeEach(func() {
+				deep = true
+
+				desiredChan <- desiredAppFingerprints
+				close(desiredChan)
+			})
+
+			It("sends fingerprints with matching ETags to the stale channel", func() {
+				Eventually(staleChan).Should(Receive(ConsistOf(existingAppFingerprint)))
+
+				Consistently(missingChan).ShouldNot(Receive())
+				Consistently(deletedChan).ShouldNot(Receive())
+			})
+		})
+
 		Context("and some are missing from the existing desired LRPs set", func() {
 			var missingAppFingerprints []cc_messages.CCDesiredAppFingerprint
 
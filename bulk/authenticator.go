@@ -0,0 +1,152 @@
+package bulk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+)
+
+// tokenExpiryMargin is how long before its advertised expiry a cached OAuth
+// token is considered stale, so that requests in flight do not race it.
+const tokenExpiryMargin = 30 * time.Second
+
+type Authenticator interface {
+	Authenticate(logger lager.Logger, httpClient *http.Client, req *http.Request) error
+
+	// Invalidate discards any cached credentials after CC rejected them.
+	Invalidate()
+}
+
+type BasicAuthenticator struct {
+	Username string
+	Password string
+}
+
+func (a *BasicAuthenticator) Authenticate(logger lager.Logger, httpClient *http.Client, req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+func (a *BasicAuthenticator) Invalidate() {}
+
+// NoAuthenticator adds no credentials, for CCs that authenticate the bulker
+// by its TLS client certificate alone.
+type NoAuthenticator struct{}
+
+func (NoAuthenticator) Authenticate(logger lager.Logger, httpClient *http.Client, req *http.Request) error {
+	return nil
+}
+
+func (NoAuthenticator) Invalidate() {}
+
+type OAuthAuthenticator struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	clock        clock.Clock
+
+	lock      sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func NewOAuthAuthenticator(tokenURL, clientID, clientSecret string, clock clock.Clock) *OAuthAuthenticator {
+	return &OAuthAuthenticator{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		clock:        clock,
+	}
+}
+
+func (a *OAuthAuthenticator) Authenticate(logger lager.Logger, httpClient *http.Client, req *http.Request) error {
+	token, err := a.accessToken(logger, httpClient)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "bearer "+token)
+	return nil
+}
+
+func (a *OAuthAuthenticator) Invalidate() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.token = ""
+}
+
+func (a *OAuthAuthenticator) accessToken(logger lager.Logger, httpClient *http.Client) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.token != "" && a.clock.Now().Before(a.expiresAt) {
+		return a.token, nil
+	}
+
+	logger = logger.Session("fetch-oauth-token", lager.Data{"token-url": a.tokenURL})
+	logger.Info("starting")
+	defer logger.Info("complete")
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest("POST", a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		logger.Error("failed-to-create-request", err)
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(a.clientID, a.clientSecret)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Error("failed-requesting-token", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("invalid response code %d from token endpoint", resp.StatusCode)
+		logger.Error("failed-requesting-token", err)
+		return "", err
+	}
+
+	tokenResponse := oauthTokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
+	if err != nil {
+		logger.Error("decode-body", err)
+		return "", err
+	}
+
+	if tokenResponse.AccessToken == "" {
+		err := fmt.Errorf("token endpoint did not return an access token")
+		logger.Error("invalid-token-response", err)
+		return "", err
+	}
+
+	lifetime := time.Duration(tokenResponse.ExpiresIn) * time.Second
+	if lifetime > 2*tokenExpiryMargin {
+		lifetime -= tokenExpiryMargin
+	} else {
+		lifetime /= 2
+	}
+
+	a.token = tokenResponse.AccessToken
+	a.expiresAt = a.clock.Now().Add(lifetime)
+
+	return a.token, nil
+}
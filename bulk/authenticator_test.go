@@ -0,0 +1,104 @@
+package bulk_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+var _ = Describe("OAuthAuthenticator", func() {
+	var (
+		authenticator *bulk.OAuthAuthenticator
+		fakeUAA       *ghttp.Server
+		clock         *fakeclock.FakeClock
+		logger        *lagertest.TestLogger
+		httpClient    *http.Client
+		req           *http.Request
+	)
+
+	BeforeEach(func() {
+		fakeUAA = ghttp.NewServer()
+		clock = fakeclock.NewFakeClock(time.Now())
+		logger = lagertest.NewTestLogger("test")
+		httpClient = &http.Client{Timeout: time.Second}
+
+		authenticator = bulk.NewOAuthAuthenticator(fakeUAA.URL()+"/oauth/token", "the-client", "the-secret", clock)
+
+		var err error
+		req, err = http.NewRequest("GET", "http://cc.example.com/internal/bulk/apps", nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		fakeUAA.Close()
+	})
+
+	Context("when the token endpoint grants a token", func() {
+		BeforeEach(func() {
+			fakeUAA.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/oauth/token"),
+					ghttp.VerifyBasicAuth("the-client", "the-secret"),
+					ghttp.VerifyHeaderKV("Content-Type", "application/x-www-form-urlencoded"),
+					ghttp.RespondWith(200, `{"access_token": "the-token", "token_type": "bearer", "expires_in": 600}`),
+				),
+				ghttp.RespondWith(200, `{"access_token": "another-token", "token_type": "bearer", "expires_in": 600}`),
+			)
+		})
+
+		It("sets a bearer authorization header", func() {
+			err := authenticator.Authenticate(logger, httpClient, req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(req.Header.Get("Authorization")).To(Equal("bearer the-token"))
+		})
+
+		It("reuses the token until it is about to expire", func() {
+			Expect(authenticator.Authenticate(logger, httpClient, req)).To(Succeed())
+			clock.Increment(500 * time.Second)
+			Expect(authenticator.Authenticate(logger, httpClient, req)).To(Succeed())
+			Expect(fakeUAA.ReceivedRequests()).To(HaveLen(1))
+
+			clock.Increment(time.Minute)
+			Expect(authenticator.Authenticate(logger, httpClient, req)).To(Succeed())
+			Expect(fakeUAA.ReceivedRequests()).To(HaveLen(2))
+			Expect(req.Header.Get("Authorization")).To(Equal("bearer another-token"))
+		})
+
+		It("fetches a new token once invalidated", func() {
+			Expect(authenticator.Authenticate(logger, httpClient, req)).To(Succeed())
+			authenticator.Invalidate()
+			Expect(authenticator.Authenticate(logger, httpClient, req)).To(Succeed())
+			Expect(fakeUAA.ReceivedRequests()).To(HaveLen(2))
+			Expect(req.Header.Get("Authorization")).To(Equal("bearer another-token"))
+		})
+	})
+
+	Context("when the token endpoint rejects the client", func() {
+		BeforeEach(func() {
+			fakeUAA.AppendHandlers(ghttp.RespondWith(401, ""))
+		})
+
+		It("returns an error", func() {
+			err := authenticator.Authenticate(logger, httpClient, req)
+			Expect(err).To(MatchError("invalid response code 401 from token endpoint"))
+			Expect(req.Header.Get("Authorization")).To(BeEmpty())
+		})
+	})
+
+	Context("when the token endpoint returns no token", func() {
+		BeforeEach(func() {
+			fakeUAA.AppendHandlers(ghttp.RespondWith(200, `{}`))
+		})
+
+		It("returns an error", func() {
+			err := authenticator.Authenticate(logger, httpClient, req)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
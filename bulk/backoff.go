@@ -0,0 +1,57 @@
+package bulk
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultMaxRetryInterval = 30 * time.Second
+
+// backoffDelay returns the delay before the given retry attempt (starting at
+// 1), doubling the base interval each attempt up to the max interval. Half of
+// the delay is randomized so that retries from several callers do not line up.
+func backoffDelay(baseInterval, maxInterval time.Duration, attempt int) time.Duration {
+	if baseInterval <= 0 {
+		return 0
+	}
+
+	if maxInterval <= 0 {
+		maxInterval = defaultMaxRetryInterval
+	}
+
+	delay := baseInterval
+	for i := 1; i < attempt && delay < maxInterval; i++ {
+		delay *= 2
+	}
+	if delay > maxInterval {
+		delay = maxInterval
+	}
+
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// retryAfter parses the Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,25 @@
+package bulk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+const (
+	CallbackTimestampHeader = "X-Nsync-Timestamp"
+	CallbackSignatureHeader = "X-Nsync-Signature"
+)
+
+// SignCallback computes the signature sent with a completion callback: the
+// hex HMAC-SHA256 of the unix timestamp, a '.', and the payload. Including
+// the timestamp lets CC reject replayed callbacks.
+func SignCallback(key []byte, timestamp time.Time, payload []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,86 @@
+package bulk
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+)
+
+const (
+	driftReasonInstances = "instances"
+	driftReasonRoutes    = "routes"
+	driftReasonResources = "resources"
+)
+
+// lrpDrift reports how an LRP whose ETag matches CC's has nonetheless been
+// changed in BBS, e.g. by an operator scaling it directly. Resource drift is
+// reported but cannot be repaired by an update.
+func lrpDrift(
+	existing *models.DesiredLRPSchedulingInfo,
+	update *models.DesiredLRPUpdate,
+	desired *models.DesiredLRP,
+) []string {
+	reasons := []string{}
+
+	if update.Instances != nil && *update.Instances != existing.Instances {
+		reasons = append(reasons, driftReasonInstances)
+	}
+
+	if update.Routes != nil && !routesEqual(*update.Routes, existing.Routes) {
+		reasons = append(reasons, driftReasonRoutes)
+	}
+
+	if desired != nil &&
+		(desired.MemoryMb != existing.MemoryMb ||
+			desired.DiskMb != existing.DiskMb ||
+			desired.RootFs != existing.RootFs) {
+		reasons = append(reasons, driftReasonResources)
+	}
+
+	return reasons
+}
+
+func repairableDrift(reasons []string) bool {
+	for _, reason := range reasons {
+		if reason != driftReasonResources {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routesEqual compares routes by their decoded values, so that differences in
+// whitespace or key order in the stored JSON are not mistaken for drift.
+func routesEqual(a, b models.Routes) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, aValue := range a {
+		bValue, ok := b[key]
+		if !ok {
+			return false
+		}
+
+		if !rawJSONEqual(aValue, bValue) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func rawJSONEqual(a, b *json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	var aDecoded, bDecoded interface{}
+	if json.Unmarshal(*a, &aDecoded) != nil || json.Unmarshal(*b, &bDecoded) != nil {
+		return string(*a) == string(*b)
+	}
+
+	return reflect.DeepEqual(aDecoded, bDecoded)
+}
@@ -45,6 +45,18 @@ type FakeFetcher struct {
 		result1 <-chan []cc_messages.DesireAppRequestFromCC
 		result2 <-chan error
 	}
+	FetchTasksStub        func(logger lager.Logger, cancel <-chan struct{}, httpClient *http.Client, taskStates <-chan []cc_messages.CCTaskState) (<-chan []cc_messages.TaskRequestFromCC, <-chan error)
+	fetchTasksMutex       sync.RWMutex
+	fetchTasksArgsForCall []struct {
+		logger     lager.Logger
+		cancel     <-chan struct{}
+		httpClient *http.Client
+		taskStates <-chan []cc_messages.CCTaskState
+	}
+	fetchTasksReturns struct {
+		result1 <-chan []cc_messages.TaskRequestFromCC
+		result2 <-chan error
+	}
 }
 
 func (fake *FakeFetcher) FetchFingerprints(logger lager.Logger, cancel <-chan struct{}, httpClient *http.Client) (<-chan []cc_messages.CCDesiredAppFingerprint, <-chan error) {
@@ -153,4 +165,40 @@ func (fake *FakeFetcher) FetchDesiredAppsReturns(result1 <-chan []cc_messages.De
 	}{result1, result2}
 }
 
+func (fake *FakeFetcher) FetchTasks(logger lager.Logger, cancel <-chan struct{}, httpClient *http.Client, taskStates <-chan []cc_messages.CCTaskState) (<-chan []cc_messages.TaskRequestFromCC, <-chan error) {
+	fake.fetchTasksMutex.Lock()
+	fake.fetchTasksArgsForCall = append(fake.fetchTasksArgsForCall, struct {
+		logger     lager.Logger
+		cancel     <-chan struct{}
+		httpClient *http.Client
+		taskStates <-chan []cc_messages.CCTaskState
+	}{logger, cancel, httpClient, taskStates})
+	fake.fetchTasksMutex.Unlock()
+	if fake.FetchTasksStub != nil {
+		return fake.FetchTasksStub(logger, cancel, httpClient, taskStates)
+	} else {
+		return fake.fetchTasksReturns.result1, fake.fetchTasksReturns.result2
+	}
+}
+
+func (fake *FakeFetcher) FetchTasksCallCount() int {
+	fake.fetchTasksMutex.RLock()
+	defer fake.fetchTasksMutex.RUnlock()
+	return len(fake.fetchTasksArgsForCall)
+}
+
+func (fake *FakeFetcher) FetchTasksArgsForCall(i int) (lager.Logger, <-chan struct{}, *http.Client, <-chan []cc_messages.CCTaskState) {
+	fake.fetchTasksMutex.RLock()
+	defer fake.fetchTasksMutex.RUnlock()
+	return fake.fetchTasksArgsForCall[i].logger, fake.fetchTasksArgsForCall[i].cancel, fake.fetchTasksArgsForCall[i].httpClient, fake.fetchTasksArgsForCall[i].taskStates
+}
+
+func (fake *FakeFetcher) FetchTasksReturns(result1 <-chan []cc_messages.TaskRequestFromCC, result2 <-chan error) {
+	fake.FetchTasksStub = nil
+	fake.fetchTasksReturns = struct {
+		result1 <-chan []cc_messages.TaskRequestFromCC
+		result2 <-chan error
+	}{result1, result2}
+}
+
 var _ bulk.Fetcher = new(FakeFetcher)
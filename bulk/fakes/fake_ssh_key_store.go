@@ -0,0 +1,137 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+)
+
+type FakeSSHKeyStore struct {
+	KeysStub        func(processGuid string) (recipebuilder.SSHKeys, error)
+	keysMutex       sync.RWMutex
+	keysArgsForCall []struct {
+		processGuid string
+	}
+	keysReturns struct {
+		result1 recipebuilder.SSHKeys
+		result2 error
+	}
+	RotateStub        func(processGuid string) (recipebuilder.SSHKeys, error)
+	rotateMutex       sync.RWMutex
+	rotateArgsForCall []struct {
+		processGuid string
+	}
+	rotateReturns struct {
+		result1 recipebuilder.SSHKeys
+		result2 error
+	}
+	DeleteStub        func(processGuid string) error
+	deleteMutex       sync.RWMutex
+	deleteArgsForCall []struct {
+		processGuid string
+	}
+	deleteReturns struct {
+		result1 error
+	}
+}
+
+func (fake *FakeSSHKeyStore) Keys(processGuid string) (recipebuilder.SSHKeys, error) {
+	fake.keysMutex.Lock()
+	fake.keysArgsForCall = append(fake.keysArgsForCall, struct {
+		processGuid string
+	}{processGuid})
+	fake.keysMutex.Unlock()
+	if fake.KeysStub != nil {
+		return fake.KeysStub(processGuid)
+	} else {
+		return fake.keysReturns.result1, fake.keysReturns.result2
+	}
+}
+
+func (fake *FakeSSHKeyStore) KeysCallCount() int {
+	fake.keysMutex.RLock()
+	defer fake.keysMutex.RUnlock()
+	return len(fake.keysArgsForCall)
+}
+
+func (fake *FakeSSHKeyStore) KeysArgsForCall(i int) string {
+	fake.keysMutex.RLock()
+	defer fake.keysMutex.RUnlock()
+	return fake.keysArgsForCall[i].processGuid
+}
+
+func (fake *FakeSSHKeyStore) KeysReturns(result1 recipebuilder.SSHKeys, result2 error) {
+	fake.KeysStub = nil
+	fake.keysReturns = struct {
+		result1 recipebuilder.SSHKeys
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeSSHKeyStore) Rotate(processGuid string) (recipebuilder.SSHKeys, error) {
+	fake.rotateMutex.Lock()
+	fake.rotateArgsForCall = append(fake.rotateArgsForCall, struct {
+		processGuid string
+	}{processGuid})
+	fake.rotateMutex.Unlock()
+	if fake.RotateStub != nil {
+		return fake.RotateStub(processGuid)
+	} else {
+		return fake.rotateReturns.result1, fake.rotateReturns.result2
+	}
+}
+
+func (fake *FakeSSHKeyStore) RotateCallCount() int {
+	fake.rotateMutex.RLock()
+	defer fake.rotateMutex.RUnlock()
+	return len(fake.rotateArgsForCall)
+}
+
+func (fake *FakeSSHKeyStore) RotateArgsForCall(i int) string {
+	fake.rotateMutex.RLock()
+	defer fake.rotateMutex.RUnlock()
+	return fake.rotateArgsForCall[i].processGuid
+}
+
+func (fake *FakeSSHKeyStore) RotateReturns(result1 recipebuilder.SSHKeys, result2 error) {
+	fake.RotateStub = nil
+	fake.rotateReturns = struct {
+		result1 recipebuilder.SSHKeys
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeSSHKeyStore) Delete(processGuid string) error {
+	fake.deleteMutex.Lock()
+	fake.deleteArgsForCall = append(fake.deleteArgsForCall, struct {
+		processGuid string
+	}{processGuid})
+	fake.deleteMutex.Unlock()
+	if fake.DeleteStub != nil {
+		return fake.DeleteStub(processGuid)
+	} else {
+		return fake.deleteReturns.result1
+	}
+}
+
+func (fake *FakeSSHKeyStore) DeleteCallCount() int {
+	fake.deleteMutex.RLock()
+	defer fake.deleteMutex.RUnlock()
+	return len(fake.deleteArgsForCall)
+}
+
+func (fake *FakeSSHKeyStore) DeleteArgsForCall(i int) string {
+	fake.deleteMutex.RLock()
+	defer fake.deleteMutex.RUnlock()
+	return fake.deleteArgsForCall[i].processGuid
+}
+
+func (fake *FakeSSHKeyStore) DeleteReturns(result1 error) {
+	fake.DeleteStub = nil
+	fake.deleteReturns = struct {
+		result1 error
+	}{result1}
+}
+
+var _ recipebuilder.SSHKeyStore = new(FakeSSHKeyStore)
@@ -0,0 +1,97 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+)
+
+type FakeSyncController struct {
+	TriggerStub        func()
+	triggerMutex       sync.RWMutex
+	triggerArgsForCall []struct{}
+	PauseStub          func()
+	pauseMutex         sync.RWMutex
+	pauseArgsForCall   []struct{}
+	ResumeStub         func()
+	resumeMutex        sync.RWMutex
+	resumeArgsForCall  []struct{}
+	PausedStub         func() bool
+	pausedMutex        sync.RWMutex
+	pausedArgsForCall  []struct{}
+	pausedReturns      struct {
+		result1 bool
+	}
+}
+
+func (fake *FakeSyncController) Trigger() {
+	fake.triggerMutex.Lock()
+	fake.triggerArgsForCall = append(fake.triggerArgsForCall, struct{}{})
+	fake.triggerMutex.Unlock()
+	if fake.TriggerStub != nil {
+		fake.TriggerStub()
+	}
+}
+
+func (fake *FakeSyncController) TriggerCallCount() int {
+	fake.triggerMutex.RLock()
+	defer fake.triggerMutex.RUnlock()
+	return len(fake.triggerArgsForCall)
+}
+
+func (fake *FakeSyncController) Pause() {
+	fake.pauseMutex.Lock()
+	fake.pauseArgsForCall = append(fake.pauseArgsForCall, struct{}{})
+	fake.pauseMutex.Unlock()
+	if fake.PauseStub != nil {
+		fake.PauseStub()
+	}
+}
+
+func (fake *FakeSyncController) PauseCallCount() int {
+	fake.pauseMutex.RLock()
+	defer fake.pauseMutex.RUnlock()
+	return len(fake.pauseArgsForCall)
+}
+
+func (fake *FakeSyncController) Resume() {
+	fake.resumeMutex.Lock()
+	fake.resumeArgsForCall = append(fake.resumeArgsForCall, struct{}{})
+	fake.resumeMutex.Unlock()
+	if fake.ResumeStub != nil {
+		fake.ResumeStub()
+	}
+}
+
+func (fake *FakeSyncController) ResumeCallCount() int {
+	fake.resumeMutex.RLock()
+	defer fake.resumeMutex.RUnlock()
+	return len(fake.resumeArgsForCall)
+}
+
+func (fake *FakeSyncController) Paused() bool {
+	fake.pausedMutex.Lock()
+	fake.pausedArgsForCall = append(fake.pausedArgsForCall, struct{}{})
+	fake.pausedMutex.Unlock()
+	if fake.PausedStub != nil {
+		return fake.PausedStub()
+	} else {
+		return fake.pausedReturns.result1
+	}
+}
+
+func (fake *FakeSyncController) PausedCallCount() int {
+	fake.pausedMutex.RLock()
+	defer fake.pausedMutex.RUnlock()
+	return len(fake.pausedArgsForCall)
+}
+
+func (fake *FakeSyncController) PausedReturns(result1 bool) {
+	fake.PausedStub = nil
+	fake.pausedReturns = struct {
+		result1 bool
+	}{result1}
+}
+
+var _ bulk.SyncController = new(FakeSyncController)
@@ -5,34 +5,51 @@ import (
 	"net/http"
 	"sync"
 
+	"github.com/cloudfoundry-incubator/bbs/models"
 	"github.com/cloudfoundry-incubator/nsync/bulk"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/pivotal-golang/lager"
 )
 
 type FakeTaskClient struct {
-	FailTaskStub        func(logger lager.Logger, taskState *cc_messages.CCTaskState, httpClient *http.Client) error
+	FailTaskStub        func(logger lager.Logger, cancel <-chan struct{}, taskState *cc_messages.CCTaskState, reason bulk.TaskFailureReason, httpClient *http.Client) error
 	failTaskMutex       sync.RWMutex
 	failTaskArgsForCall []struct {
 		logger     lager.Logger
+		cancel     <-chan struct{}
 		taskState  *cc_messages.CCTaskState
+		reason     bulk.TaskFailureReason
 		httpClient *http.Client
 	}
 	failTaskReturns struct {
 		result1 error
 	}
+	CompleteTaskStub        func(logger lager.Logger, cancel <-chan struct{}, taskState *cc_messages.CCTaskState, task *models.Task, httpClient *http.Client) error
+	completeTaskMutex       sync.RWMutex
+	completeTaskArgsForCall []struct {
+		logger     lager.Logger
+		cancel     <-chan struct{}
+		taskState  *cc_messages.CCTaskState
+		task       *models.Task
+		httpClient *http.Client
+	}
+	completeTaskReturns struct {
+		result1 error
+	}
 }
 
-func (fake *FakeTaskClient) FailTask(logger lager.Logger, taskState *cc_messages.CCTaskState, httpClient *http.Client) error {
+func (fake *FakeTaskClient) FailTask(logger lager.Logger, cancel <-chan struct{}, taskState *cc_messages.CCTaskState, reason bulk.TaskFailureReason, httpClient *http.Client) error {
 	fake.failTaskMutex.Lock()
 	fake.failTaskArgsForCall = append(fake.failTaskArgsForCall, struct {
 		logger     lager.Logger
+		cancel     <-chan struct{}
 		taskState  *cc_messages.CCTaskState
+		reason     bulk.TaskFailureReason
 		httpClient *http.Client
-	}{logger, taskState, httpClient})
+	}{logger, cancel, taskState, reason, httpClient})
 	fake.failTaskMutex.Unlock()
 	if fake.FailTaskStub != nil {
-		return fake.FailTaskStub(logger, taskState, httpClient)
+		return fake.FailTaskStub(logger, cancel, taskState, reason, httpClient)
 	} else {
 		return fake.failTaskReturns.result1
 	}
@@ -44,10 +61,10 @@ func (fake *FakeTaskClient) FailTaskCallCount() int {
 	return len(fake.failTaskArgsForCall)
 }
 
-func (fake *FakeTaskClient) FailTaskArgsForCall(i int) (lager.Logger, *cc_messages.CCTaskState, *http.Client) {
+func (fake *FakeTaskClient) FailTaskArgsForCall(i int) (lager.Logger, <-chan struct{}, *cc_messages.CCTaskState, bulk.TaskFailureReason, *http.Client) {
 	fake.failTaskMutex.RLock()
 	defer fake.failTaskMutex.RUnlock()
-	return fake.failTaskArgsForCall[i].logger, fake.failTaskArgsForCall[i].taskState, fake.failTaskArgsForCall[i].httpClient
+	return fake.failTaskArgsForCall[i].logger, fake.failTaskArgsForCall[i].cancel, fake.failTaskArgsForCall[i].taskState, fake.failTaskArgsForCall[i].reason, fake.failTaskArgsForCall[i].httpClient
 }
 
 func (fake *FakeTaskClient) FailTaskReturns(result1 error) {
@@ -57,4 +74,40 @@ func (fake *FakeTaskClient) FailTaskReturns(result1 error) {
 	}{result1}
 }
 
+func (fake *FakeTaskClient) CompleteTask(logger lager.Logger, cancel <-chan struct{}, taskState *cc_messages.CCTaskState, task *models.Task, httpClient *http.Client) error {
+	fake.completeTaskMutex.Lock()
+	fake.completeTaskArgsForCall = append(fake.completeTaskArgsForCall, struct {
+		logger     lager.Logger
+		cancel     <-chan struct{}
+		taskState  *cc_messages.CCTaskState
+		task       *models.Task
+		httpClient *http.Client
+	}{logger, cancel, taskState, task, httpClient})
+	fake.completeTaskMutex.Unlock()
+	if fake.CompleteTaskStub != nil {
+		return fake.CompleteTaskStub(logger, cancel, taskState, task, httpClient)
+	} else {
+		return fake.completeTaskReturns.result1
+	}
+}
+
+func (fake *FakeTaskClient) CompleteTaskCallCount() int {
+	fake.completeTaskMutex.RLock()
+	defer fake.completeTaskMutex.RUnlock()
+	return len(fake.completeTaskArgsForCall)
+}
+
+func (fake *FakeTaskClient) CompleteTaskArgsForCall(i int) (lager.Logger, <-chan struct{}, *cc_messages.CCTaskState, *models.Task, *http.Client) {
+	fake.completeTaskMutex.RLock()
+	defer fake.completeTaskMutex.RUnlock()
+	return fake.completeTaskArgsForCall[i].logger, fake.completeTaskArgsForCall[i].cancel, fake.completeTaskArgsForCall[i].taskState, fake.completeTaskArgsForCall[i].task, fake.completeTaskArgsForCall[i].httpClient
+}
+
+func (fake *FakeTaskClient) CompleteTaskReturns(result1 error) {
+	fake.CompleteTaskStub = nil
+	fake.completeTaskReturns = struct {
+		result1 error
+	}{result1}
+}
+
 var _ bulk.TaskClient = new(FakeTaskClient)
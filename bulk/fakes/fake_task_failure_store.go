@@ -0,0 +1,97 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+)
+
+type FakeTaskFailureStore struct {
+	RecordStub        func(record bulk.TaskFailureRecord) error
+	recordMutex       sync.RWMutex
+	recordArgsForCall []struct {
+		record bulk.TaskFailureRecord
+	}
+	recordReturns struct {
+		result1 error
+	}
+	LookupStub        func(taskGuid string) (bulk.TaskFailureRecord, bool, error)
+	lookupMutex       sync.RWMutex
+	lookupArgsForCall []struct {
+		taskGuid string
+	}
+	lookupReturns struct {
+		result1 bulk.TaskFailureRecord
+		result2 bool
+		result3 error
+	}
+}
+
+func (fake *FakeTaskFailureStore) Record(record bulk.TaskFailureRecord) error {
+	fake.recordMutex.Lock()
+	fake.recordArgsForCall = append(fake.recordArgsForCall, struct {
+		record bulk.TaskFailureRecord
+	}{record})
+	fake.recordMutex.Unlock()
+	if fake.RecordStub != nil {
+		return fake.RecordStub(record)
+	} else {
+		return fake.recordReturns.result1
+	}
+}
+
+func (fake *FakeTaskFailureStore) RecordCallCount() int {
+	fake.recordMutex.RLock()
+	defer fake.recordMutex.RUnlock()
+	return len(fake.recordArgsForCall)
+}
+
+func (fake *FakeTaskFailureStore) RecordArgsForCall(i int) bulk.TaskFailureRecord {
+	fake.recordMutex.RLock()
+	defer fake.recordMutex.RUnlock()
+	return fake.recordArgsForCall[i].record
+}
+
+func (fake *FakeTaskFailureStore) RecordReturns(result1 error) {
+	fake.RecordStub = nil
+	fake.recordReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeTaskFailureStore) Lookup(taskGuid string) (bulk.TaskFailureRecord, bool, error) {
+	fake.lookupMutex.Lock()
+	fake.lookupArgsForCall = append(fake.lookupArgsForCall, struct {
+		taskGuid string
+	}{taskGuid})
+	fake.lookupMutex.Unlock()
+	if fake.LookupStub != nil {
+		return fake.LookupStub(taskGuid)
+	} else {
+		return fake.lookupReturns.result1, fake.lookupReturns.result2, fake.lookupReturns.result3
+	}
+}
+
+func (fake *FakeTaskFailureStore) LookupCallCount() int {
+	fake.lookupMutex.RLock()
+	defer fake.lookupMutex.RUnlock()
+	return len(fake.lookupArgsForCall)
+}
+
+func (fake *FakeTaskFailureStore) LookupArgsForCall(i int) string {
+	fake.lookupMutex.RLock()
+	defer fake.lookupMutex.RUnlock()
+	return fake.lookupArgsForCall[i].taskGuid
+}
+
+func (fake *FakeTaskFailureStore) LookupReturns(result1 bulk.TaskFailureRecord, result2 bool, result3 error) {
+	fake.LookupStub = nil
+	fake.lookupReturns = struct {
+		result1 bulk.TaskFailureRecord
+		result2 bool
+		result3 error
+	}{result1, result2, result3}
+}
+
+var _ bulk.TaskFailureStore = new(FakeTaskFailureStore)
@@ -5,9 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/pivotal-golang/clock"
 	"github.com/pivotal-golang/lager"
 )
 
@@ -32,6 +37,13 @@ type Fetcher interface {
 		httpClient *http.Client,
 		fingerprints <-chan []cc_messages.CCDesiredAppFingerprint,
 	) (<-chan []cc_messages.DesireAppRequestFromCC, <-chan error)
+
+	FetchTasks(
+		logger lager.Logger,
+		cancel <-chan struct{},
+		httpClient *http.Client,
+		taskStates <-chan []cc_messages.CCTaskState,
+	) (<-chan []cc_messages.TaskRequestFromCC, <-chan error)
 }
 
 type CCFetcher struct {
@@ -39,16 +51,57 @@ type CCFetcher struct {
 	BatchSize int
 	Username  string
 	Password  string
+
+	// Authenticator adds credentials to each request. When nil, basic auth
+	// with Username and Password is used.
+	Authenticator Authenticator
+
+	// MaxAttempts is the number of times a request to the bulk API is tried
+	// when it fails transiently (connection errors, 5xx and 429 responses).
+	// Values below 2 disable retries.
+	MaxAttempts      int
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	// ChunkSize caps how many desired apps are decoded before being sent
+	// downstream, bounding memory independently of BatchSize. Defaults to
+	// defaultChunkSize.
+	ChunkSize int
+
+	// PrefetchDepth is how many fingerprint or task state pages may be
+	// fetched ahead of the consumer, so that the next page request is in
+	// flight while the current one is processed.
+	PrefetchDepth int
+
+	// DesiredAppConcurrency is the number of desired app requests that may be
+	// in flight at once. Defaults to 1.
+	DesiredAppConcurrency int
+
+	// Clock times retries and Retry-After dates. Defaults to the real clock.
+	Clock clock.Clock
+}
+
+type responseError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (err *responseError) Error() string {
+	return fmt.Sprintf("invalid response code %d", err.StatusCode)
 }
 
 const initialBulkToken = "{}"
 
+const defaultChunkSize = 100
+
+var errCancelled = errors.New("cancelled")
+
 func (fetcher *CCFetcher) FetchFingerprints(
 	logger lager.Logger,
 	cancel <-chan struct{},
 	httpClient *http.Client,
 ) (<-chan []cc_messages.CCDesiredAppFingerprint, <-chan error) {
-	results := make(chan []cc_messages.CCDesiredAppFingerprint)
+	results := make(chan []cc_messages.CCDesiredAppFingerprint, fetcher.prefetchDepth())
 	errc := make(chan error, 1)
 
 	logger = logger.Session("fetch-fingerprints-from-cc")
@@ -62,15 +115,9 @@ func (fetcher *CCFetcher) FetchFingerprints(
 		for {
 			logger.Info("fetching-desired")
 
-			req, err := http.NewRequest("GET", fetcher.fingerprintURL(token), nil)
-			if err != nil {
-				errc <- err
-				return
-			}
-
 			response := cc_messages.CCDesiredStateFingerprintResponse{}
 
-			err = fetcher.doRequest(logger, httpClient, req, &response)
+			err := fetcher.doRequest(logger, cancel, httpClient, "GET", fetcher.fingerprintURL(token), nil, decodeValue(&response))
 			if err != nil {
 				errc <- err
 				return
@@ -107,65 +154,120 @@ func (fetcher *CCFetcher) FetchDesiredApps(
 	results := make(chan []cc_messages.DesireAppRequestFromCC)
 	errc := make(chan error, 1)
 
+	wg := sync.WaitGroup{}
+	for i := 0; i < fetcher.desiredAppConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fetcher.fetchDesiredApps(logger, cancel, httpClient, fingerprintCh, results, errc)
+		}()
+	}
+
 	go func() {
-		defer close(results)
-		defer close(errc)
+		wg.Wait()
+		close(results)
+		close(errc)
+	}()
 
-		for {
-			var fingerprints []cc_messages.CCDesiredAppFingerprint
+	return results, errc
+}
 
-			select {
-			case <-cancel:
+func (fetcher *CCFetcher) fetchDesiredApps(
+	logger lager.Logger,
+	cancel <-chan struct{},
+	httpClient *http.Client,
+	fingerprintCh <-chan []cc_messages.CCDesiredAppFingerprint,
+	results chan<- []cc_messages.DesireAppRequestFromCC,
+	errc chan<- error,
+) {
+	for {
+		var fingerprints []cc_messages.CCDesiredAppFingerprint
+
+		select {
+		case <-cancel:
+			return
+		case selected, ok := <-fingerprintCh:
+			if !ok {
 				return
-			case selected, ok := <-fingerprintCh:
-				if !ok {
-					return
-				}
-				fingerprints = selected
 			}
+			fingerprints = selected
+		}
 
-			if len(fingerprints) == 0 {
-				continue
-			}
+		if len(fingerprints) == 0 {
+			continue
+		}
 
-			processGuids := make([]string, len(fingerprints))
-			for i, fingerprint := range fingerprints {
-				processGuids[i] = fingerprint.ProcessGuid
-			}
+		processGuids := make([]string, len(fingerprints))
+		for i, fingerprint := range fingerprints {
+			processGuids[i] = fingerprint.ProcessGuid
+		}
 
-			payload, err := json.Marshal(processGuids)
-			if err != nil {
-				logger.Error("failed-to-marshal", err, lager.Data{"guids": processGuids})
-				errc <- err
-				return
+		payload, err := json.Marshal(processGuids)
+		if err != nil {
+			logger.Error("failed-to-marshal", err, lager.Data{"guids": processGuids})
+			select {
+			case errc <- err:
+			case <-cancel:
 			}
+			return
+		}
 
-			logger.Info("fetching-desired", lager.Data{"fingerprints-length": len(fingerprints)})
+		logger.Info("fetching-desired", lager.Data{"fingerprints-length": len(fingerprints)})
 
-			req, err := http.NewRequest("POST", fetcher.desiredURL(), bytes.NewReader(payload))
-			if err != nil {
-				logger.Error("failed-to-create-request", err)
-				errc <- err
-				continue
+		chunkSize := fetcher.chunkSize()
+		if chunkSize > len(fingerprints) {
+			chunkSize = len(fingerprints)
+		}
+
+		send := func(chunk []cc_messages.DesireAppRequestFromCC) error {
+			select {
+			case results <- chunk:
+				return nil
+			case <-cancel:
+				return errCancelled
 			}
+		}
 
-			response := []cc_messages.DesireAppRequestFromCC{}
+		err = fetcher.doRequest(logger, cancel, httpClient, "POST", fetcher.desiredURL(), payload, func(decoder *json.Decoder) error {
+			chunk := make([]cc_messages.DesireAppRequestFromCC, 0, chunkSize)
 
-			err = fetcher.doRequest(logger, httpClient, req, &response)
+			err := decodeArray(decoder, func(decoder *json.Decoder) error {
+				chunk = append(chunk, cc_messages.DesireAppRequestFromCC{})
+				err := decoder.Decode(&chunk[len(chunk)-1])
+				if err != nil {
+					return err
+				}
+
+				if len(chunk) < chunkSize {
+					return nil
+				}
+
+				err = send(chunk)
+				chunk = make([]cc_messages.DesireAppRequestFromCC, 0, chunkSize)
+				return err
+			})
 			if err != nil {
-				errc <- err
-				continue
+				return err
 			}
 
+			if len(chunk) > 0 {
+				return send(chunk)
+			}
+
+			return nil
+		})
+		if err == errCancelled {
+			return
+		}
+
+		if err != nil {
 			select {
-			case results <- response:
+			case errc <- err:
 			case <-cancel:
 				return
 			}
 		}
-	}()
-
-	return results, errc
+	}
 }
 
 func (fetcher *CCFetcher) FetchTaskStates(
@@ -173,7 +275,7 @@ func (fetcher *CCFetcher) FetchTaskStates(
 	cancel <-chan struct{},
 	httpClient *http.Client,
 ) (<-chan []cc_messages.CCTaskState, <-chan error) {
-	results := make(chan []cc_messages.CCTaskState)
+	results := make(chan []cc_messages.CCTaskState, fetcher.prefetchDepth())
 	errc := make(chan error, 1)
 
 	logger = logger.Session("fetch-task-states-from-cc")
@@ -187,15 +289,9 @@ func (fetcher *CCFetcher) FetchTaskStates(
 		for {
 			logger.Info("fetching-task-states")
 
-			req, err := http.NewRequest("GET", fetcher.taskStatesURL(token), nil)
-			if err != nil {
-				errc <- err
-				return
-			}
-
 			response := cc_messages.CCTaskStatesResponse{}
 
-			err = fetcher.doRequest(logger, httpClient, req, &response)
+			err := fetcher.doRequest(logger, cancel, httpClient, "GET", fetcher.taskStatesURL(token), nil, decodeValue(&response))
 			if err != nil {
 				errc <- err
 				return
@@ -223,14 +319,153 @@ func (fetcher *CCFetcher) FetchTaskStates(
 	return results, errc
 }
 
+// FetchTasks retrieves the full task definitions for the given task states, so
+// that tasks which never reached BBS can be desired again.
+func (fetcher *CCFetcher) FetchTasks(
+	logger lager.Logger,
+	cancel <-chan struct{},
+	httpClient *http.Client,
+	taskStateCh <-chan []cc_messages.CCTaskState,
+) (<-chan []cc_messages.TaskRequestFromCC, <-chan error) {
+	results := make(chan []cc_messages.TaskRequestFromCC)
+	errc := make(chan error, 1)
+
+	logger = logger.Session("fetch-tasks-from-cc")
+
+	go func() {
+		defer close(results)
+		defer close(errc)
+
+		for {
+			var taskStates []cc_messages.CCTaskState
+
+			select {
+			case <-cancel:
+				return
+			case selected, ok := <-taskStateCh:
+				if !ok {
+					return
+				}
+				taskStates = selected
+			}
+
+			if len(taskStates) == 0 {
+				continue
+			}
+
+			taskGuids := make([]string, len(taskStates))
+			for i, taskState := range taskStates {
+				taskGuids[i] = taskState.TaskGuid
+			}
+
+			payload, err := json.Marshal(taskGuids)
+			if err != nil {
+				logger.Error("failed-to-marshal", err, lager.Data{"guids": taskGuids})
+				errc <- err
+				return
+			}
+
+			logger.Info("fetching-tasks", lager.Data{"task-guids-length": len(taskGuids)})
+
+			response := []cc_messages.TaskRequestFromCC{}
+
+			err = fetcher.doRequest(logger, cancel, httpClient, "POST", fetcher.tasksURL(), payload, decodeValue(&response))
+			if err != nil {
+				select {
+				case errc <- err:
+				case <-cancel:
+					return
+				}
+				continue
+			}
+
+			select {
+			case results <- response:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+
+	return results, errc
+}
+
 func (fetcher *CCFetcher) doRequest(
 	logger lager.Logger,
+	cancel <-chan struct{},
 	httpClient *http.Client,
-	req *http.Request,
-	value interface{},
+	method string,
+	requestURL string,
+	payload []byte,
+	decode func(*json.Decoder) error,
 ) error {
+	maxAttempts := fetcher.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	reauthenticated := false
+	for attempt := 1; ; attempt++ {
+		err := fetcher.attemptRequest(logger, httpClient, method, requestURL, payload, decode)
+		if err == nil {
+			return nil
+		}
+
+		if isUnauthorized(err) && !reauthenticated {
+			logger.Info("reauthenticating")
+			fetcher.authenticator().Invalidate()
+			reauthenticated = true
+			attempt--
+			continue
+		}
+
+		delay, retryable := fetcher.retryDelay(err, attempt)
+		if !retryable || attempt >= maxAttempts {
+			return err
+		}
+
+		logger.Info("retrying-request", lager.Data{
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"error":   err.Error(),
+		})
+
+		timer := fetcher.clock().NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-cancel:
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (fetcher *CCFetcher) attemptRequest(
+	logger lager.Logger,
+	httpClient *http.Client,
+	method string,
+	requestURL string,
+	payload []byte,
+	decode func(*json.Decoder) error,
+) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		logger.Error("failed-to-create-request", err)
+		return err
+	}
+
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(fetcher.Username, fetcher.Password)
+
+	err = fetcher.authenticator().Authenticate(logger, httpClient, req)
+	if err != nil {
+		logger.Error("failed-to-authenticate", err)
+		return err
+	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -244,10 +479,17 @@ func (fetcher *CCFetcher) doRequest(
 	})
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid response code %d", resp.StatusCode)
+		delay, _ := retryAfter(resp.Header, fetcher.clock().Now())
+		return &responseError{StatusCode: resp.StatusCode, RetryAfter: delay}
+	}
+
+	// the body is decoded as it arrives; a failure part way through is not
+	// retried, since some of it may already have been sent downstream
+	err = decode(json.NewDecoder(resp.Body))
+	if err == errCancelled {
+		return err
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(value)
 	if err != nil {
 		logger.Error("decode-body", err)
 		return err
@@ -256,6 +498,85 @@ func (fetcher *CCFetcher) doRequest(
 	return nil
 }
 
+// retryDelay decides whether a failed request is worth retrying and how long
+// to wait first. Only failures that may go away on their own are retried. A
+// Retry-After from CC replaces the backoff, but is capped at the max retry
+// interval so that CC cannot stall a sync indefinitely.
+func (fetcher *CCFetcher) retryDelay(err error, attempt int) (time.Duration, bool) {
+	delay := backoffDelay(fetcher.RetryInterval, fetcher.MaxRetryInterval, attempt)
+
+	switch err := err.(type) {
+	case *url.Error:
+		return delay, true
+	case *responseError:
+		if err.StatusCode == http.StatusTooManyRequests {
+			if err.RetryAfter > 0 {
+				delay = err.RetryAfter
+			}
+			if max := fetcher.maxRetryInterval(); delay > max {
+				delay = max
+			}
+			return delay, true
+		}
+		return delay, err.StatusCode >= http.StatusInternalServerError
+	default:
+		return 0, false
+	}
+}
+
+func (fetcher *CCFetcher) authenticator() Authenticator {
+	if fetcher.Authenticator != nil {
+		return fetcher.Authenticator
+	}
+
+	return &BasicAuthenticator{Username: fetcher.Username, Password: fetcher.Password}
+}
+
+func (fetcher *CCFetcher) maxRetryInterval() time.Duration {
+	if fetcher.MaxRetryInterval > 0 {
+		return fetcher.MaxRetryInterval
+	}
+
+	return defaultMaxRetryInterval
+}
+
+func (fetcher *CCFetcher) clock() clock.Clock {
+	if fetcher.Clock != nil {
+		return fetcher.Clock
+	}
+
+	return clock.NewClock()
+}
+
+func (fetcher *CCFetcher) chunkSize() int {
+	if fetcher.ChunkSize > 0 {
+		return fetcher.ChunkSize
+	}
+
+	return defaultChunkSize
+}
+
+func (fetcher *CCFetcher) prefetchDepth() int {
+	if fetcher.PrefetchDepth < 0 {
+		return 0
+	}
+
+	return fetcher.PrefetchDepth
+}
+
+func (fetcher *CCFetcher) desiredAppConcurrency() int {
+	if fetcher.DesiredAppConcurrency > 0 {
+		return fetcher.DesiredAppConcurrency
+	}
+
+	return 1
+}
+
+func isUnauthorized(err error) bool {
+	respErr, ok := err.(*responseError)
+	return ok && respErr.StatusCode == http.StatusUnauthorized
+}
+
 func (fetcher *CCFetcher) fingerprintURL(bulkToken string) string {
 	return fmt.Sprintf("%s/internal/bulk/apps?batch_size=%d&format=fingerprint&token=%s", fetcher.BaseURI, fetcher.BatchSize, bulkToken)
 }
@@ -264,6 +585,10 @@ func (fetcher *CCFetcher) desiredURL() string {
 	return fmt.Sprintf("%s/internal/bulk/apps", fetcher.BaseURI)
 }
 
+func (fetcher *CCFetcher) tasksURL() string {
+	return fmt.Sprintf("%s/internal/v3/bulk/tasks", fetcher.BaseURI)
+}
+
 func (fetcher *CCFetcher) taskStatesURL(bulkToken string) string {
 	return fmt.Sprintf("%s/internal/v3/bulk/task_states?batch_size=%d&token=%s", fetcher.BaseURI, fetcher.BatchSize, bulkToken)
 }
@@ -0,0 +1,115 @@
+package bulk_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+const benchmarkAppCount = 10000
+
+// Run with `go test -run NONE -bench . -benchmem ./bulk` to compare the
+// memory used per 10k apps by the streaming fetcher against decoding the
+// whole response at once.
+
+func BenchmarkFetchDesiredApps10k(b *testing.B) {
+	body, fingerprints := benchmarkDesiredApps(b)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	fetcher := &bulk.CCFetcher{
+		BaseURI:   server.URL,
+		BatchSize: benchmarkAppCount,
+	}
+	logger := lagertest.NewTestLogger("benchmark")
+	httpClient := &http.Client{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		fingerprintCh := make(chan []cc_messages.CCDesiredAppFingerprint, 1)
+		fingerprintCh <- fingerprints
+		close(fingerprintCh)
+
+		results, errc := fetcher.FetchDesiredApps(logger, nil, httpClient, fingerprintCh)
+
+		count := 0
+		for chunk := range results {
+			count += len(chunk)
+		}
+
+		for err := range errc {
+			b.Fatal(err)
+		}
+
+		if count != benchmarkAppCount {
+			b.Fatalf("expected %d apps, got %d", benchmarkAppCount, count)
+		}
+	}
+}
+
+func BenchmarkDecodeWholeDesiredApps10k(b *testing.B) {
+	body, _ := benchmarkDesiredApps(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		response := []cc_messages.DesireAppRequestFromCC{}
+		err := json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if len(response) != benchmarkAppCount {
+			b.Fatalf("expected %d apps, got %d", benchmarkAppCount, len(response))
+		}
+	}
+}
+
+func benchmarkDesiredApps(b *testing.B) ([]byte, []cc_messages.CCDesiredAppFingerprint) {
+	apps := make([]cc_messages.DesireAppRequestFromCC, benchmarkAppCount)
+	fingerprints := make([]cc_messages.CCDesiredAppFingerprint, benchmarkAppCount)
+
+	for i := range apps {
+		processGuid := fmt.Sprintf("process-guid-%d", i)
+
+		apps[i] = cc_messages.DesireAppRequestFromCC{
+			ProcessGuid:  processGuid,
+			DropletUri:   "http://example.com/droplets/" + processGuid,
+			Stack:        "cflinuxfs2",
+			StartCommand: "bundle exec rackup config.ru -p $PORT",
+			Environment: []*models.EnvironmentVariable{
+				{Name: "VCAP_APPLICATION", Value: `{"application_name":"` + processGuid + `"}`},
+				{Name: "VCAP_SERVICES", Value: "{}"},
+			},
+			MemoryMB:        256,
+			DiskMB:          1024,
+			FileDescriptors: 16384,
+			NumInstances:    2,
+			LogGuid:         processGuid,
+			ETag:            "1234567.890",
+		}
+
+		fingerprints[i] = cc_messages.CCDesiredAppFingerprint{ProcessGuid: processGuid, ETag: "1234567.890"}
+	}
+
+	body, err := json.Marshal(apps)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return body, fingerprints
+}
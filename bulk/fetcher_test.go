@@ -11,6 +11,8 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/clock/fakeclock"
 	"github.com/pivotal-golang/lager/lagertest"
 )
 
@@ -202,6 +204,213 @@ var _ = Describe("Fetcher", func() {
 			})
 		})
 
+		Describe("retrying transient failures", func() {
+			var (
+				fingerprintsResponse string
+				fakeClock            *fakeclock.FakeClock
+			)
+
+			BeforeEach(func() {
+				fakeClock = fakeclock.NewFakeClock(time.Now())
+				fetcher = &bulk.CCFetcher{
+					BaseURI:          fakeCC.URL(),
+					BatchSize:        2,
+					Username:         "the-username",
+					Password:         "the-password",
+					MaxAttempts:      3,
+					RetryInterval:    10 * time.Millisecond,
+					MaxRetryInterval: 10 * time.Second,
+					Clock:            fakeClock,
+				}
+
+				fingerprintsResponse = `{
+					"token": {},
+					"fingerprints": [
+						{
+							"process_guid": "process-guid-1",
+							"etag": "1234567.890"
+						}
+					]
+				}`
+			})
+
+			Context("when the API returns a server error and then succeeds", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.RespondWith(503, ""),
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/internal/bulk/apps", "batch_size=2&format=fingerprint&token={}"),
+							ghttp.VerifyBasicAuth("the-username", "the-password"),
+							ghttp.RespondWith(200, fingerprintsResponse),
+						),
+					)
+				})
+
+				It("retries the request and returns the fingerprints", func() {
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					fakeClock.Increment(10 * time.Millisecond)
+
+					Eventually(resultsChan).Should(Receive(ConsistOf(
+						cc_messages.CCDesiredAppFingerprint{ProcessGuid: "process-guid-1", ETag: "1234567.890"},
+					)))
+					Consistently(errorsChan).ShouldNot(Receive())
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(2))
+				})
+			})
+
+			Context("when the API is rate limiting with a Retry-After header", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.RespondWith(429, "", http.Header{"Retry-After": []string{"1"}}),
+						ghttp.RespondWith(200, fingerprintsResponse),
+					)
+				})
+
+				It("waits before retrying the request", func() {
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					fakeClock.Increment(999 * time.Millisecond)
+					Consistently(resultsChan).ShouldNot(Receive())
+
+					fakeClock.Increment(time.Millisecond)
+					Eventually(resultsChan).Should(Receive(HaveLen(1)))
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(2))
+				})
+			})
+
+			Context("when the Retry-After header is longer than the max retry interval", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.RespondWith(429, "", http.Header{"Retry-After": []string{"3600"}}),
+						ghttp.RespondWith(200, fingerprintsResponse),
+					)
+				})
+
+				It("waits only the max retry interval", func() {
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					fakeClock.Increment(10 * time.Second)
+
+					Eventually(resultsChan).Should(Receive(HaveLen(1)))
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(2))
+				})
+			})
+
+			Context("when the API keeps failing", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.RespondWith(500, ""),
+						ghttp.RespondWith(502, ""),
+						ghttp.RespondWith(503, ""),
+					)
+				})
+
+				It("gives up after the maximum number of attempts", func() {
+					for i := 0; i < 2; i++ {
+						Eventually(fakeClock.WatcherCount).Should(Equal(1))
+						fakeClock.Increment(time.Second)
+					}
+
+					Eventually(errorsChan).Should(Receive(MatchError("invalid response code 503")))
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(3))
+				})
+			})
+
+			Context("when the API returns a client error", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(ghttp.RespondWith(403, ""))
+				})
+
+				It("does not retry the request", func() {
+					Eventually(errorsChan).Should(Receive(MatchError("invalid response code 403")))
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(1))
+				})
+			})
+
+			Context("when cancelled while waiting to retry", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.RespondWith(429, "", http.Header{"Retry-After": []string{"60"}}),
+					)
+				})
+
+				It("stops retrying", func() {
+					Eventually(fakeCC.ReceivedRequests).Should(HaveLen(1))
+					close(cancel)
+					Eventually(errorsChan).Should(Receive(MatchError("invalid response code 429")))
+					Eventually(resultsChan).Should(BeClosed())
+				})
+			})
+		})
+
+		Context("when prefetching pages", func() {
+			BeforeEach(func() {
+				fetcher = &bulk.CCFetcher{
+					BaseURI:       fakeCC.URL(),
+					BatchSize:     1,
+					PrefetchDepth: 1,
+				}
+
+				fakeCC.AppendHandlers(
+					ghttp.RespondWith(200, `{"token": {"id": "page-2"}, "fingerprints": [{"process_guid": "process-guid-1", "etag": "1"}]}`),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/internal/bulk/apps", `batch_size=1&format=fingerprint&token={"id":"page-2"}`),
+						ghttp.RespondWith(200, `{"token": {"id": "page-3"}, "fingerprints": [{"process_guid": "process-guid-2", "etag": "2"}]}`),
+					),
+					ghttp.RespondWith(200, `{"token": {}, "fingerprints": []}`),
+				)
+			})
+
+			It("requests the next page before the current one is consumed", func() {
+				Eventually(fakeCC.ReceivedRequests).Should(HaveLen(2))
+				Consistently(fakeCC.ReceivedRequests).Should(HaveLen(2))
+
+				Eventually(resultsChan).Should(Receive(HaveLen(1)))
+				Eventually(resultsChan).Should(Receive(HaveLen(1)))
+				Eventually(resultsChan).Should(Receive(BeEmpty()))
+				Expect(fakeCC.ReceivedRequests()).To(HaveLen(3))
+			})
+		})
+
+		Describe("authenticating with OAuth", func() {
+			BeforeEach(func() {
+				fetcher = &bulk.CCFetcher{
+					BaseURI:       fakeCC.URL(),
+					BatchSize:     2,
+					Authenticator: bulk.NewOAuthAuthenticator(fakeCC.URL()+"/oauth/token", "the-client", "the-secret", clock.NewClock()),
+				}
+
+				fakeCC.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("POST", "/oauth/token"),
+						ghttp.VerifyBasicAuth("the-client", "the-secret"),
+						ghttp.RespondWith(200, `{"access_token": "stale-token", "token_type": "bearer", "expires_in": 3600}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/internal/bulk/apps"),
+						ghttp.VerifyHeaderKV("Authorization", "bearer stale-token"),
+						ghttp.RespondWith(401, ""),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("POST", "/oauth/token"),
+						ghttp.RespondWith(200, `{"access_token": "fresh-token", "token_type": "bearer", "expires_in": 3600}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/internal/bulk/apps"),
+						ghttp.VerifyHeaderKV("Authorization", "bearer fresh-token"),
+						ghttp.RespondWith(200, `{
+							"token": {},
+							"fingerprints": [{"process_guid": "process-guid-1", "etag": "1234567.890"}]
+						}`),
+					),
+				)
+			})
+
+			It("refreshes the token when CC rejects it and retries the request", func() {
+				Eventually(resultsChan).Should(Receive(HaveLen(1)))
+				Consistently(errorsChan).ShouldNot(Receive())
+				Expect(fakeCC.ReceivedRequests()).To(HaveLen(4))
+			})
+		})
+
 		Describe("cancelling", func() {
 			BeforeEach(func() {
 				fakeCC.AppendHandlers(
@@ -372,6 +581,112 @@ var _ = Describe("Fetcher", func() {
 			})
 		})
 
+		Context("when fetching with concurrency", func() {
+			var arrived chan struct{}
+			var release chan struct{}
+
+			BeforeEach(func() {
+				fetcher = &bulk.CCFetcher{
+					BaseURI:               fakeCC.URL(),
+					BatchSize:             1,
+					DesiredAppConcurrency: 2,
+				}
+
+				arrived = make(chan struct{}, 2)
+				release = make(chan struct{})
+
+				blockingHandler := func(w http.ResponseWriter, req *http.Request) {
+					arrived <- struct{}{}
+					<-release
+					w.Write([]byte(`[{"process_guid": "some-process-guid"}]`))
+				}
+				fakeCC.AppendHandlers(blockingHandler, blockingHandler)
+
+				fingerprintsChan = make(chan []cc_messages.CCDesiredAppFingerprint, 2)
+				fingerprintsChan <- []cc_messages.CCDesiredAppFingerprint{{ProcessGuid: "process-guid-1"}}
+				fingerprintsChan <- []cc_messages.CCDesiredAppFingerprint{{ProcessGuid: "process-guid-2"}}
+				close(fingerprintsChan)
+			})
+
+			It("sends the requests in parallel", func() {
+				Eventually(arrived).Should(Receive())
+				Eventually(arrived).Should(Receive())
+				close(release)
+
+				Eventually(resultsChan).Should(Receive(HaveLen(1)))
+				Eventually(resultsChan).Should(Receive(HaveLen(1)))
+				Eventually(resultsChan).Should(BeClosed())
+				Eventually(errorsChan).Should(BeClosed())
+			})
+		})
+
+		Context("when the response is larger than the chunk size", func() {
+			BeforeEach(func() {
+				fetcher = &bulk.CCFetcher{
+					BaseURI:   fakeCC.URL(),
+					BatchSize: 3,
+					ChunkSize: 2,
+				}
+
+				fakeCC.AppendHandlers(
+					ghttp.RespondWithJSONEncoded(200, []cc_messages.DesireAppRequestFromCC{
+						{ProcessGuid: "process-guid-1"},
+						{ProcessGuid: "process-guid-2"},
+						{ProcessGuid: "process-guid-3"},
+					}),
+				)
+
+				fingerprintsChan <- []cc_messages.CCDesiredAppFingerprint{
+					{ProcessGuid: "process-guid-1"},
+					{ProcessGuid: "process-guid-2"},
+					{ProcessGuid: "process-guid-3"},
+				}
+				close(fingerprintsChan)
+			})
+
+			It("sends the desired apps downstream in chunks", func() {
+				Eventually(resultsChan).Should(Receive(ConsistOf(
+					cc_messages.DesireAppRequestFromCC{ProcessGuid: "process-guid-1"},
+					cc_messages.DesireAppRequestFromCC{ProcessGuid: "process-guid-2"},
+				)))
+				Eventually(resultsChan).Should(Receive(ConsistOf(
+					cc_messages.DesireAppRequestFromCC{ProcessGuid: "process-guid-3"},
+				)))
+
+				Eventually(resultsChan).Should(BeClosed())
+				Consistently(errorsChan).ShouldNot(Receive())
+			})
+		})
+
+		Context("when the response is truncated", func() {
+			BeforeEach(func() {
+				fetcher = &bulk.CCFetcher{
+					BaseURI:   fakeCC.URL(),
+					BatchSize: 2,
+					ChunkSize: 1,
+				}
+
+				fakeCC.AppendHandlers(ghttp.RespondWith(200, `[{"process_guid": "process-guid-1"}, {"process_gu`))
+
+				fingerprintsChan <- []cc_messages.CCDesiredAppFingerprint{
+					{ProcessGuid: "process-guid-1"},
+					{ProcessGuid: "process-guid-2"},
+				}
+			})
+
+			It("sends the apps decoded so far and then an error", func() {
+				Eventually(resultsChan).Should(Receive(ConsistOf(
+					cc_messages.DesireAppRequestFromCC{ProcessGuid: "process-guid-1"},
+				)))
+				Eventually(errorsChan).Should(Receive(HaveOccurred()))
+				Expect(fakeCC.ReceivedRequests()).To(HaveLen(1))
+
+				close(fingerprintsChan)
+				Eventually(errorsChan).Should(BeClosed())
+				Eventually(resultsChan).Should(BeClosed())
+			})
+		})
+
 		Context("when the fingerprint batch is empty", func() {
 			BeforeEach(func() {
 				fingerprintsChan <- []cc_messages.CCDesiredAppFingerprint{}
@@ -428,6 +743,44 @@ var _ = Describe("Fetcher", func() {
 			})
 		})
 
+		Context("when the API fails transiently", func() {
+			BeforeEach(func() {
+				fetcher = &bulk.CCFetcher{
+					BaseURI:       fakeCC.URL(),
+					BatchSize:     2,
+					Username:      "the-username",
+					Password:      "the-password",
+					MaxAttempts:   2,
+					RetryInterval: 10 * time.Millisecond,
+				}
+
+				fakeCC.AppendHandlers(
+					ghttp.RespondWith(500, ""),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("POST", "/internal/bulk/apps"),
+						ghttp.VerifyJSON(`["process-guid"]`),
+						ghttp.RespondWithJSONEncoded(200, []cc_messages.DesireAppRequestFromCC{
+							{ProcessGuid: "process-guid", ETag: "123"},
+						}),
+					),
+				)
+
+				fingerprintsChan <- []cc_messages.CCDesiredAppFingerprint{
+					{ProcessGuid: "process-guid", ETag: "123"},
+				}
+			})
+
+			It("resends the same request body and returns the desired apps", func() {
+				Eventually(resultsChan).Should(Receive(ConsistOf(
+					cc_messages.DesireAppRequestFromCC{ProcessGuid: "process-guid", ETag: "123"},
+				)))
+				Expect(fakeCC.ReceivedRequests()).To(HaveLen(2))
+
+				close(fingerprintsChan)
+				Eventually(errorsChan).Should(BeClosed())
+			})
+		})
+
 		Context("when the server responds with invalid JSON", func() {
 			BeforeEach(func() {
 				fakeCC.AppendHandlers(ghttp.RespondWith(200, "{"))
@@ -672,4 +1025,74 @@ var _ = Describe("Fetcher", func() {
 			})
 		})
 	})
+
+	Describe("Fetching Tasks", func() {
+		var (
+			taskStatesChan chan []cc_messages.CCTaskState
+			resultsChan    <-chan []cc_messages.TaskRequestFromCC
+			errorsChan     <-chan error
+		)
+
+		BeforeEach(func() {
+			taskStatesChan = make(chan []cc_messages.CCTaskState, 1)
+		})
+
+		JustBeforeEach(func() {
+			resultsChan, errorsChan = fetcher.FetchTasks(logger, cancel, httpClient, taskStatesChan)
+		})
+
+		AfterEach(func() {
+			Eventually(resultsChan).Should(BeClosed())
+			Eventually(errorsChan).Should(BeClosed())
+		})
+
+		Context("when retrieving tasks", func() {
+			BeforeEach(func() {
+				fakeCC.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("POST", "/internal/v3/bulk/tasks"),
+						ghttp.VerifyBasicAuth("the-username", "the-password"),
+						ghttp.VerifyJSON(`["task-guid-1", "task-guid-2"]`),
+						ghttp.RespondWith(200, `[
+							{"task_guid": "task-guid-1", "lifecycle": "buildpack"},
+							{"task_guid": "task-guid-2", "lifecycle": "docker"}
+						]`),
+					),
+				)
+
+				taskStatesChan <- []cc_messages.CCTaskState{
+					{TaskGuid: "task-guid-1", State: cc_messages.TaskStatePending},
+					{TaskGuid: "task-guid-2", State: cc_messages.TaskStatePending},
+				}
+				close(taskStatesChan)
+			})
+
+			It("sends the task requests on the results channel", func() {
+				Eventually(resultsChan).Should(Receive(ConsistOf(
+					cc_messages.TaskRequestFromCC{TaskGuid: "task-guid-1", Lifecycle: "buildpack"},
+					cc_messages.TaskRequestFromCC{TaskGuid: "task-guid-2", Lifecycle: "docker"},
+				)))
+				Consistently(errorsChan).ShouldNot(Receive())
+			})
+		})
+
+		Context("when the API returns an error response", func() {
+			BeforeEach(func() {
+				fakeCC.AppendHandlers(ghttp.RespondWith(403, ""))
+
+				taskStatesChan <- []cc_messages.CCTaskState{{TaskGuid: "task-guid-1"}}
+				close(taskStatesChan)
+			})
+
+			It("sends an error on the error channel", func() {
+				Eventually(errorsChan).Should(Receive(MatchError(ContainSubstring("403"))))
+			})
+		})
+
+		Context("when cancelled while waiting for task states", func() {
+			It("exits", func() {
+				close(cancel)
+			})
+		})
+	})
 })
@@ -0,0 +1,40 @@
+package bulk
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+func decodeValue(value interface{}) func(*json.Decoder) error {
+	return func(decoder *json.Decoder) error {
+		return decoder.Decode(value)
+	}
+}
+
+// decodeArray walks a JSON array one element at a time, leaving decodeElement
+// to consume each element from the decoder, so that the whole array never has
+// to be held in memory. A null array is treated as empty.
+func decodeArray(decoder *json.Decoder, decodeElement func(*json.Decoder) error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if token == nil {
+		return nil
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected JSON array, got %v", token)
+	}
+
+	for decoder.More() {
+		err := decodeElement(decoder)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = decoder.Token()
+	return err
+}
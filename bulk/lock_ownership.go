@@ -0,0 +1,138 @@
+package bulk
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/metric"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+const abandonedWrites = metric.Metric("NsyncAbandonedWrites")
+
+// LockOwnership signals the processors when the bulker stops holding its
+// lock, so that they cancel any sync in progress rather than keep writing
+// alongside the new lock holder.
+type LockOwnership struct {
+	lost     chan struct{}
+	loseOnce sync.Once
+}
+
+func NewLockOwnership() *LockOwnership {
+	return &LockOwnership{
+		lost: make(chan struct{}),
+	}
+}
+
+// Watch wraps the lock runner, losing ownership as soon as it exits.
+func (o *LockOwnership) Watch(lockRunner ifrit.Runner) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		defer o.Lose()
+		return lockRunner.Run(signals, ready)
+	})
+}
+
+func (o *LockOwnership) Lose() {
+	o.loseOnce.Do(func() {
+		close(o.lost)
+	})
+}
+
+// Lost is closed once ownership is lost; it never fires for a nil
+// LockOwnership.
+func (o *LockOwnership) Lost() <-chan struct{} {
+	if o == nil {
+		return nil
+	}
+
+	return o.lost
+}
+
+var errWriteAbandoned = errors.New("write abandoned")
+
+// writeGuard stops the writes of a sync once it is cancelled, the lock is
+// lost or the operator pauses syncing, counting those it skips. BBS writes
+// also pass through the limiter.
+type writeGuard struct {
+	cancel    <-chan struct{}
+	lost      <-chan struct{}
+	paused    func() bool
+	limiter   *WriteLimiter
+	abandoned int32
+}
+
+func newWriteGuard(cancel <-chan struct{}, lost <-chan struct{}, paused func() bool, limiter *WriteLimiter) *writeGuard {
+	return &writeGuard{cancel: cancel, lost: lost, paused: paused, limiter: limiter}
+}
+
+// proceed reports whether a write may go ahead. A sync already running when
+// syncing is paused makes no further writes.
+func (g *writeGuard) proceed() bool {
+	select {
+	case <-g.cancel:
+	case <-g.lost:
+	default:
+		if !g.paused() {
+			return true
+		}
+	}
+
+	atomic.AddInt32(&g.abandoned, 1)
+	return false
+}
+
+// write makes a BBS write once the limiter allows it, returning
+// errWriteAbandoned instead if the sync stops first.
+func (g *writeGuard) write(write func() error) error {
+	if !g.limiter.Wait(g.cancel, g.lost) {
+		atomic.AddInt32(&g.abandoned, 1)
+		return errWriteAbandoned
+	}
+
+	if !g.proceed() {
+		return errWriteAbandoned
+	}
+
+	return g.limiter.Do(write)
+}
+
+func (g *writeGuard) abandonedCount() int {
+	return int(atomic.LoadInt32(&g.abandoned))
+}
+
+// abandonSync cancels a sync and waits for its pipeline's errors to close,
+// then reports how many writes the sync of domain skipped. A signal stops the
+// wait early.
+func abandonSync(
+	logger lager.Logger,
+	cancelCh chan struct{},
+	guard *writeGuard,
+	domain string,
+	errors <-chan error,
+	signals <-chan os.Signal,
+) {
+	close(cancelCh)
+
+drain_loop:
+	for errors != nil {
+		select {
+		case _, open := <-errors:
+			if !open {
+				break drain_loop
+			}
+		case <-signals:
+			break drain_loop
+		}
+	}
+
+	count := guard.abandonedCount()
+	logger.Info("abandoned-writes", lager.Data{"count": count})
+
+	err := metric.Metric(sourceMetric(string(abandonedWrites), domain)).Send(count)
+	if err != nil {
+		logger.Error("failed-to-send-abandoned-writes-metric", err)
+	}
+}
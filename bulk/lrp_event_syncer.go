@@ -0,0 +1,291 @@
+package bulk
+
+import (
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bbs/events"
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+const eventResubscribeInterval = 5 * time.Second
+
+// lrpEventSyncer re-checks single LRPs against CC as soon as BBS reports them
+// changed, rather than leaving them to the next full sync. Events arriving
+// within the batch interval are re-checked together. Removed LRPs are left to
+// the full sync: the listener removes an LRP as soon as CC stops its app, and
+// CC may still list the app for a moment, so desiring it again at once could
+// restart an app its user just stopped.
+type lrpEventSyncer struct {
+	processor     *LRPProcessor
+	batchInterval time.Duration
+}
+
+// NewEventSyncer returns a runner that shares the processor's shard, lock
+// ownership and pause state.
+func (l *LRPProcessor) NewEventSyncer(batchInterval time.Duration) ifrit.Runner {
+	return &lrpEventSyncer{
+		processor:     l,
+		batchInterval: batchInterval,
+	}
+}
+
+func (s *lrpEventSyncer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := s.processor.logger.Session("event-sync")
+	logger.Info("starting")
+	defer logger.Info("done")
+
+	guids := make(chan string)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go s.streamEvents(logger, guids, stop)
+
+	close(ready)
+
+	pending := map[string]struct{}{}
+	var timer clock.Timer
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case <-signals:
+			return nil
+
+		case <-s.processor.ownership.Lost():
+			logger.Info("lock-lost")
+			return nil
+
+		case guid := <-guids:
+			pending[guid] = struct{}{}
+			if timer == nil {
+				timer = s.processor.clock.NewTimer(s.batchInterval)
+				flush = timer.C()
+			}
+
+		case <-flush:
+			timer = nil
+			flush = nil
+
+			processGuids := make([]string, 0, len(pending))
+			for guid := range pending {
+				processGuids = append(processGuids, guid)
+			}
+			pending = map[string]struct{}{}
+
+			if s.processor.Paused() {
+				logger.Info("paused-skipping-recheck", lager.Data{"process-guids": processGuids})
+				continue
+			}
+
+			s.recheck(logger, processGuids)
+		}
+	}
+}
+
+// streamEvents sends the process guid of every LRP in the shard that is
+// changed or removed in BBS, resubscribing whenever the stream fails.
+func (s *lrpEventSyncer) streamEvents(logger lager.Logger, guids chan<- string, stop <-chan struct{}) {
+	var retry clock.Timer
+	defer func() {
+		if retry != nil {
+			retry.Stop()
+		}
+	}()
+
+	for {
+		eventSource, err := s.processor.bbsClient.SubscribeToEvents(logger)
+		if err != nil {
+			logger.Error("failed-subscribing-to-events", err)
+		} else {
+			logger.Info("subscribed-to-events")
+			if !s.forwardEvents(logger, eventSource, guids, stop) {
+				return
+			}
+		}
+
+		if retry == nil {
+			retry = s.processor.clock.NewTimer(eventResubscribeInterval)
+		} else {
+			retry.Reset(eventResubscribeInterval)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-retry.C():
+		}
+	}
+}
+
+// forwardEvents reads events until the source fails, returning false if it
+// was stopped instead.
+func (s *lrpEventSyncer) forwardEvents(
+	logger lager.Logger,
+	eventSource events.EventSource,
+	guids chan<- string,
+	stop <-chan struct{},
+) bool {
+	done := make(chan struct{})
+	defer close(done)
+
+	// closing the source unblocks Next when stopping
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		eventSource.Close()
+	}()
+
+	for {
+		event, err := eventSource.Next()
+		if err != nil {
+			select {
+			case <-stop:
+				return false
+			default:
+			}
+
+			logger.Error("failed-getting-next-event", err)
+			return true
+		}
+
+		guid, ok := s.changedProcessGuid(event)
+		if !ok {
+			continue
+		}
+
+		logger.Debug("lrp-changed-in-bbs", lager.Data{"process-guid": guid, "event-type": event.EventType()})
+
+		select {
+		case guids <- guid:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+func (s *lrpEventSyncer) changedProcessGuid(event models.Event) (string, bool) {
+	changed, ok := event.(*models.DesiredLRPChangedEvent)
+	if !ok {
+		return "", false
+	}
+
+	lrp := changed.After
+	if lrp == nil || lrp.Domain != s.processor.domain || !s.processor.shard.Owns(lrp.ProcessGuid) {
+		return "", false
+	}
+
+	// the bulker's own writes need no re-check against CC
+	if s.processor.ownWrites.recent(lrp.ProcessGuid) {
+		return "", false
+	}
+
+	return lrp.ProcessGuid, true
+}
+
+// recheck fetches the desired apps for the process guids from CC and
+// repairs their LRPs as a full sync would.
+func (s *lrpEventSyncer) recheck(logger lager.Logger, processGuids []string) {
+	logger = logger.Session("recheck")
+	logger.Info("starting", lager.Data{"process-guids": processGuids})
+	defer logger.Info("done")
+
+	desiredApps, err := s.processor.fetchDesiredAppsByGuid(logger, processGuids)
+	if err != nil {
+		// without a complete answer from CC, an app missing from the
+		// response cannot be told apart from one CC no longer wants
+		logger.Error("failed-fetching-desired-apps", err)
+		return
+	}
+
+	guard := newWriteGuard(nil, s.processor.ownership.Lost(), s.processor.Paused, s.processor.writeLimiter)
+
+	for _, guid := range processGuids {
+		select {
+		case <-s.processor.ownership.Lost():
+			logger.Info("lock-lost-cancelling-recheck")
+			return
+		default:
+		}
+
+		s.recheckLRP(logger, guard, guid, desiredApps[guid])
+	}
+}
+
+func (s *lrpEventSyncer) recheckLRP(logger lager.Logger, guard *writeGuard, processGuid string, desireAppRequest *cc_messages.DesireAppRequestFromCC) {
+	bbsClient := s.processor.bbsClient
+	logger = logger.Session("recheck-lrp", lager.Data{"process-guid": processGuid})
+
+	existing, err := bbsClient.DesiredLRPByProcessGuid(logger, processGuid)
+	if err != nil && models.ConvertError(err).Type != models.Error_ResourceNotFound {
+		logger.Error("failed-getting-desired-lrp", err)
+		return
+	}
+	found := err == nil
+
+	if desireAppRequest == nil {
+		if !found {
+			return
+		}
+
+		logger.Info("removing-lrp-not-desired-by-cc")
+		err = s.processor.writeLRP(guard, processGuid, func() error {
+			return bbsClient.RemoveDesiredLRP(logger, processGuid)
+		})
+		if err != nil {
+			logger.Error("failed-removing-lrp", err)
+			return
+		}
+		s.processor.deleteSSHKeys(logger, processGuid)
+		return
+	}
+
+	if !found {
+		// removed since it changed, possibly because CC stopped it
+		logger.Info("lrp-removed-leaving-to-sync")
+		return
+	}
+
+	builder := s.processor.builderFor(desireAppRequest)
+
+	schedulingInfo := existing.DesiredLRPSchedulingInfo()
+
+	update, err := buildUpdate(logger, builder, desireAppRequest, &schedulingInfo)
+	if err != nil && !invalidRoutes(err) {
+		return
+	}
+
+	if schedulingInfo.Annotation == desireAppRequest.ETag {
+		desired, err := builder.Build(desireAppRequest)
+		if err != nil {
+			logger.Error("failed-building-desired-lrp-for-drift-check", err)
+			return
+		}
+
+		reasons := lrpDrift(&schedulingInfo, update, desired)
+		if len(reasons) == 0 {
+			return
+		}
+
+		logger.Info("found-drifted-lrp", lager.Data{"reasons": reasons})
+
+		if !repairableDrift(reasons) {
+			logger.Info("drift-not-repairable-by-update", lager.Data{"reasons": reasons})
+			return
+		}
+	}
+
+	logger.Info("updating-changed-lrp")
+	err = s.processor.writeLRP(guard, processGuid, func() error {
+		return bbsClient.UpdateDesiredLRP(logger, processGuid, update)
+	})
+	if err != nil {
+		logger.Error("failed-updating-lrp", err)
+	}
+}
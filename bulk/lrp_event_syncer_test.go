@@ -0,0 +1,275 @@
+package bulk_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bbs/events/eventfakes"
+	"github.com/cloudfoundry-incubator/bbs/fake_bbs"
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+)
+
+var _ = Describe("LRP event syncer", func() {
+	var (
+		bbsClient        *fake_bbs.FakeClient
+		eventSource      *eventfakes.FakeEventSource
+		fetcher          *fakes.FakeFetcher
+		buildpackBuilder *fakes.FakeRecipeBuilder
+		clock            *fakeclock.FakeClock
+		logger           *lagertest.TestLogger
+
+		events      chan models.Event
+		desiredApps []cc_messages.DesireAppRequestFromCC
+
+		process ifrit.Process
+	)
+
+	BeforeEach(func() {
+		bbsClient = new(fake_bbs.FakeClient)
+		eventSource = new(eventfakes.FakeEventSource)
+		fetcher = new(fakes.FakeFetcher)
+		buildpackBuilder = new(fakes.FakeRecipeBuilder)
+		clock = fakeclock.NewFakeClock(time.Now())
+
+		events = make(chan models.Event, 10)
+		closed := make(chan struct{})
+		eventSource.NextStub = func() (models.Event, error) {
+			select {
+			case event := <-events:
+				return event, nil
+			case <-closed:
+				return nil, errors.New("closed")
+			}
+		}
+		var closeOnce sync.Once
+		eventSource.CloseStub = func() error {
+			closeOnce.Do(func() { close(closed) })
+			return nil
+		}
+		bbsClient.SubscribeToEventsReturns(eventSource, nil)
+
+		desiredApps = nil
+		fetcher.FetchDesiredAppsStub = func(
+			logger lager.Logger,
+			cancel <-chan struct{},
+			httpClient *http.Client,
+			fingerprints <-chan []cc_messages.CCDesiredAppFingerprint,
+		) (<-chan []cc_messages.DesireAppRequestFromCC, <-chan error) {
+			<-fingerprints
+
+			results := make(chan []cc_messages.DesireAppRequestFromCC, 1)
+			errc := make(chan error, 1)
+
+			results <- desiredApps
+			close(results)
+			close(errc)
+
+			return results, errc
+		}
+
+		buildpackBuilder.BuildReturns(&models.DesiredLRP{ProcessGuid: "the-process-guid"}, nil)
+	})
+
+	JustBeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		processor := bulk.NewLRPProcessor(
+			logger,
+			bbsClient,
+			500*time.Millisecond,
+			cc_messages.AppLRPDomain,
+			time.Second,
+			0,
+			10,
+			50,
+			&tls.Config{},
+			fetcher,
+			map[string]recipebuilder.RecipeBuilder{
+				"buildpack": buildpackBuilder,
+				"docker":    new(fakes.FakeRecipeBuilder),
+			},
+			nil,
+			bulk.Shard{},
+			nil,
+			bulk.NewLockOwnership(),
+			clock,
+		)
+
+		process = ifrit.Invoke(processor.NewEventSyncer(time.Second))
+		Eventually(bbsClient.SubscribeToEventsCallCount).Should(Equal(1))
+	})
+
+	AfterEach(func() {
+		ginkgomon.Interrupt(process)
+	})
+
+	sendEvent := func(event models.Event) {
+		events <- event
+		Eventually(clock.WatcherCount).Should(Equal(1))
+		clock.Increment(time.Second)
+	}
+
+	appLRP := &models.DesiredLRP{ProcessGuid: "the-process-guid", Domain: cc_messages.AppLRPDomain}
+
+	Context("when an LRP CC still desires is removed from BBS", func() {
+		BeforeEach(func() {
+			desiredApps = []cc_messages.DesireAppRequestFromCC{
+				{ProcessGuid: "the-process-guid", ETag: "the-etag"},
+			}
+			bbsClient.DesiredLRPByProcessGuidReturns(nil, models.ErrResourceNotFound)
+		})
+
+		It("leaves it to the full sync, as CC may be stopping the app", func() {
+			events <- models.NewDesiredLRPRemovedEvent(appLRP)
+
+			Consistently(clock.WatcherCount).Should(Equal(0))
+			Expect(fetcher.FetchDesiredAppsCallCount()).To(Equal(0))
+			Expect(bbsClient.DesireLRPCallCount()).To(Equal(0))
+		})
+
+		Context("after it changed", func() {
+			It("does not desire it again", func() {
+				sendEvent(models.NewDesiredLRPChangedEvent(appLRP, appLRP))
+
+				Eventually(logger.TestSink.Buffer).Should(gbytes.Say("lrp-removed-leaving-to-sync"))
+				Expect(bbsClient.DesireLRPCallCount()).To(Equal(0))
+			})
+		})
+	})
+
+	Context("when an LRP CC no longer desires is changed in BBS", func() {
+		BeforeEach(func() {
+			bbsClient.DesiredLRPByProcessGuidReturns(appLRP, nil)
+		})
+
+		It("removes it", func() {
+			sendEvent(models.NewDesiredLRPChangedEvent(appLRP, appLRP))
+
+			Eventually(bbsClient.RemoveDesiredLRPCallCount).Should(Equal(1))
+			_, guid := bbsClient.RemoveDesiredLRPArgsForCall(0)
+			Expect(guid).To(Equal("the-process-guid"))
+		})
+	})
+
+	Context("when an LRP is changed to differ from CC", func() {
+		BeforeEach(func() {
+			desiredApps = []cc_messages.DesireAppRequestFromCC{
+				{ProcessGuid: "the-process-guid", ETag: "new-etag", NumInstances: 3},
+			}
+			bbsClient.DesiredLRPByProcessGuidReturns(&models.DesiredLRP{
+				ProcessGuid: "the-process-guid",
+				Domain:      cc_messages.AppLRPDomain,
+				Annotation:  "old-etag",
+				Instances:   1,
+			}, nil)
+		})
+
+		It("updates it from CC", func() {
+			sendEvent(models.NewDesiredLRPChangedEvent(appLRP, appLRP))
+
+			Eventually(bbsClient.UpdateDesiredLRPCallCount).Should(Equal(1))
+			_, guid, update := bbsClient.UpdateDesiredLRPArgsForCall(0)
+			Expect(guid).To(Equal("the-process-guid"))
+			Expect(*update.Instances).To(BeEquivalentTo(3))
+			Expect(*update.Annotation).To(Equal("new-etag"))
+		})
+	})
+
+	Context("when an LRP outside the CC app domain changes", func() {
+		It("ignores it", func() {
+			other := &models.DesiredLRP{ProcessGuid: "other", Domain: "other-domain"}
+			events <- models.NewDesiredLRPChangedEvent(other, other)
+
+			Consistently(clock.WatcherCount).Should(Equal(0))
+			Expect(fetcher.FetchDesiredAppsCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when fetching the app from CC fails", func() {
+		BeforeEach(func() {
+			bbsClient.DesiredLRPByProcessGuidReturns(appLRP, nil)
+
+			fetcher.FetchDesiredAppsStub = func(
+				logger lager.Logger,
+				cancel <-chan struct{},
+				httpClient *http.Client,
+				fingerprints <-chan []cc_messages.CCDesiredAppFingerprint,
+			) (<-chan []cc_messages.DesireAppRequestFromCC, <-chan error) {
+				results := make(chan []cc_messages.DesireAppRequestFromCC)
+				errc := make(chan error, 1)
+
+				errc <- errors.New("oh no")
+				close(results)
+				close(errc)
+
+				return results, errc
+			}
+		})
+
+		It("does not remove the LRP", func() {
+			sendEvent(models.NewDesiredLRPChangedEvent(appLRP, appLRP))
+
+			Eventually(fetcher.FetchDesiredAppsCallCount).Should(Equal(1))
+			Consistently(bbsClient.RemoveDesiredLRPCallCount).Should(Equal(0))
+		})
+	})
+
+	Context("when the event stream fails", func() {
+		BeforeEach(func() {
+			bbsClient.SubscribeToEventsReturns(nil, errors.New("boom"))
+		})
+
+		It("resubscribes", func() {
+			Eventually(clock.WatcherCount).Should(Equal(1))
+			clock.Increment(5 * time.Second)
+			Eventually(bbsClient.SubscribeToEventsCallCount).Should(Equal(2))
+		})
+	})
+
+	Context("when the event is for an LRP the bulker just wrote", func() {
+		BeforeEach(func() {
+			bbsClient.DesiredLRPByProcessGuidReturns(appLRP, nil)
+		})
+
+		It("does not re-check it", func() {
+			sendEvent(models.NewDesiredLRPChangedEvent(appLRP, appLRP))
+			Eventually(bbsClient.RemoveDesiredLRPCallCount).Should(Equal(1))
+
+			events <- models.NewDesiredLRPChangedEvent(appLRP, appLRP)
+
+			Consistently(clock.WatcherCount).Should(Equal(0))
+			Expect(fetcher.FetchDesiredAppsCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the event stream keeps failing", func() {
+		BeforeEach(func() {
+			bbsClient.SubscribeToEventsReturns(nil, errors.New("boom"))
+		})
+
+		It("reuses a single resubscribe timer", func() {
+			for i := 2; i <= 4; i++ {
+				Eventually(clock.WatcherCount).Should(Equal(1))
+				clock.Increment(5 * time.Second)
+				Eventually(bbsClient.SubscribeToEventsCallCount).Should(Equal(i))
+			}
+
+			Consistently(clock.WatcherCount).Should(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,492 @@
+package bulk
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	"github.com/cloudfoundry-incubator/runtime-schema/metric"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+const (
+	outdatedRecipeLRPs = metric.Metric("NsyncOutdatedRecipeLRPs")
+	migratedRecipeLRPs = metric.Counter("NsyncMigratedRecipeLRPs")
+)
+
+const (
+	// migrateDesireAttempts is the number of times a removed LRP is desired
+	// before leaving it to the surge LRP and the next sync.
+	migrateDesireAttempts = 3
+
+	// migrateStartTimeout is how long the migrator waits for the instances
+	// of a surge or replacement LRP to run.
+	migrateStartTimeout = 10 * time.Minute
+
+	// migratePollInterval is how often the migrator checks whether they do.
+	migratePollInterval = 5 * time.Second
+
+	// surgeSuffix is appended to an LRP's process guid to name its surge
+	// LRP, and to the processor's domain to name the surge LRPs' domain.
+	surgeSuffix = "-migration"
+)
+
+var errMigrationStopped = errors.New("migration stopped")
+
+// lrpMigrator replaces LRPs built with another recipe version than the
+// current one, which CC's ETags alone never would. LRPs whose version is
+// unknown are left alone.
+//
+// BBS cannot update an LRP's actions, so each LRP is removed and desired
+// again. To keep the app up meanwhile, a surge LRP, a copy of the
+// replacement under another process guid and in a domain no sync owns, is
+// desired first with as many instances as the app runs. The LRP is only
+// replaced once the surge's instances run, and the surge is removed once the
+// replacement's run. Apps briefly need twice their instances, so one LRP is
+// replaced per interval, and LRPs with more than maxInstances instances are
+// left alone. Surge LRPs left behind, for instance by a migrator that was
+// stopped, are removed once their LRP runs again.
+type lrpMigrator struct {
+	processor    *LRPProcessor
+	interval     time.Duration
+	maxInstances int
+	stamp        func() string
+}
+
+// NewMigrator returns a runner that replaces the LRPs in the processor's
+// domain and shard whose recipe stamp is not the one stamp returns, one
+// every interval. LRPs with more than maxInstances instances are skipped,
+// unless maxInstances is 0. It shares the processor's lock ownership and
+// pause state.
+func (l *LRPProcessor) NewMigrator(interval time.Duration, maxInstances int, stamp func() string) ifrit.Runner {
+	return &lrpMigrator{
+		processor:    l,
+		interval:     interval,
+		maxInstances: maxInstances,
+		stamp:        stamp,
+	}
+}
+
+func (m *lrpMigrator) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := m.processor.logger.Session("migrate-recipes")
+	logger.Info("starting")
+	defer logger.Info("done")
+
+	close(ready)
+
+	var outdated []string
+	var stamp string
+	migratedCount := 0
+
+	timer := m.processor.clock.NewTimer(m.interval)
+
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-m.processor.ownership.Lost():
+			logger.Info("lock-lost")
+			return nil
+		case <-timer.C():
+		}
+
+		if m.processor.Paused() {
+			logger.Info("paused-skipping-migration")
+			timer.Reset(m.interval)
+			continue
+		}
+
+		// the recipe config was reloaded; the remaining LRPs may already
+		// be current, or others outdated
+		if current := m.stamp(); len(outdated) > 0 && current != stamp {
+			logger.Info("recipe-version-changed", lager.Data{"from": stamp, "to": current})
+			outdated = nil
+		}
+
+		if len(outdated) == 0 {
+			stamp = m.stamp()
+
+			m.removeLeftoverSurges(logger)
+
+			var err error
+			outdated, err = m.findOutdated(logger, stamp)
+			if err != nil {
+				timer.Reset(m.processor.pollingInterval)
+				continue
+			}
+
+			m.reportRemaining(logger, len(outdated))
+
+			if len(outdated) == 0 {
+				if migratedCount > 0 {
+					logger.Info("migration-complete", lager.Data{"migrated": migratedCount})
+					migratedCount = 0
+				}
+
+				// nothing left to migrate; look again as often as the
+				// processor syncs, in case an older nsync desires more
+				timer.Reset(m.processor.pollingInterval)
+				continue
+			}
+
+			logger.Info("found-outdated-lrps", lager.Data{"count": len(outdated), "recipe-version": stamp})
+		}
+
+		processGuid := outdated[0]
+		outdated = outdated[1:]
+
+		migrated, err := m.migrate(logger, signals, processGuid, stamp)
+		if err != nil {
+			return nil
+		}
+
+		if migrated {
+			migratedCount++
+			logger.Info("migrated-lrp", lager.Data{
+				"process-guid": processGuid,
+				"migrated":     migratedCount,
+				"remaining":    len(outdated),
+			})
+
+			err := metric.Counter(sourceMetric(string(migratedRecipeLRPs), m.processor.domain)).Increment()
+			if err != nil {
+				logger.Error("failed-to-send-migrated-recipe-lrps-metric", err)
+			}
+		}
+
+		m.reportRemaining(logger, len(outdated))
+		timer.Reset(m.interval)
+	}
+}
+
+// findOutdated returns the process guids of the LRPs to migrate, in order.
+// The recipe version is not part of the scheduling infos, so the full LRPs
+// are listed. LRPs without a recipe version were built before versions were
+// recorded; what they were built with is unknown, so they are left alone.
+func (m *lrpMigrator) findOutdated(logger lager.Logger, stamp string) ([]string, error) {
+	logger.Info("getting-desired-lrps-from-bbs")
+	desiredLRPs, err := m.processor.bbsClient.DesiredLRPs(logger, models.DesiredLRPFilter{Domain: m.processor.domain})
+	if err != nil {
+		logger.Error("failed-getting-desired-lrps-from-bbs", err)
+		return nil, err
+	}
+
+	outdated := []string{}
+	skipped := 0
+	unknown := 0
+	for _, desiredLRP := range desiredLRPs {
+		if !m.processor.shard.Owns(desiredLRP.ProcessGuid) {
+			continue
+		}
+
+		previous := recipebuilder.RecipeStampOf(desiredLRP)
+		if previous == "" {
+			unknown++
+			continue
+		}
+
+		if previous == stamp {
+			continue
+		}
+
+		if m.tooManyInstances(desiredLRP.Instances) {
+			skipped++
+			continue
+		}
+
+		outdated = append(outdated, desiredLRP.ProcessGuid)
+	}
+
+	if unknown > 0 {
+		logger.Info("skipping-lrps-without-recipe-version", lager.Data{"count": unknown})
+	}
+
+	if skipped > 0 {
+		logger.Info("skipping-lrps-with-too-many-instances", lager.Data{"count": skipped, "max-instances": m.maxInstances})
+	}
+
+	sort.Strings(outdated)
+	return outdated, nil
+}
+
+func (m *lrpMigrator) tooManyInstances(instances int32) bool {
+	return m.maxInstances > 0 && int(instances) > m.maxInstances
+}
+
+// migrate rebuilds an LRP from CC's current desired app, reporting whether it
+// replaced it. LRPs that have since been removed, replaced or are no longer
+// desired by CC are left to the processor. It returns errMigrationStopped
+// once the migrator is signalled or loses the lock while waiting.
+func (m *lrpMigrator) migrate(logger lager.Logger, signals <-chan os.Signal, processGuid, stamp string) (bool, error) {
+	bbsClient := m.processor.bbsClient
+	logger = logger.Session("migrate-lrp", lager.Data{"process-guid": processGuid})
+
+	existing, err := bbsClient.DesiredLRPByProcessGuid(logger, processGuid)
+	if err != nil {
+		if models.ConvertError(err).Type != models.Error_ResourceNotFound {
+			logger.Error("failed-getting-desired-lrp", err)
+		}
+		return false, nil
+	}
+
+	previous := recipebuilder.RecipeStampOf(existing)
+	if previous == "" || previous == stamp {
+		return false, nil
+	}
+
+	if m.tooManyInstances(existing.Instances) {
+		logger.Info("skipping-lrp-with-too-many-instances", lager.Data{"instances": existing.Instances})
+		return false, nil
+	}
+
+	desiredApps, err := m.processor.fetchDesiredAppsByGuid(logger, []string{processGuid})
+	if err != nil {
+		logger.Error("failed-fetching-desired-app", err)
+		return false, nil
+	}
+
+	desireAppRequest, ok := desiredApps[processGuid]
+	if !ok {
+		logger.Info("no-longer-desired-by-cc")
+		return false, nil
+	}
+
+	desired, err := m.processor.builderFor(desireAppRequest).Build(desireAppRequest)
+	if err != nil {
+		logger.Error("failed-building-desired-lrp", err)
+		return false, nil
+	}
+	desired.Domain = m.processor.domain
+
+	guard := newWriteGuard(nil, m.processor.ownership.Lost(), m.processor.Paused, m.processor.writeLimiter)
+
+	surgeGuid := processGuid + surgeSuffix
+	if existing.Instances > 0 {
+		surge := *desired
+		surge.ProcessGuid = surgeGuid
+		surge.Domain = m.surgeDomain()
+		surge.Instances = existing.Instances
+
+		logger.Info("desiring-surge-lrp", lager.Data{"surge-process-guid": surgeGuid, "instances": surge.Instances})
+		err = guard.write(func() error {
+			return bbsClient.DesireLRP(logger, &surge)
+		})
+		if err != nil && models.ConvertError(err).Type != models.Error_ResourceExists {
+			logger.Error("failed-desiring-surge-lrp", err)
+			return false, nil
+		}
+
+		running, err := m.waitForInstances(logger, signals, surgeGuid, surge.Instances, nil)
+		if err != nil {
+			return false, err
+		}
+
+		if !running {
+			logger.Info("surge-lrp-did-not-start", lager.Data{"surge-process-guid": surgeGuid})
+			m.removeSurge(logger, guard, surgeGuid)
+			return false, nil
+		}
+	}
+
+	// the old instances are stopping, so only new ones count as running
+	oldInstances, err := m.instanceGuids(logger, processGuid)
+	if err != nil {
+		m.removeSurge(logger, guard, surgeGuid)
+		return false, nil
+	}
+
+	logger.Info("replacing-lrp", lager.Data{"from-recipe-version": previous})
+	err = m.processor.writeLRP(guard, processGuid, func() error {
+		return bbsClient.RemoveDesiredLRP(logger, processGuid)
+	})
+	if err != nil && models.ConvertError(err).Type != models.Error_ResourceNotFound {
+		logger.Error("failed-removing-lrp", err)
+		m.removeSurge(logger, guard, surgeGuid)
+		return false, nil
+	}
+
+	// only the surge serves the app until it is desired again, so retry at
+	// once rather than leaving it to the next sync
+	for attempt := 1; ; attempt++ {
+		err = m.processor.writeLRP(guard, processGuid, func() error {
+			return bbsClient.DesireLRP(logger, desired)
+		})
+		if err == nil {
+			break
+		}
+
+		if models.ConvertError(err).Type == models.Error_ResourceExists {
+			// the listener desired it first; the surge is removed once
+			// its instances run
+			logger.Info("lrp-already-desired")
+			return false, nil
+		}
+
+		if err == errWriteAbandoned || attempt >= migrateDesireAttempts {
+			// the surge keeps serving the app until the processor
+			// desires it again
+			logger.Error("failed-desiring-lrp", err, lager.Data{"attempts": attempt})
+			return false, nil
+		}
+
+		logger.Error("retrying-desiring-lrp", err, lager.Data{"attempt": attempt})
+	}
+
+	if existing.Instances > 0 {
+		running, err := m.waitForInstances(logger, signals, processGuid, desired.Instances, oldInstances)
+		if err != nil {
+			return true, err
+		}
+
+		if !running {
+			// keep the surge until the replacement runs
+			logger.Info("replacement-lrp-did-not-start")
+			return true, nil
+		}
+
+		m.removeSurge(logger, guard, surgeGuid)
+	}
+
+	return true, nil
+}
+
+// waitForInstances waits for an LRP to run instances instances other than
+// those in ignored, reporting whether it did before migrateStartTimeout.
+func (m *lrpMigrator) waitForInstances(
+	logger lager.Logger,
+	signals <-chan os.Signal,
+	processGuid string,
+	instances int32,
+	ignored map[string]bool,
+) (bool, error) {
+	deadline := m.processor.clock.Now().Add(migrateStartTimeout)
+
+	var poll clock.Timer
+	for {
+		running, err := m.runningInstances(logger, processGuid, ignored)
+		if err == nil && running >= int(instances) {
+			return true, nil
+		}
+
+		if !m.processor.clock.Now().Before(deadline) {
+			return false, nil
+		}
+
+		if poll == nil {
+			poll = m.processor.clock.NewTimer(migratePollInterval)
+			defer poll.Stop()
+		} else {
+			poll.Reset(migratePollInterval)
+		}
+
+		select {
+		case <-signals:
+			return false, errMigrationStopped
+		case <-m.processor.ownership.Lost():
+			logger.Info("lock-lost")
+			return false, errMigrationStopped
+		case <-poll.C():
+		}
+	}
+}
+
+func (m *lrpMigrator) runningInstances(logger lager.Logger, processGuid string, ignored map[string]bool) (int, error) {
+	groups, err := m.processor.bbsClient.ActualLRPGroupsByProcessGuid(logger, processGuid)
+	if err != nil {
+		logger.Error("failed-getting-actual-lrps", err, lager.Data{"process-guid": processGuid})
+		return 0, err
+	}
+
+	running := 0
+	for _, group := range groups {
+		actualLRP, _ := group.Resolve()
+		if actualLRP.State == models.ActualLRPStateRunning && !ignored[actualLRP.InstanceGuid] {
+			running++
+		}
+	}
+
+	return running, nil
+}
+
+func (m *lrpMigrator) instanceGuids(logger lager.Logger, processGuid string) (map[string]bool, error) {
+	groups, err := m.processor.bbsClient.ActualLRPGroupsByProcessGuid(logger, processGuid)
+	if err != nil {
+		logger.Error("failed-getting-actual-lrps", err, lager.Data{"process-guid": processGuid})
+		return nil, err
+	}
+
+	guids := map[string]bool{}
+	for _, group := range groups {
+		actualLRP, _ := group.Resolve()
+		guids[actualLRP.InstanceGuid] = true
+	}
+
+	return guids, nil
+}
+
+// removeLeftoverSurges removes the surge LRPs of this shard whose LRP is gone
+// or runs all its instances again.
+func (m *lrpMigrator) removeLeftoverSurges(logger lager.Logger) {
+	bbsClient := m.processor.bbsClient
+
+	surges, err := bbsClient.DesiredLRPSchedulingInfos(logger, models.DesiredLRPFilter{Domain: m.surgeDomain()})
+	if err != nil {
+		logger.Error("failed-getting-surge-lrps", err)
+		return
+	}
+
+	guard := newWriteGuard(nil, m.processor.ownership.Lost(), m.processor.Paused, m.processor.writeLimiter)
+
+	for _, surge := range surges {
+		processGuid := strings.TrimSuffix(surge.ProcessGuid, surgeSuffix)
+		if !m.processor.shard.Owns(processGuid) {
+			continue
+		}
+
+		existing, err := bbsClient.DesiredLRPByProcessGuid(logger, processGuid)
+		if err != nil && models.ConvertError(err).Type != models.Error_ResourceNotFound {
+			logger.Error("failed-getting-desired-lrp", err, lager.Data{"process-guid": processGuid})
+			continue
+		}
+
+		if err == nil {
+			running, err := m.runningInstances(logger, processGuid, nil)
+			if err != nil || running < int(existing.Instances) {
+				continue
+			}
+		}
+
+		m.removeSurge(logger, guard, surge.ProcessGuid)
+	}
+}
+
+func (m *lrpMigrator) removeSurge(logger lager.Logger, guard *writeGuard, surgeGuid string) {
+	err := guard.write(func() error {
+		return m.processor.bbsClient.RemoveDesiredLRP(logger, surgeGuid)
+	})
+	if err != nil && models.ConvertError(err).Type != models.Error_ResourceNotFound {
+		logger.Error("failed-removing-surge-lrp", err, lager.Data{"surge-process-guid": surgeGuid})
+		return
+	}
+
+	logger.Info("removed-surge-lrp", lager.Data{"surge-process-guid": surgeGuid})
+}
+
+// surgeDomain is the domain of the surge LRPs. It is never bumped, so BBS
+// leaves their instances alone, and no sync removes them.
+func (m *lrpMigrator) surgeDomain() string {
+	return m.processor.domain + surgeSuffix
+}
+
+func (m *lrpMigrator) reportRemaining(logger lager.Logger, remaining int) {
+	err := metric.Metric(sourceMetric(string(outdatedRecipeLRPs), m.processor.domain)).Send(remaining)
+	if err != nil {
+		logger.Error("failed-to-send-outdated-recipe-lrps-metric", err)
+	}
+}
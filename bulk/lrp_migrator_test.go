@@ -0,0 +1,501 @@
+package bulk_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bbs/fake_bbs"
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+)
+
+var _ = Describe("LRP migrator", func() {
+	const surgeDomain = cc_messages.AppLRPDomain + "-migration"
+
+	var (
+		logger           *lagertest.TestLogger
+		bbsClient        *fake_bbs.FakeClient
+		fetcher          *fakes.FakeFetcher
+		buildpackBuilder *fakes.FakeRecipeBuilder
+		clock            *fakeclock.FakeClock
+		processor        *bulk.LRPProcessor
+
+		lock              sync.Mutex
+		existing          map[string]string
+		surges            map[string]bool
+		instances         map[string]int32
+		running           map[string][]string
+		events            []string
+		startSurges       bool
+		startReplacements bool
+		desireFailures    int
+
+		desiredApps  []cc_messages.DesireAppRequestFromCC
+		stamp        atomic.Value
+		maxInstances int
+
+		process ifrit.Process
+	)
+
+	desiredLRP := func(guid string) *models.DesiredLRP {
+		lrp := &models.DesiredLRP{
+			ProcessGuid: guid,
+			Domain:      cc_messages.AppLRPDomain,
+			Instances:   instances[guid],
+		}
+		if existing[guid] != "" {
+			lrp.EnvironmentVariables = []*models.EnvironmentVariable{
+				{Name: recipebuilder.RecipeVersionEnv, Value: existing[guid]},
+			}
+		}
+		return lrp
+	}
+
+	setStamp := func(guid, stamp string) {
+		lock.Lock()
+		defer lock.Unlock()
+		existing[guid] = stamp
+	}
+
+	getEvents := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, events...)
+	}
+
+	tick := func(d time.Duration) {
+		Eventually(clock.WatcherCount).Should(Equal(1))
+		clock.Increment(d)
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		bbsClient = new(fake_bbs.FakeClient)
+		fetcher = new(fakes.FakeFetcher)
+		buildpackBuilder = new(fakes.FakeRecipeBuilder)
+		clock = fakeclock.NewFakeClock(time.Now())
+
+		existing = map[string]string{
+			"current-guid":     "2",
+			"old-guid":         "1",
+			"unstamped-guid":   "",
+			"rolled-back-guid": "3",
+		}
+		surges = map[string]bool{}
+		instances = map[string]int32{}
+		running = map[string][]string{}
+		for guid := range existing {
+			instances[guid] = 1
+			running[guid] = []string{guid + "-old-instance"}
+		}
+		events = nil
+		startSurges = true
+		startReplacements = true
+		desireFailures = 0
+
+		stamp.Store("2")
+		maxInstances = 0
+
+		bbsClient.DesiredLRPsStub = func(lager.Logger, models.DesiredLRPFilter) ([]*models.DesiredLRP, error) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			desiredLRPs := []*models.DesiredLRP{}
+			for guid := range existing {
+				desiredLRPs = append(desiredLRPs, desiredLRP(guid))
+			}
+			return desiredLRPs, nil
+		}
+
+		bbsClient.DesiredLRPSchedulingInfosStub = func(logger lager.Logger, filter models.DesiredLRPFilter) ([]*models.DesiredLRPSchedulingInfo, error) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			schedulingInfos := []*models.DesiredLRPSchedulingInfo{}
+			if filter.Domain != surgeDomain {
+				return schedulingInfos, nil
+			}
+
+			for guid := range surges {
+				schedulingInfos = append(schedulingInfos, &models.DesiredLRPSchedulingInfo{
+					DesiredLRPKey: models.NewDesiredLRPKey(guid, surgeDomain, "log-guid"),
+					Instances:     instances[guid],
+				})
+			}
+			return schedulingInfos, nil
+		}
+
+		bbsClient.DesiredLRPByProcessGuidStub = func(logger lager.Logger, guid string) (*models.DesiredLRP, error) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if _, ok := existing[guid]; !ok {
+				return nil, models.ErrResourceNotFound
+			}
+			return desiredLRP(guid), nil
+		}
+
+		bbsClient.DesireLRPStub = func(logger lager.Logger, lrp *models.DesiredLRP) error {
+			lock.Lock()
+			defer lock.Unlock()
+
+			events = append(events, "desire:"+lrp.ProcessGuid)
+
+			start := startReplacements
+			if lrp.Domain == surgeDomain {
+				surges[lrp.ProcessGuid] = true
+				start = startSurges
+			} else {
+				if desireFailures > 0 {
+					desireFailures--
+					return errors.New("boom")
+				}
+				existing[lrp.ProcessGuid] = recipebuilder.RecipeStampOf(lrp)
+			}
+			instances[lrp.ProcessGuid] = lrp.Instances
+
+			if start {
+				for i := int32(0); i < lrp.Instances; i++ {
+					running[lrp.ProcessGuid] = append(running[lrp.ProcessGuid], fmt.Sprintf("%s-%d", lrp.ProcessGuid, len(events)))
+				}
+			}
+			return nil
+		}
+
+		bbsClient.RemoveDesiredLRPStub = func(logger lager.Logger, guid string) error {
+			lock.Lock()
+			defer lock.Unlock()
+
+			events = append(events, "remove:"+guid)
+
+			// the removed LRP's instances keep running while they stop
+			delete(existing, guid)
+			delete(surges, guid)
+			return nil
+		}
+
+		bbsClient.ActualLRPGroupsByProcessGuidStub = func(logger lager.Logger, guid string) ([]*models.ActualLRPGroup, error) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			groups := []*models.ActualLRPGroup{}
+			for _, instanceGuid := range running[guid] {
+				groups = append(groups, &models.ActualLRPGroup{
+					Instance: &models.ActualLRP{
+						ActualLRPInstanceKey: models.NewActualLRPInstanceKey(instanceGuid, "cell-id"),
+						State:                models.ActualLRPStateRunning,
+					},
+				})
+			}
+			return groups, nil
+		}
+
+		desiredApps = []cc_messages.DesireAppRequestFromCC{
+			{ProcessGuid: "old-guid", ETag: "old-etag", NumInstances: 1},
+			{ProcessGuid: "unstamped-guid", ETag: "unstamped-etag", NumInstances: 1},
+			{ProcessGuid: "rolled-back-guid", ETag: "rolled-back-etag", NumInstances: 1},
+		}
+
+		fetcher.FetchDesiredAppsStub = func(
+			logger lager.Logger,
+			cancel <-chan struct{},
+			httpClient *http.Client,
+			fingerprints <-chan []cc_messages.CCDesiredAppFingerprint,
+		) (<-chan []cc_messages.DesireAppRequestFromCC, <-chan error) {
+			requested := map[string]bool{}
+			for _, fingerprint := range <-fingerprints {
+				requested[fingerprint.ProcessGuid] = true
+			}
+
+			found := []cc_messages.DesireAppRequestFromCC{}
+			for _, app := range desiredApps {
+				if requested[app.ProcessGuid] {
+					found = append(found, app)
+				}
+			}
+
+			results := make(chan []cc_messages.DesireAppRequestFromCC, 1)
+			errc := make(chan error, 1)
+
+			results <- found
+			close(results)
+			close(errc)
+
+			return results, errc
+		}
+
+		buildpackBuilder.BuildStub = func(app *cc_messages.DesireAppRequestFromCC) (*models.DesiredLRP, error) {
+			return &models.DesiredLRP{
+				ProcessGuid: app.ProcessGuid,
+				Annotation:  app.ETag,
+				Instances:   int32(app.NumInstances),
+				EnvironmentVariables: []*models.EnvironmentVariable{
+					{Name: recipebuilder.RecipeVersionEnv, Value: "2"},
+				},
+			}, nil
+		}
+
+		processor = bulk.NewLRPProcessor(
+			logger,
+			bbsClient,
+			time.Minute,
+			cc_messages.AppLRPDomain,
+			time.Second,
+			0,
+			10,
+			50,
+			&tls.Config{},
+			fetcher,
+			map[string]recipebuilder.RecipeBuilder{
+				"buildpack": buildpackBuilder,
+				"docker":    new(fakes.FakeRecipeBuilder),
+			},
+			nil,
+			bulk.Shard{},
+			nil,
+			bulk.NewLockOwnership(),
+			clock,
+		)
+	})
+
+	JustBeforeEach(func() {
+		process = ifrit.Invoke(processor.NewMigrator(time.Second, maxInstances, func() string {
+			return stamp.Load().(string)
+		}))
+	})
+
+	AfterEach(func() {
+		ginkgomon.Interrupt(process)
+	})
+
+	It("replaces the LRPs with another recipe version, one per interval", func() {
+		tick(time.Second)
+		Eventually(getEvents).Should(Equal([]string{
+			"desire:old-guid-migration",
+			"remove:old-guid",
+			"desire:old-guid",
+			"remove:old-guid-migration",
+		}))
+
+		_, surge := bbsClient.DesireLRPArgsForCall(0)
+		Expect(surge.Domain).To(Equal(surgeDomain))
+		Expect(surge.Instances).To(BeEquivalentTo(1))
+		Expect(surge.Annotation).To(Equal("old-etag"))
+
+		_, desired := bbsClient.DesireLRPArgsForCall(1)
+		Expect(desired.ProcessGuid).To(Equal("old-guid"))
+		Expect(desired.Annotation).To(Equal("old-etag"))
+		Expect(desired.Domain).To(Equal(cc_messages.AppLRPDomain))
+
+		Consistently(bbsClient.DesireLRPCallCount).Should(Equal(2))
+
+		tick(time.Second)
+		Eventually(getEvents).Should(HaveLen(8))
+		Expect(getEvents()[4:]).To(Equal([]string{
+			"desire:rolled-back-guid-migration",
+			"remove:rolled-back-guid",
+			"desire:rolled-back-guid",
+			"remove:rolled-back-guid-migration",
+		}))
+
+		tick(time.Second)
+		Eventually(logger.TestSink.Buffer).Should(gbytes.Say("migration-complete"))
+		Expect(bbsClient.DesireLRPCallCount()).To(Equal(4))
+	})
+
+	It("leaves the LRPs without a recipe version alone", func() {
+		tick(time.Second)
+		Eventually(logger.TestSink.Buffer).Should(gbytes.Say("skipping-lrps-without-recipe-version.*\"count\":1"))
+
+		for i := 0; i < 2; i++ {
+			tick(time.Second)
+		}
+		Eventually(logger.TestSink.Buffer).Should(gbytes.Say("migration-complete"))
+
+		Expect(getEvents()).NotTo(ContainElement("remove:unstamped-guid"))
+	})
+
+	It("reports its progress", func() {
+		tick(time.Second)
+		Eventually(logger.TestSink.Buffer).Should(gbytes.Say("found-outdated-lrps.*\"count\":2"))
+		Eventually(logger.TestSink.Buffer).Should(gbytes.Say("migrated-lrp.*\"migrated\":1.*\"remaining\":1"))
+	})
+
+	Context("when the surge LRP's instances do not start", func() {
+		BeforeEach(func() {
+			startSurges = false
+		})
+
+		It("removes it and leaves the LRP running", func() {
+			tick(time.Second)
+			Eventually(getEvents).Should(Equal([]string{"desire:old-guid-migration"}))
+
+			tick(11 * time.Minute)
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("surge-lrp-did-not-start"))
+			Expect(getEvents()).To(Equal([]string{
+				"desire:old-guid-migration",
+				"remove:old-guid-migration",
+			}))
+		})
+
+		It("stops waiting when signalled", func() {
+			tick(time.Second)
+			Eventually(getEvents).Should(Equal([]string{"desire:old-guid-migration"}))
+			Eventually(clock.WatcherCount).Should(Equal(1))
+
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+		})
+	})
+
+	Context("when the replacement's instances do not start", func() {
+		BeforeEach(func() {
+			startReplacements = false
+		})
+
+		It("keeps the surge LRP, ignoring the old instances", func() {
+			tick(time.Second)
+			Eventually(getEvents).Should(HaveLen(3))
+
+			tick(11 * time.Minute)
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("replacement-lrp-did-not-start"))
+			Expect(getEvents()).NotTo(ContainElement("remove:old-guid-migration"))
+		})
+	})
+
+	Context("when surge LRPs were left behind", func() {
+		BeforeEach(func() {
+			surges["current-guid-migration"] = true
+			surges["gone-guid-migration"] = true
+			surges["stuck-guid-migration"] = true
+
+			existing["stuck-guid"] = "2"
+			instances["stuck-guid"] = 2
+			running["stuck-guid"] = []string{"stuck-guid-0"}
+		})
+
+		It("removes those whose LRP is gone or runs all its instances", func() {
+			tick(time.Second)
+			Eventually(getEvents).Should(ContainElement("remove:current-guid-migration"))
+			Expect(getEvents()).To(ContainElement("remove:gone-guid-migration"))
+			Expect(getEvents()).NotTo(ContainElement("remove:stuck-guid-migration"))
+		})
+	})
+
+	Context("when CC no longer desires an outdated LRP", func() {
+		BeforeEach(func() {
+			desiredApps = desiredApps[1:]
+		})
+
+		It("leaves it for the processor to remove", func() {
+			tick(time.Second)
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("no-longer-desired-by-cc"))
+
+			Expect(bbsClient.RemoveDesiredLRPCallCount()).To(Equal(0))
+			Expect(bbsClient.DesireLRPCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when the LRP was replaced since it was found", func() {
+		It("skips it", func() {
+			tick(time.Second)
+			Eventually(bbsClient.DesireLRPCallCount).Should(Equal(2))
+
+			setStamp("rolled-back-guid", "2")
+
+			tick(time.Second)
+			Eventually(bbsClient.DesiredLRPByProcessGuidCallCount).Should(Equal(2))
+			Consistently(bbsClient.DesireLRPCallCount).Should(Equal(2))
+		})
+	})
+
+	Context("when paused", func() {
+		BeforeEach(func() {
+			processor.Pause()
+		})
+
+		It("does not migrate", func() {
+			tick(time.Second)
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("paused-skipping-migration"))
+
+			Expect(bbsClient.DesiredLRPsCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when an outdated LRP has more instances than allowed", func() {
+		BeforeEach(func() {
+			maxInstances = 2
+			instances["old-guid"] = 3
+		})
+
+		It("skips it", func() {
+			tick(time.Second)
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("skipping-lrps-with-too-many-instances.*\"count\":1"))
+
+			Eventually(bbsClient.DesireLRPCallCount).Should(Equal(2))
+			_, desired := bbsClient.DesireLRPArgsForCall(1)
+			Expect(desired.ProcessGuid).To(Equal("rolled-back-guid"))
+		})
+	})
+
+	Context("when desiring the replacement fails", func() {
+		BeforeEach(func() {
+			desireFailures = 2
+		})
+
+		It("retries at once", func() {
+			tick(time.Second)
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("migrated-lrp"))
+			Expect(bbsClient.DesireLRPCallCount()).To(Equal(4))
+		})
+
+		Context("every time", func() {
+			BeforeEach(func() {
+				desireFailures = 10
+			})
+
+			It("gives up after a few attempts, keeping the surge LRP", func() {
+				tick(time.Second)
+				Eventually(logger.TestSink.Buffer).Should(gbytes.Say("failed-desiring-lrp.*\"attempts\":3"))
+				Expect(bbsClient.DesireLRPCallCount()).To(Equal(4))
+				Expect(getEvents()).NotTo(ContainElement("remove:old-guid-migration"))
+			})
+		})
+	})
+
+	Context("when the recipe version changes", func() {
+		BeforeEach(func() {
+			desiredApps = append(desiredApps, cc_messages.DesireAppRequestFromCC{ProcessGuid: "current-guid", ETag: "current-etag", NumInstances: 1})
+		})
+
+		It("looks for outdated LRPs again", func() {
+			tick(time.Second)
+			Eventually(bbsClient.DesireLRPCallCount).Should(Equal(2))
+
+			stamp.Store("3")
+
+			tick(time.Second)
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("recipe-version-changed"))
+			Eventually(bbsClient.DesireLRPCallCount).Should(Equal(4))
+			_, desired := bbsClient.DesireLRPArgsForCall(3)
+			Expect(desired.ProcessGuid).To(Equal("current-guid"))
+		})
+	})
+})
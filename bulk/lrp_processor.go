@@ -14,8 +14,6 @@ import (
 	"github.com/cloudfoundry-incubator/cf_http"
 	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
-	"github.com/cloudfoundry-incubator/routing-info/cfroutes"
-	"github.com/cloudfoundry-incubator/routing-info/tcp_routes"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/cloudfoundry-incubator/runtime-schema/metric"
 	"github.com/cloudfoundry/gunk/workpool"
@@ -26,44 +24,70 @@ import (
 const (
 	syncDesiredLRPsDuration = metric.Duration("DesiredLRPSyncDuration")
 	invalidLRPsFound        = metric.Metric("NsyncInvalidDesiredLRPsFound")
+	driftedLRPsFound        = metric.Metric("NsyncDriftedDesiredLRPsFound")
 )
 
 type LRPProcessor struct {
 	bbsClient             bbs.Client
 	pollingInterval       time.Duration
+	domain                string
 	domainTTL             time.Duration
+	deepReconcileInterval time.Duration
 	bulkBatchSize         uint
 	updateLRPWorkPoolSize int
 	httpClient            *http.Client
 	logger                lager.Logger
 	fetcher               Fetcher
 	builders              map[string]recipebuilder.RecipeBuilder
+	sshKeyStore           recipebuilder.SSHKeyStore
+	shard                 Shard
+	writeLimiter          *WriteLimiter
+	ownership             *LockOwnership
 	clock                 clock.Clock
+	ownWrites             *ownWrites
+
+	lastDeepReconcile time.Time
+
+	*syncControl
 }
 
 func NewLRPProcessor(
 	logger lager.Logger,
 	bbsClient bbs.Client,
 	pollingInterval time.Duration,
+	domain string,
 	domainTTL time.Duration,
+	deepReconcileInterval time.Duration,
 	bulkBatchSize uint,
 	updateLRPWorkPoolSize int,
-	skipCertVerify bool,
+	tlsConfig *tls.Config,
 	fetcher Fetcher,
 	builders map[string]recipebuilder.RecipeBuilder,
+	sshKeyStore recipebuilder.SSHKeyStore,
+	shard Shard,
+	writeLimiter *WriteLimiter,
+	ownership *LockOwnership,
 	clock clock.Clock,
 ) *LRPProcessor {
 	return &LRPProcessor{
 		bbsClient:             bbsClient,
 		pollingInterval:       pollingInterval,
+		domain:                domain,
 		domainTTL:             domainTTL,
+		deepReconcileInterval: deepReconcileInterval,
 		bulkBatchSize:         bulkBatchSize,
 		updateLRPWorkPoolSize: updateLRPWorkPoolSize,
-		httpClient:            initializeHttpClient(skipCertVerify),
+		httpClient:            initializeHttpClient(tlsConfig),
 		logger:                logger,
 		fetcher:               fetcher,
 		builders:              builders,
+		sshKeyStore:           sshKeyStore,
+		shard:                 shard,
+		writeLimiter:          writeLimiter,
+		ownership:             ownership,
 		clock:                 clock,
+		ownWrites:             newOwnWrites(clock),
+		syncControl:           newSyncControl(),
 	}
 }
 
@@ -81,29 +105,49 @@ func (l *LRPProcessor) Run(signals <-chan os.Signal, ready chan<- struct{}) erro
 		select {
 		case <-signals:
 			return nil
+		case <-l.ownership.Lost():
+			l.logger.Info("lock-lost")
+			return nil
 		case <-timer.C():
 			stop = l.sync(signals)
 			timer.Reset(l.pollingInterval)
+		case <-l.triggered():
+			l.logger.Info("sync-triggered")
+			stop = l.sync(signals)
+			timer.Reset(l.pollingInterval)
 		}
 	}
 }
 
 func (l *LRPProcessor) sync(signals <-chan os.Signal) bool {
+	if l.Paused() {
+		l.logger.Info("sync-lrps-paused")
+		return false
+	}
+
 	start := l.clock.Now()
 	invalidsFound := int32(0)
+	driftedFound := int32(0)
+	deep := l.deepReconcileDue(start)
 	logger := l.logger.Session("sync-lrps")
 	logger.Info("starting")
 
 	defer func() {
 		duration := l.clock.Now().Sub(start)
-		err := syncDesiredLRPsDuration.Send(duration)
+		err := metric.Duration(sourceMetric(string(syncDesiredLRPsDuration), l.domain)).Send(duration)
 		if err != nil {
 			logger.Error("failed-to-send-sync-desired-lrps-duration-metric", err)
 		}
-		err = invalidLRPsFound.Send(int(invalidsFound))
+		err = metric.Metric(sourceMetric(string(invalidLRPsFound), l.domain)).Send(int(invalidsFound))
 		if err != nil {
 			logger.Error("failed-to-send-sync-invalid-lrps-found-metric", err)
 		}
+		if deep {
+			err = metric.Metric(sourceMetric(string(driftedLRPsFound), l.domain)).Send(int(driftedFound))
+			if err != nil {
+				logger.Error("failed-to-send-sync-drifted-lrps-found-metric", err)
+			}
+		}
 	}()
 
 	defer logger.Info("done")
@@ -114,9 +158,13 @@ func (l *LRPProcessor) sync(signals <-chan os.Signal) bool {
 	}
 
 	existingSchedulingInfoMap := organizeSchedulingInfosByProcessGuid(existing)
-	appDiffer := NewAppDiffer(existingSchedulingInfoMap)
+	if deep {
+		logger.Info("performing-deep-reconcile")
+	}
+	appDiffer := NewAppDiffer(existingSchedulingInfoMap, deep, l.shard)
 
 	cancelCh := make(chan struct{})
+	guard := newWriteGuard(cancelCh, l.ownership.Lost(), l.Paused, l.writeLimiter)
 
 	// from here on out, the fetcher, differ, and processor work across channels in a pipeline
 	fingerprintCh, fingerprintErrorCh := l.fetcher.FetchFingerprints(
@@ -138,7 +186,7 @@ func (l *LRPProcessor) sync(signals <-chan os.Signal) bool {
 		appDiffer.Missing(),
 	)
 
-	createErrorCh := l.createMissingDesiredLRPs(logger, cancelCh, missingAppCh, &invalidsFound)
+	createErrorCh := l.createMissingDesiredLRPs(logger, cancelCh, guard, missingAppCh, &invalidsFound)
 
 	staleAppCh, staleAppErrorCh := l.fetcher.FetchDesiredApps(
 		logger.Session("fetch-stale-desired-lrps-from-cc"),
@@ -147,7 +195,7 @@ func (l *LRPProcessor) sync(signals <-chan os.Signal) bool {
 		appDiffer.Stale(),
 	)
 
-	updateErrorCh := l.updateStaleDesiredLRPs(logger, cancelCh, staleAppCh, existingSchedulingInfoMap, &invalidsFound)
+	updateErrorCh := l.updateStaleDesiredLRPs(logger, cancelCh, guard, staleAppCh, existingSchedulingInfoMap, &invalidsFound, &driftedFound)
 
 	bumpFreshness := true
 	success := true
@@ -181,6 +229,10 @@ process_loop:
 			logger.Info("exiting", lager.Data{"received-signal": sig})
 			close(cancelCh)
 			return true
+		case <-l.ownership.Lost():
+			logger.Info("lock-lost-cancelling-sync")
+			abandonSync(logger, cancelCh, guard, l.domain, errors, signals)
+			return true
 		}
 	}
 	logger.Info("done-processing-updates-and-creates")
@@ -192,13 +244,52 @@ process_loop:
 
 	if success {
 		deleteList := <-appDiffer.Deleted()
-		l.deleteExcess(logger, cancelCh, deleteList)
+		deleteErrorCh := l.deleteExcess(logger, guard, deleteList)
+
+	delete_loop:
+		for {
+			select {
+			case err, open := <-deleteErrorCh:
+				if err != nil {
+					logger.Error("not-bumping-freshness-because-of", err)
+					bumpFreshness = false
+				}
+				if !open {
+					break delete_loop
+				}
+			case sig := <-signals:
+				logger.Info("exiting", lager.Data{"received-signal": sig})
+				close(cancelCh)
+				return true
+			case <-l.ownership.Lost():
+				logger.Info("lock-lost-cancelling-sync")
+				abandonSync(logger, cancelCh, guard, l.domain, deleteErrorCh, signals)
+				return true
+			}
+		}
+	}
+
+	select {
+	case <-l.ownership.Lost():
+		logger.Info("lock-lost-cancelling-sync")
+		abandonSync(logger, cancelCh, guard, l.domain, nil, signals)
+		return true
+	default:
+	}
+
+	if l.Paused() {
+		logger.Info("paused-not-bumping-freshness")
+		bumpFreshness = false
 	}
 
 	if bumpFreshness && success {
+		if deep {
+			l.lastDeepReconcile = start
+		}
+
 		logger.Info("bumping-freshness")
 
-		err = l.bbsClient.UpsertDomain(logger, cc_messages.AppLRPDomain, l.domainTTL)
+		err = markDomainFresh(logger, l.bbsClient, l.shard, l.domain, l.domainTTL)
 		if err != nil {
 			logger.Error("failed-to-upsert-domain", err)
 		}
@@ -207,9 +298,19 @@ process_loop:
 	return false
 }
 
+// writeLRP makes a write to an LRP through the guard, noting it as the
+// bulker's own so that the event syncer ignores BBS's echo of it.
+func (l *LRPProcessor) writeLRP(guard *writeGuard, processGuid string, write func() error) error {
+	return guard.write(func() error {
+		l.ownWrites.mark(processGuid)
+		return write()
+	})
+}
+
 func (l *LRPProcessor) createMissingDesiredLRPs(
 	logger lager.Logger,
 	cancel <-chan struct{},
+	guard *writeGuard,
 	missing <-chan []cc_messages.DesireAppRequestFromCC,
 	invalidCount *int32,
 ) <-chan error {
@@ -239,23 +340,30 @@ func (l *LRPProcessor) createMissingDesiredLRPs(
 
 			for i, desireAppRequest := range desireAppRequests {
 				desireAppRequest := desireAppRequest
-				var builder recipebuilder.RecipeBuilder = l.builders["buildpack"]
-				if desireAppRequest.DockerImageUrl != "" {
-					builder = l.builders["docker"]
-				}
+				builder := l.builderFor(&desireAppRequest)
 
 				works[i] = func() {
 					logger.Debug("building-create-desired-lrp-request", desireAppRequestDebugData(&desireAppRequest))
 					desired, err := builder.Build(&desireAppRequest)
 					if err != nil {
 						logger.Error("failed-building-create-desired-lrp-request", err, lager.Data{"process-guid": desireAppRequest.ProcessGuid})
-						errc <- err
+						if invalidRoutes(err) {
+							atomic.AddInt32(invalidCount, int32(1))
+						} else {
+							errc <- err
+						}
 						return
 					}
 					logger.Debug("succeeded-building-create-desired-lrp-request", desireAppRequestDebugData(&desireAppRequest))
+					desired.Domain = l.domain
 
 					logger.Debug("creating-desired-lrp", createDesiredReqDebugData(desired))
-					err = l.bbsClient.DesireLRP(logger, desired)
+					err = l.writeLRP(guard, desired.ProcessGuid, func() error {
+						return l.bbsClient.DesireLRP(logger, desired)
+					})
+					if err == errWriteAbandoned {
+						return
+					}
 					if err != nil {
 						logger.Error("failed-creating-desired-lrp", err, lager.Data{"process-guid": desired.ProcessGuid})
 						if models.ConvertError(err).Type == models.Error_InvalidRequest {
@@ -287,9 +395,11 @@ func (l *LRPProcessor) createMissingDesiredLRPs(
 func (l *LRPProcessor) updateStaleDesiredLRPs(
 	logger lager.Logger,
 	cancel <-chan struct{},
+	guard *writeGuard,
 	stale <-chan []cc_messages.DesireAppRequestFromCC,
 	existingSchedulingInfoMap map[string]*models.DesiredLRPSchedulingInfo,
 	invalidCount *int32,
+	driftCount *int32,
 ) <-chan error {
 	logger = logger.Session("update-stale-desired-lrps")
 
@@ -317,47 +427,52 @@ func (l *LRPProcessor) updateStaleDesiredLRPs(
 
 			for i, desireAppRequest := range staleAppRequests {
 				desireAppRequest := desireAppRequest
-				var builder recipebuilder.RecipeBuilder = l.builders["buildpack"]
-				if desireAppRequest.DockerImageUrl != "" {
-					builder = l.builders["docker"]
-				}
+				builder := l.builderFor(&desireAppRequest)
 
 				works[i] = func() {
 					processGuid := desireAppRequest.ProcessGuid
 					existingSchedulingInfo := existingSchedulingInfoMap[desireAppRequest.ProcessGuid]
 
-					updateReq := &models.DesiredLRPUpdate{}
-					instances := int32(desireAppRequest.NumInstances)
-					updateReq.Instances = &instances
-					updateReq.Annotation = &desireAppRequest.ETag
-
-					exposedPorts, err := builder.ExtractExposedPorts(&desireAppRequest)
-					if err != nil {
-						logger.Error("failed-updating-stale-lrp", err, lager.Data{
-							"process-guid":       processGuid,
-							"execution-metadata": desireAppRequest.ExecutionMetadata,
-						})
+					updateReq, err := buildUpdate(logger, builder, &desireAppRequest, existingSchedulingInfo)
+					if invalidRoutes(err) {
+						// instances and the ETag still follow CC
+						atomic.AddInt32(invalidCount, int32(1))
+					} else if err != nil {
 						errc <- err
 						return
 					}
 
-					routes, err := helpers.CCRouteInfoToRoutes(desireAppRequest.RoutingInfo, exposedPorts)
-					if err != nil {
-						logger.Error("failed-to-marshal-routes", err)
-						errc <- err
-						return
-					}
+					// a matching ETag means this LRP came from a deep reconcile
+					// and is only updated if it has drifted from CC
+					if existingSchedulingInfo.Annotation == desireAppRequest.ETag {
+						desired, err := builder.Build(&desireAppRequest)
+						if err != nil {
+							logger.Error("failed-building-desired-lrp-for-drift-check", err, lager.Data{"process-guid": processGuid})
+							errc <- err
+							return
+						}
 
-					updateReq.Routes = &routes
+						reasons := lrpDrift(existingSchedulingInfo, updateReq, desired)
+						if len(reasons) == 0 {
+							return
+						}
+
+						atomic.AddInt32(driftCount, int32(1))
+						logger.Info("found-drifted-lrp", lager.Data{"process-guid": processGuid, "reasons": reasons})
 
-					for k, v := range existingSchedulingInfo.Routes {
-						if k != cfroutes.CF_ROUTER && k != tcp_routes.TCP_ROUTER {
-							(*updateReq.Routes)[k] = v
+						if !repairableDrift(reasons) {
+							logger.Info("drift-not-repairable-by-update", lager.Data{"process-guid": processGuid, "reasons": reasons})
+							return
 						}
 					}
 
 					logger.Debug("updating-stale-lrp", updateDesiredRequestDebugData(processGuid, updateReq))
-					err = l.bbsClient.UpdateDesiredLRP(logger, processGuid, updateReq)
+					err = l.writeLRP(guard, processGuid, func() error {
+						return l.bbsClient.UpdateDesiredLRP(logger, processGuid, updateReq)
+					})
+					if err == errWriteAbandoned {
+						return
+					}
 					if err != nil {
 						logger.Error("failed-updating-stale-lrp", err, lager.Data{
 							"process-guid": processGuid,
@@ -389,9 +504,108 @@ func (l *LRPProcessor) updateStaleDesiredLRPs(
 	return errc
 }
 
+func (l *LRPProcessor) builderFor(desireAppRequest *cc_messages.DesireAppRequestFromCC) recipebuilder.RecipeBuilder {
+	if desireAppRequest.DockerImageUrl != "" {
+		return l.builders["docker"]
+	}
+	return l.builders["buildpack"]
+}
+
+// fetchDesiredAppsByGuid fetches the desired apps for the process guids from
+// CC, keyed by process guid. Apps CC no longer desires are left out.
+func (l *LRPProcessor) fetchDesiredAppsByGuid(logger lager.Logger, processGuids []string) (map[string]*cc_messages.DesireAppRequestFromCC, error) {
+	fingerprints := make([]cc_messages.CCDesiredAppFingerprint, len(processGuids))
+	for i, guid := range processGuids {
+		fingerprints[i] = cc_messages.CCDesiredAppFingerprint{ProcessGuid: guid}
+	}
+
+	fingerprintCh := make(chan []cc_messages.CCDesiredAppFingerprint, 1)
+	fingerprintCh <- fingerprints
+	close(fingerprintCh)
+
+	cancel := make(chan struct{})
+	defer close(cancel)
+
+	desiredCh, errc := l.fetcher.FetchDesiredApps(logger, cancel, l.httpClient, fingerprintCh)
+
+	desiredApps := map[string]*cc_messages.DesireAppRequestFromCC{}
+	for batch := range desiredCh {
+		for i := range batch {
+			desiredApps[batch[i].ProcessGuid] = &batch[i]
+		}
+	}
+
+	for err := range errc {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return desiredApps, nil
+}
+
+// buildUpdate builds the update that brings an existing LRP in line with CC,
+// keeping any routes that belong to systems other than CC. Routes from CC
+// that are invalid are left out of the update and reported in a
+// helpers.RouteValidationError returned along with it.
+func buildUpdate(
+	logger lager.Logger,
+	builder recipebuilder.RecipeBuilder,
+	desireAppRequest *cc_messages.DesireAppRequestFromCC,
+	existingSchedulingInfo *models.DesiredLRPSchedulingInfo,
+) (*models.DesiredLRPUpdate, error) {
+	processGuid := desireAppRequest.ProcessGuid
+
+	updateReq := &models.DesiredLRPUpdate{}
+	instances := int32(desireAppRequest.NumInstances)
+	updateReq.Instances = &instances
+	updateReq.Annotation = &desireAppRequest.ETag
+
+	exposedPorts, err := builder.ExtractExposedPorts(desireAppRequest)
+	if err != nil {
+		logger.Error("failed-updating-stale-lrp", err, lager.Data{
+			"process-guid":       processGuid,
+			"execution-metadata": desireAppRequest.ExecutionMetadata,
+		})
+		return nil, err
+	}
+
+	routes, err := helpers.CCRouteInfoToRoutes(desireAppRequest.RoutingInfo, exposedPorts)
+	if invalidRoutes(err) {
+		logger.Info("dropped-invalid-routes", lager.Data{
+			"process-guid": processGuid,
+			"problems":     err.(helpers.RouteValidationError).Problems,
+		})
+	} else if err != nil {
+		logger.Error("failed-to-marshal-routes", err)
+		return nil, err
+	}
+
+	mergedRoutes := helpers.MergeRoutes(existingSchedulingInfo.Routes, routes)
+	updateReq.Routes = &mergedRoutes
+
+	return updateReq, err
+}
+
+// invalidRoutes reports whether CC asked for routes nsync will never desire.
+// Such LRPs are counted as invalid rather than failing the sync; their
+// remaining routes are still desired.
+func invalidRoutes(err error) bool {
+	_, ok := err.(helpers.RouteValidationError)
+	return ok
+}
+
+func (l *LRPProcessor) deepReconcileDue(now time.Time) bool {
+	if l.deepReconcileInterval <= 0 {
+		return false
+	}
+
+	return l.lastDeepReconcile.IsZero() || now.Sub(l.lastDeepReconcile) >= l.deepReconcileInterval
+}
+
 func (l *LRPProcessor) getSchedulingInfos(logger lager.Logger) ([]*models.DesiredLRPSchedulingInfo, error) {
 	logger.Info("getting-desired-lrps-from-bbs")
-	existing, err := l.bbsClient.DesiredLRPSchedulingInfos(logger, models.DesiredLRPFilter{Domain: cc_messages.AppLRPDomain})
+	existing, err := l.bbsClient.DesiredLRPSchedulingInfos(logger, models.DesiredLRPFilter{Domain: l.domain})
 	if err != nil {
 		logger.Error("failed-getting-desired-lrps-from-bbs", err)
 		return nil, err
@@ -401,20 +615,71 @@ func (l *LRPProcessor) getSchedulingInfos(logger lager.Logger) ([]*models.Desire
 	return existing, nil
 }
 
-func (l *LRPProcessor) deleteExcess(logger lager.Logger, cancel <-chan struct{}, excess []string) {
+func (l *LRPProcessor) deleteExcess(logger lager.Logger, guard *writeGuard, excess []string) <-chan error {
 	logger = logger.Session("delete-excess")
 
-	logger.Info("processing-batch", lager.Data{"num-to-delete": len(excess), "guids-to-delete": excess})
-	deletedGuids := make([]string, 0, len(excess))
-	for _, deleteGuid := range excess {
-		err := l.bbsClient.RemoveDesiredLRP(logger, deleteGuid)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+
+		if len(excess) == 0 {
+			return
+		}
+
+		works := make([]func(), len(excess))
+
+		for i, deleteGuid := range excess {
+			deleteGuid := deleteGuid
+
+			works[i] = func() {
+				err := l.writeLRP(guard, deleteGuid, func() error {
+					return l.bbsClient.RemoveDesiredLRP(logger, deleteGuid)
+				})
+				if err == errWriteAbandoned {
+					return
+				}
+				if err != nil {
+					if models.ConvertError(err).Type == models.Error_ResourceNotFound {
+						logger.Debug("desired-lrp-already-removed", lager.Data{"process-guid": deleteGuid})
+						l.deleteSSHKeys(logger, deleteGuid)
+						return
+					}
+
+					logger.Error("failed-deleting-desired-lrp", err, lager.Data{"process-guid": deleteGuid})
+					errc <- err
+					return
+				}
+				logger.Debug("succeeded-deleting-desired-lrp", lager.Data{"process-guid": deleteGuid})
+				l.deleteSSHKeys(logger, deleteGuid)
+			}
+		}
+
+		throttler, err := workpool.NewThrottler(l.updateLRPWorkPoolSize, works)
 		if err != nil {
-			logger.Error("failed-processing-batch", err, lager.Data{"delete-request": deleteGuid})
-		} else {
-			deletedGuids = append(deletedGuids, deleteGuid)
+			errc <- err
+			return
 		}
+
+		logger.Info("processing-batch", lager.Data{"num-to-delete": len(excess), "guids-to-delete": excess})
+		throttler.Work()
+		logger.Info("done-processing-batch", lager.Data{"num-to-delete": len(excess)})
+	}()
+
+	return errc
+}
+
+// deleteSSHKeys forgets the SSH keys of an LRP the processor removed, so that
+// the key store does not keep the keys of every app ever deleted.
+func (l *LRPProcessor) deleteSSHKeys(logger lager.Logger, processGuid string) {
+	if l.sshKeyStore == nil {
+		return
+	}
+
+	err := l.sshKeyStore.Delete(processGuid)
+	if err != nil {
+		logger.Error("failed-deleting-ssh-keys", err, lager.Data{"process-guid": processGuid})
 	}
-	logger.Info("succeeded-processing-batch", lager.Data{"num-deleted": len(deletedGuids), "deleted-guids": deletedGuids})
 }
 
 func countErrors(source <-chan error) (<-chan error, <-chan int) {
@@ -514,7 +779,7 @@ func desireAppRequestDebugData(desireAppRequest *cc_messages.DesireAppRequestFro
 	}
 }
 
-func initializeHttpClient(skipCertVerify bool) *http.Client {
+func initializeHttpClient(tlsConfig *tls.Config) *http.Client {
 	httpClient := cf_http.NewClient()
 	httpClient.Transport = &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
@@ -523,10 +788,7 @@ func initializeHttpClient(skipCertVerify bool) *http.Client {
 			KeepAlive: 30 * time.Second,
 		}).Dial,
 		TLSHandshakeTimeout: 10 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: skipCertVerify,
-			MinVersion:         tls.VersionTLS10,
-		},
+		TLSClientConfig:     tlsConfig,
 	}
 	return httpClient
 }
@@ -1,6 +1,7 @@
 package bulk_test
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"github.com/cloudfoundry-incubator/bbs/models"
 	"github.com/cloudfoundry-incubator/nsync/bulk"
 	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 	"github.com/cloudfoundry-incubator/routing-info/cfroutes"
 	"github.com/cloudfoundry-incubator/routing-info/tcp_routes"
@@ -36,6 +38,7 @@ var _ = Describe("LRPProcessor", func() {
 		fetcher                *fakes.FakeFetcher
 		buildpackRecipeBuilder *fakes.FakeRecipeBuilder
 		dockerRecipeBuilder    *fakes.FakeRecipeBuilder
+		sshKeyStore            *fakes.FakeSSHKeyStore
 
 		processor ifrit.Runner
 
@@ -43,19 +46,55 @@ var _ = Describe("LRPProcessor", func() {
 		syncDuration time.Duration
 		metricSender *fake.FakeMetricSender
 		clock        *fakeclock.FakeClock
+		ownership    *bulk.LockOwnership
+		shard        bulk.Shard
+		domain       string
+		writeLimiter *bulk.WriteLimiter
 
-		pollingInterval time.Duration
+		pollingInterval       time.Duration
+		deepReconcileInterval time.Duration
 
 		logger *lagertest.TestLogger
 	)
 
+	// contexts that change the processor's configuration rebuild it with
+	// newProcessor in their own BeforeEach
+	newProcessor := func() ifrit.Runner {
+		return bulk.NewLRPProcessor(
+			logger,
+			bbsClient,
+			500*time.Millisecond,
+			domain,
+			time.Second,
+			deepReconcileInterval,
+			10,
+			50,
+			&tls.Config{},
+			fetcher,
+			map[string]recipebuilder.RecipeBuilder{
+				"buildpack": buildpackRecipeBuilder,
+				"docker":    dockerRecipeBuilder,
+			},
+			sshKeyStore,
+			shard,
+			writeLimiter,
+			ownership,
+			clock,
+		)
+	}
+
 	BeforeEach(func() {
 		metricSender = fake.NewFakeMetricSender()
 		metrics.Initialize(metricSender, nil)
 
 		syncDuration = 900900
 		pollingInterval = 500 * time.Millisecond
+		deepReconcileInterval = 0
 		clock = fakeclock.NewFakeClock(time.Now())
+		ownership = bulk.NewLockOwnership()
+		shard = bulk.Shard{}
+		domain = cc_messages.AppLRPDomain
+		writeLimiter = nil
 
 		fingerprintsToFetch = []cc_messages.CCDesiredAppFingerprint{
 			{ProcessGuid: "current-process-guid", ETag: "current-etag"},
@@ -164,6 +203,8 @@ var _ = Describe("LRPProcessor", func() {
 			return []uint32{8080}, nil
 		}
 
+		sshKeyStore = new(fakes.FakeSSHKeyStore)
+
 		dockerRecipeBuilder = new(fakes.FakeRecipeBuilder)
 		dockerRecipeBuilder.BuildStub = func(ccRequest *cc_messages.DesireAppRequestFromCC) (*models.DesiredLRP, error) {
 			createRequest := models.DesiredLRP{
@@ -183,21 +224,7 @@ var _ = Describe("LRPProcessor", func() {
 
 		logger = lagertest.NewTestLogger("test")
 
-		processor = bulk.NewLRPProcessor(
-			logger,
-			bbsClient,
-			500*time.Millisecond,
-			time.Second,
-			10,
-			50,
-			false,
-			fetcher,
-			map[string]recipebuilder.RecipeBuilder{
-				"buildpack": buildpackRecipeBuilder,
-				"docker":    dockerRecipeBuilder,
-			},
-			clock,
-		)
+		processor = newProcessor()
 	})
 
 	JustBeforeEach(func() {
@@ -366,6 +393,7 @@ var _ = Describe("LRPProcessor", func() {
 					_, desiredLRP := bbsClient.DesireLRPArgsForCall(0)
 					Expect(desiredLRP).To(BeEquivalentTo(&models.DesiredLRP{
 						ProcessGuid: "new-process-guid",
+						Domain:      "cf-apps",
 						Annotation:  "new-etag",
 					}))
 
@@ -377,6 +405,11 @@ var _ = Describe("LRPProcessor", func() {
 					Expect(ttl).To(Equal(1 * time.Second))
 				})
 
+				It("deletes the SSH keys of the removed LRP", func() {
+					Eventually(sshKeyStore.DeleteCallCount).Should(Equal(1))
+					Expect(sshKeyStore.DeleteArgsForCall(0)).To(Equal("excess-process-guid"))
+				})
+
 				Context("and the create request fails", func() {
 					BeforeEach(func() {
 						bbsClient.DesireLRPReturns(errors.New("create failed!"))
@@ -400,6 +433,25 @@ var _ = Describe("LRPProcessor", func() {
 					It("sends all the other updates", func() {
 						Eventually(bbsClient.DesireLRPCallCount).Should(Equal(1))
 						Eventually(bbsClient.RemoveDesiredLRPCallCount).Should(Equal(1))
+					})
+
+					It("does not update the domain", func() {
+						Eventually(bbsClient.RemoveDesiredLRPCallCount).Should(Equal(1))
+						Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(0))
+					})
+
+					It("keeps the SSH keys", func() {
+						Eventually(bbsClient.RemoveDesiredLRPCallCount).Should(Equal(1))
+						Consistently(sshKeyStore.DeleteCallCount).Should(Equal(0))
+					})
+				})
+
+				Context("and the LRP to delete is already gone", func() {
+					BeforeEach(func() {
+						bbsClient.RemoveDesiredLRPReturns(models.ErrResourceNotFound)
+					})
+
+					It("updates the domain", func() {
 						Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
 					})
 				})
@@ -571,6 +623,83 @@ var _ = Describe("LRPProcessor", func() {
 					Eventually(bbsClient.RemoveDesiredLRPCallCount).Should(Equal(1))
 				})
 			})
+
+			Context("when CC's routes for a new app are invalid", func() {
+				BeforeEach(func() {
+					buildpackRecipeBuilder.BuildStub = func(ccRequest *cc_messages.DesireAppRequestFromCC) (*models.DesiredLRP, error) {
+						return nil, helpers.RouteValidationError{Problems: []string{`invalid hostname "-"`}}
+					}
+				})
+
+				It("does not desire it", func() {
+					Consistently(bbsClient.DesireLRPCallCount).Should(Equal(0))
+				})
+
+				It("counts it as invalid and updates the domain", func() {
+					Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+					Eventually(func() fake.Metric {
+						return metricSender.GetValue("NsyncInvalidDesiredLRPsFound")
+					}).Should(Equal(fake.Metric{Value: 1, Unit: "Metric"}))
+				})
+			})
+
+			Context("when CC's routes for a stale app are invalid", func() {
+				BeforeEach(func() {
+					fetchDesiredApps := fetcher.FetchDesiredAppsStub
+					fetcher.FetchDesiredAppsStub = func(
+						logger lager.Logger,
+						cancel <-chan struct{},
+						httpClient *http.Client,
+						fingerprints <-chan []cc_messages.CCDesiredAppFingerprint,
+					) (<-chan []cc_messages.DesireAppRequestFromCC, <-chan error) {
+						desired, errc := fetchDesiredApps(logger, cancel, httpClient, fingerprints)
+
+						badRoutes, err := cc_messages.CCHTTPRoutes{{Hostname: "bad host"}}.CCRouteInfo()
+						Expect(err).NotTo(HaveOccurred())
+
+						results := make(chan []cc_messages.DesireAppRequestFromCC, 1)
+						batch := <-desired
+						for i := range batch {
+							if batch[i].ProcessGuid == "stale-process-guid" {
+								batch[i].RoutingInfo = badRoutes
+								batch[i].NumInstances = 3
+							}
+						}
+						results <- batch
+						close(results)
+
+						return results, errc
+					}
+				})
+
+				It("still updates its instances and ETag, without the invalid routes", func() {
+					Eventually(bbsClient.UpdateDesiredLRPCallCount).Should(Equal(2))
+
+					var update *models.DesiredLRPUpdate
+					for i := 0; i < 2; i++ {
+						_, guid, u := bbsClient.UpdateDesiredLRPArgsForCall(i)
+						if guid == "stale-process-guid" {
+							update = u
+						}
+					}
+					Expect(update).NotTo(BeNil())
+					Expect(*update.Instances).To(BeEquivalentTo(3))
+					Expect(*update.Annotation).To(Equal("new-etag"))
+
+					var cfRoutes cfroutes.CFRoutes
+					Expect(json.Unmarshal(*(*update.Routes)[cfroutes.CF_ROUTER], &cfRoutes)).To(Succeed())
+					Expect(cfRoutes).To(BeEmpty())
+
+					Eventually(logger.TestSink.Buffer).Should(gbytes.Say("dropped-invalid-routes"))
+				})
+
+				It("counts it as invalid and updates the domain", func() {
+					Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+					Eventually(func() fake.Metric {
+						return metricSender.GetValue("NsyncInvalidDesiredLRPsFound")
+					}).Should(Equal(fake.Metric{Value: 1, Unit: "Metric"}))
+				})
+			})
 		})
 	})
 
@@ -637,4 +766,262 @@ var _ = Describe("LRPProcessor", func() {
 			Consistently(bbsClient.RemoveDesiredLRPCallCount).Should(Equal(0))
 		})
 	})
+
+	Context("when deep reconciliation is enabled", func() {
+		BeforeEach(func() {
+			deepReconcileInterval = time.Minute
+			processor = newProcessor()
+		})
+
+		Context("and a current LRP has drifted from CC", func() {
+			It("updates it even though its ETag matches", func() {
+				Eventually(bbsClient.UpdateDesiredLRPCallCount).Should(Equal(3))
+
+				updatedGuids := []string{}
+				for i := 0; i < 3; i++ {
+					_, processGuid, _ := bbsClient.UpdateDesiredLRPArgsForCall(i)
+					updatedGuids = append(updatedGuids, processGuid)
+				}
+				Expect(updatedGuids).To(ConsistOf("current-process-guid", "stale-process-guid", "docker-process-guid"))
+			})
+
+			It("logs the reason for the update", func() {
+				Eventually(logger.TestSink.Buffer).Should(gbytes.Say(`found-drifted-lrp.*"process-guid":"current-process-guid","reasons":\["routes"\]`))
+			})
+
+			It("emits the number of drifted LRPs found", func() {
+				Eventually(func() fake.Metric {
+					return metricSender.GetValue("NsyncDriftedDesiredLRPsFound")
+				}).Should(Equal(fake.Metric{Value: 1, Unit: "Metric"}))
+			})
+		})
+
+		Context("and a current LRP matches CC", func() {
+			BeforeEach(func() {
+				routeInfo, err := cc_messages.CCHTTPRoutes{
+					{Hostname: "host-current-process-guid"},
+				}.CCRouteInfo()
+				Expect(err).NotTo(HaveOccurred())
+
+				routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+				Expect(err).NotTo(HaveOccurred())
+
+				existingSchedulingInfos[0].Routes = routes
+			})
+
+			It("does not update it", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+				Expect(bbsClient.UpdateDesiredLRPCallCount()).To(Equal(2))
+
+				Eventually(func() fake.Metric {
+					return metricSender.GetValue("NsyncDriftedDesiredLRPsFound")
+				}).Should(Equal(fake.Metric{Value: 0, Unit: "Metric"}))
+			})
+		})
+
+		It("does not deep reconcile again until the interval has passed", func() {
+			Eventually(bbsClient.UpdateDesiredLRPCallCount).Should(Equal(3))
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+
+			clock.Increment(pollingInterval + time.Millisecond)
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+			Expect(bbsClient.UpdateDesiredLRPCallCount()).To(Equal(5))
+		})
+	})
+
+	Context("when a sync is triggered", func() {
+		It("syncs immediately without waiting for the polling interval", func() {
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+
+			processor.(bulk.SyncController).Trigger()
+
+			Eventually(bbsClient.DesiredLRPSchedulingInfosCallCount).Should(Equal(2))
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+		})
+	})
+
+	Context("when sharded", func() {
+		BeforeEach(func() {
+			shard = bulk.Shard{Index: 0, Count: 2}
+			processor = newProcessor()
+		})
+
+		Context("and the other shard has not synced", func() {
+			BeforeEach(func() {
+				bbsClient.DomainsReturns([]string{"cf-apps-shard-0-of-2"}, nil)
+			})
+
+			It("records its own sync but does not bump freshness", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+				Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+
+				_, domain, _ := bbsClient.UpsertDomainArgsForCall(0)
+				Expect(domain).To(Equal("cf-apps-shard-0-of-2"))
+			})
+		})
+
+		Context("and every shard has synced", func() {
+			BeforeEach(func() {
+				bbsClient.DomainsReturns([]string{"cf-apps-shard-0-of-2", "cf-apps-shard-1-of-2"}, nil)
+			})
+
+			It("bumps freshness", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+
+				_, domain, _ := bbsClient.UpsertDomainArgsForCall(1)
+				Expect(domain).To(Equal(cc_messages.AppLRPDomain))
+			})
+		})
+	})
+
+	Context("when syncing another CC source's domain", func() {
+		BeforeEach(func() {
+			domain = "cf-apps-east"
+			processor = newProcessor()
+		})
+
+		It("compares against and creates LRPs in that domain", func() {
+			Eventually(bbsClient.DesireLRPCallCount).Should(Equal(1))
+
+			_, filter := bbsClient.DesiredLRPSchedulingInfosArgsForCall(0)
+			Expect(filter.Domain).To(Equal("cf-apps-east"))
+
+			_, desiredLRP := bbsClient.DesireLRPArgsForCall(0)
+			Expect(desiredLRP.Domain).To(Equal("cf-apps-east"))
+		})
+
+		It("bumps only that domain", func() {
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+			Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+
+			_, upserted, _ := bbsClient.UpsertDomainArgsForCall(0)
+			Expect(upserted).To(Equal("cf-apps-east"))
+		})
+
+		It("labels its metrics with that domain", func() {
+			Eventually(func() fake.Metric { return metricSender.GetValue("DesiredLRPSyncDuration.cf-apps-east") }).Should(Equal(fake.Metric{
+				Value: float64(syncDuration),
+				Unit:  "nanos",
+			}))
+			Expect(metricSender.GetValue("DesiredLRPSyncDuration")).To(Equal(fake.Metric{}))
+		})
+	})
+
+	Context("when BBS writes are rate limited", func() {
+		BeforeEach(func() {
+			writeLimiter = bulk.NewWriteLimiter(logger, 1, 0, clock)
+			processor = newProcessor()
+		})
+
+		bbsWrites := func() int {
+			return bbsClient.DesireLRPCallCount() +
+				bbsClient.UpdateDesiredLRPCallCount() +
+				bbsClient.RemoveDesiredLRPCallCount()
+		}
+
+		It("spaces the sync's writes out to the configured rate", func() {
+			Eventually(bbsWrites).Should(Equal(1))
+			Consistently(bbsWrites).Should(Equal(1))
+
+			clock.Increment(time.Second)
+			Eventually(bbsWrites).Should(Equal(2))
+			Consistently(bbsWrites).Should(Equal(2))
+		})
+	})
+
+	Context("when the lock is lost during a sync", func() {
+		BeforeEach(func() {
+			fetchFingerprints := fetcher.FetchFingerprintsStub
+			fetcher.FetchFingerprintsStub = func(
+				logger lager.Logger,
+				cancel <-chan struct{},
+				httpClient *http.Client,
+			) (<-chan []cc_messages.CCDesiredAppFingerprint, <-chan error) {
+				ownership.Lose()
+				return fetchFingerprints(logger, cancel, httpClient)
+			}
+		})
+
+		It("abandons the sync's writes and does not bump freshness", func() {
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+
+			Expect(bbsClient.DesireLRPCallCount()).To(Equal(0))
+			Expect(bbsClient.UpdateDesiredLRPCallCount()).To(Equal(0))
+			Expect(bbsClient.RemoveDesiredLRPCallCount()).To(Equal(0))
+			Expect(bbsClient.UpsertDomainCallCount()).To(Equal(0))
+		})
+
+		It("records the abandoned writes", func() {
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("lock-lost-cancelling-sync"))
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("abandoned-writes"))
+			Eventually(func() string {
+				return metricSender.GetValue("NsyncAbandonedWrites").Unit
+			}).Should(Equal("Metric"))
+		})
+	})
+
+	Context("when the lock is lost between syncs", func() {
+		It("stops syncing", func() {
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+
+			ownership.Lose()
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+
+			clock.Increment(pollingInterval + time.Millisecond)
+			Consistently(bbsClient.DesiredLRPSchedulingInfosCallCount).Should(Equal(1))
+		})
+	})
+
+	Context("when syncing is paused", func() {
+		BeforeEach(func() {
+			processor.(bulk.SyncController).Pause()
+		})
+
+		It("does not sync or bump freshness", func() {
+			clock.Increment(pollingInterval + time.Millisecond)
+			Consistently(bbsClient.DesiredLRPSchedulingInfosCallCount).Should(Equal(0))
+			Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(0))
+		})
+
+		It("ignores triggered syncs", func() {
+			processor.(bulk.SyncController).Trigger()
+			Consistently(bbsClient.DesiredLRPSchedulingInfosCallCount).Should(Equal(0))
+		})
+
+		Context("and then resumed", func() {
+			It("syncs again on the next trigger", func() {
+				Consistently(bbsClient.DesiredLRPSchedulingInfosCallCount).Should(Equal(0))
+
+				processor.(bulk.SyncController).Resume()
+				processor.(bulk.SyncController).Trigger()
+
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+			})
+		})
+	})
+
+	Context("when syncing is paused while a sync is running", func() {
+		BeforeEach(func() {
+			fetchDesiredApps := fetcher.FetchDesiredAppsStub
+			fetcher.FetchDesiredAppsStub = func(
+				logger lager.Logger,
+				cancel <-chan struct{},
+				httpClient *http.Client,
+				fingerprints <-chan []cc_messages.CCDesiredAppFingerprint,
+			) (<-chan []cc_messages.DesireAppRequestFromCC, <-chan error) {
+				processor.(bulk.SyncController).Pause()
+				return fetchDesiredApps(logger, cancel, httpClient, fingerprints)
+			}
+		})
+
+		It("makes no further writes and does not bump freshness", func() {
+			Eventually(fetcher.FetchDesiredAppsCallCount).Should(Equal(1))
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("paused-not-bumping-freshness"))
+
+			Expect(bbsClient.DesireLRPCallCount()).To(Equal(0))
+			Expect(bbsClient.UpdateDesiredLRPCallCount()).To(Equal(0))
+			Expect(bbsClient.RemoveDesiredLRPCallCount()).To(Equal(0))
+			Expect(bbsClient.UpsertDomainCallCount()).To(Equal(0))
+		})
+	})
 })
@@ -0,0 +1,56 @@
+package bulk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+)
+
+// ownWriteWindow is how long after writing an LRP the bulker ignores BBS
+// events about it, which would otherwise echo its own writes back to it.
+const ownWriteWindow = 30 * time.Second
+
+// ownWrites remembers which LRPs this bulker has just written.
+type ownWrites struct {
+	lock      sync.Mutex
+	clock     clock.Clock
+	writtenAt map[string]time.Time
+	pruneAt   int
+}
+
+func newOwnWrites(clock clock.Clock) *ownWrites {
+	return &ownWrites{
+		clock:     clock,
+		writtenAt: map[string]time.Time{},
+	}
+}
+
+func (w *ownWrites) mark(processGuid string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := w.clock.Now()
+	w.writtenAt[processGuid] = now
+
+	// prune whenever the map doubles, so marking stays cheap
+	if len(w.writtenAt) < w.pruneAt {
+		return
+	}
+
+	for guid, writtenAt := range w.writtenAt {
+		if now.Sub(writtenAt) >= ownWriteWindow {
+			delete(w.writtenAt, guid)
+		}
+	}
+	w.pruneAt = 2*len(w.writtenAt) + 1
+}
+
+// recent reports whether the bulker wrote the LRP within the window.
+func (w *ownWrites) recent(processGuid string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	writtenAt, found := w.writtenAt[processGuid]
+	return found && w.clock.Now().Sub(writtenAt) < ownWriteWindow
+}
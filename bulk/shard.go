@@ -0,0 +1,94 @@
+package bulk
+
+import (
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bbs"
+	"github.com/cloudfoundry-incubator/runtime-schema/metric"
+	"github.com/pivotal-golang/lager"
+)
+
+const failedDomainUpserts = metric.Counter("NsyncFailedDomainUpserts")
+
+// Shard is the range of process and task guids one bulker instance owns
+// when Count instances share the work. Guids are hashed onto a ring split
+// into Count equal ranges, of which the shard owns the Index'th. A Count of
+// one or less owns every guid.
+type Shard struct {
+	Index int
+	Count int
+}
+
+func (s Shard) Owns(guid string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+
+	hash := uint64(crc32.ChecksumIEEE([]byte(guid)))
+	return int(hash*uint64(s.Count)>>32) == s.Index
+}
+
+func (s Shard) sharded() bool {
+	return s.Count > 1
+}
+
+// syncedDomain is the domain a shard keeps fresh to report that its last
+// sync of the domain succeeded.
+//
+// These domains are written to BBS like any other, with the domain TTL, and
+// nothing deletes them: BBS has no API to remove a domain. After a reshard
+// the old shards' domains, named for the old count, are no longer bumped or
+// read, so they simply go stale once their TTL passes. They are harmless, as
+// nothing outside nsync acts on them.
+func (s Shard) syncedDomain(domain string) string {
+	return fmt.Sprintf("%s-shard-%d-of-%d", domain, s.Index, s.Count)
+}
+
+// markDomainFresh bumps the domain once the shard has synced it. A sharded
+// bulker first records its own success, then bumps the domain only if every
+// shard has succeeded within the TTL, since each has seen only part of it.
+// Failures are counted; the caller logs them.
+func markDomainFresh(logger lager.Logger, bbsClient bbs.Client, shard Shard, domain string, ttl time.Duration) error {
+	err := upsertFreshDomain(logger, bbsClient, shard, domain, ttl)
+	if err != nil {
+		metricErr := metric.Counter(sourceMetric(string(failedDomainUpserts), domain)).Increment()
+		if metricErr != nil {
+			logger.Error("failed-to-send-failed-domain-upserts-metric", metricErr)
+		}
+	}
+
+	return err
+}
+
+func upsertFreshDomain(logger lager.Logger, bbsClient bbs.Client, shard Shard, domain string, ttl time.Duration) error {
+	if !shard.sharded() {
+		return bbsClient.UpsertDomain(logger, domain, ttl)
+	}
+
+	err := bbsClient.UpsertDomain(logger, shard.syncedDomain(domain), ttl)
+	if err != nil {
+		return err
+	}
+
+	freshDomains, err := bbsClient.Domains(logger)
+	if err != nil {
+		return err
+	}
+
+	fresh := make(map[string]bool, len(freshDomains))
+	for _, freshDomain := range freshDomains {
+		fresh[freshDomain] = true
+	}
+
+	for index := 0; index < shard.Count; index++ {
+		other := Shard{Index: index, Count: shard.Count}
+		if !fresh[other.syncedDomain(domain)] {
+			logger.Info("waiting-for-shard-to-sync", lager.Data{"domain": domain, "shard": index})
+			return nil
+		}
+	}
+
+	return bbsClient.UpsertDomain(logger, domain, ttl)
+}
@@ -0,0 +1,47 @@
+package bulk_test
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shard", func() {
+	It("owns every guid when unsharded", func() {
+		Expect(bulk.Shard{}.Owns("some-guid")).To(BeTrue())
+		Expect(bulk.Shard{Index: 0, Count: 1}.Owns("some-guid")).To(BeTrue())
+	})
+
+	It("assigns each guid to exactly one shard, spreading them across all shards", func() {
+		counts := make([]int, 4)
+
+		for i := 0; i < 1000; i++ {
+			guid := fmt.Sprintf("process-guid-%d", i)
+
+			owners := 0
+			for index := range counts {
+				if (bulk.Shard{Index: index, Count: len(counts)}).Owns(guid) {
+					owners++
+					counts[index]++
+				}
+			}
+			Expect(owners).To(Equal(1))
+		}
+
+		for _, count := range counts {
+			Expect(count).To(BeNumerically(">", 150))
+		}
+	})
+})
+
+// guidInShard returns a guid with the prefix that the shard owns or not.
+func guidInShard(prefix string, shard bulk.Shard, owned bool) string {
+	for i := 0; ; i++ {
+		guid := fmt.Sprintf("%s-%d", prefix, i)
+		if shard.Owns(guid) == owned {
+			return guid
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package bulk
+
+import "github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+
+// sourceMetric labels a sync's metric with the BBS domain it syncs, which
+// names its CC source, so that the sources of one bulker do not overwrite
+// each other's values. Metrics carry no tags, so the label is part of the
+// name; the default domains keep the bare names a single CC has always sent.
+func sourceMetric(name, domain string) string {
+	if domain == cc_messages.AppLRPDomain || domain == cc_messages.RunningTaskDomain {
+		return name
+	}
+
+	return name + "." + domain
+}
@@ -0,0 +1,80 @@
+package bulk
+
+import "sync/atomic"
+
+//go:generate counterfeiter -o fakes/fake_sync_controller.go . SyncController
+
+type SyncController interface {
+	Trigger()
+	Pause()
+	Resume()
+	Paused() bool
+}
+
+type syncControl struct {
+	trigger chan struct{}
+	paused  int32
+}
+
+func newSyncControl() *syncControl {
+	return &syncControl{
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// Trigger requests an immediate sync. Triggers received while a sync is
+// already pending are coalesced into it.
+func (c *syncControl) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (c *syncControl) Pause() {
+	atomic.StoreInt32(&c.paused, 1)
+}
+
+func (c *syncControl) Resume() {
+	atomic.StoreInt32(&c.paused, 0)
+}
+
+func (c *syncControl) Paused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+func (c *syncControl) triggered() <-chan struct{} {
+	return c.trigger
+}
+
+// SyncControllers controls several processors as one, such as the processors
+// of every CC source. It counts as paused only once all of them are.
+type SyncControllers []SyncController
+
+func (cs SyncControllers) Trigger() {
+	for _, c := range cs {
+		c.Trigger()
+	}
+}
+
+func (cs SyncControllers) Pause() {
+	for _, c := range cs {
+		c.Pause()
+	}
+}
+
+func (cs SyncControllers) Resume() {
+	for _, c := range cs {
+		c.Resume()
+	}
+}
+
+func (cs SyncControllers) Paused() bool {
+	for _, c := range cs {
+		if !c.Paused() {
+			return false
+		}
+	}
+
+	return len(cs) > 0
+}
@@ -5,48 +5,260 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/pivotal-golang/clock"
 	"github.com/pivotal-golang/lager"
 )
 
 //go:generate counterfeiter -o fakes/fake_task_client.go . TaskClient
 
 type TaskClient interface {
-	FailTask(logger lager.Logger, taskState *cc_messages.CCTaskState, httpClient *http.Client) error
+	FailTask(logger lager.Logger, cancel <-chan struct{}, taskState *cc_messages.CCTaskState, reason TaskFailureReason, httpClient *http.Client) error
+	CompleteTask(logger lager.Logger, cancel <-chan struct{}, taskState *cc_messages.CCTaskState, task *models.Task, httpClient *http.Client) error
 }
 
+// errCallbackCancelled is returned when a callback is abandoned while waiting
+// to be retried.
+var errCallbackCancelled = errors.New("callback cancelled")
+
 type CCTaskClient struct {
+	// Authenticator, when set, adds credentials to completion callbacks in
+	// place of any embedded in the callback URL.
+	Authenticator Authenticator
+
+	// FailureStore, when set, records every task failed by nsync; tasks it
+	// already holds are not failed again.
+	FailureStore TaskFailureStore
+
+	// MaxAttempts is the number of times a callback is tried when it fails
+	// transiently (connection errors, 5xx and 429 responses).
+	MaxAttempts      int
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	// CallbackAllowlist, when set, restricts the callback URLs nsync will
+	// post to.
+	CallbackAllowlist *helpers.CallbackAllowlist
+
+	// SigningKey, when set, is used to sign callback payloads so that CC can
+	// verify they came from nsync. See SignCallback.
+	SigningKey []byte
+
+	// Clock times retries and stamps signatures and failure records.
+	// Defaults to the real clock.
+	Clock clock.Clock
 }
 
-func (tc *CCTaskClient) FailTask(logger lager.Logger, taskState *cc_messages.CCTaskState, httpClient *http.Client) error {
+// FailTask reports the task to CC as failed and records why. A task whose
+// callback URL is not allowed cannot be reported; it is recorded instead, so
+// that it is surfaced to operators once and not retried on every sync.
+func (tc *CCTaskClient) FailTask(logger lager.Logger, cancel <-chan struct{}, taskState *cc_messages.CCTaskState, reason TaskFailureReason, httpClient *http.Client) error {
 	taskGuid := taskState.TaskGuid
+
+	if record, found := tc.lookupFailure(logger, taskGuid); found {
+		logger.Info("task-already-failed", lager.Data{
+			"task_guid": taskGuid,
+			"reason":    record.Reason,
+			"failed-at": record.FailedAt,
+		})
+		return nil
+	}
+
 	payload, err := json.Marshal(cc_messages.TaskFailResponseForCC{
 		TaskGuid:      taskGuid,
 		Failed:        true,
-		FailureReason: "Unable to determine completion status",
+		FailureReason: reason.Message(),
 	})
 	if err != nil {
 		logger.Error("failed-to-marshal", err, lager.Data{"task_guid": taskGuid})
 		return err
 	}
 
-	req, err := http.NewRequest("POST", taskState.CompletionCallbackUrl, bytes.NewReader(payload))
+	attempts, err := tc.sendCallback(logger, cancel, taskGuid, taskState.CompletionCallbackUrl, payload, httpClient)
+	if err == helpers.ErrCallbackURLNotAllowed {
+		tc.recordFailure(logger, taskGuid, CallbackURLNotAllowed, 0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("failed-task", lager.Data{"task_guid": taskGuid, "reason": reason})
+
+	// the task has been failed in CC; losing its audit record should not
+	// make the sync retry it
+	tc.recordFailure(logger, taskGuid, reason, attempts)
+
+	return nil
+}
+
+// CompleteTask redelivers the result of a task that completed in BBS but
+// whose completion callback CC never acknowledged. It returns
+// helpers.ErrCallbackURLNotAllowed, without retrying, for a task whose
+// callback URL is not allowed; the task is recorded the first time.
+func (tc *CCTaskClient) CompleteTask(logger lager.Logger, cancel <-chan struct{}, taskState *cc_messages.CCTaskState, task *models.Task, httpClient *http.Client) error {
+	taskGuid := taskState.TaskGuid
+
+	if record, found := tc.lookupFailure(logger, taskGuid); found && record.Reason == CallbackURLNotAllowed {
+		return helpers.ErrCallbackURLNotAllowed
+	}
+
+	var annotation string
+	if task.TaskDefinition != nil {
+		annotation = task.TaskDefinition.Annotation
+	}
+
+	payload, err := json.Marshal(&models.TaskCallbackResponse{
+		TaskGuid:      taskGuid,
+		Failed:        task.Failed,
+		FailureReason: task.FailureReason,
+		Result:        task.Result,
+		Annotation:    annotation,
+		CreatedAt:     task.CreatedAt,
+	})
 	if err != nil {
+		logger.Error("failed-to-marshal", err, lager.Data{"task_guid": taskGuid})
 		return err
 	}
 
+	_, err = tc.sendCallback(logger, cancel, taskGuid, taskState.CompletionCallbackUrl, payload, httpClient)
+	if err == helpers.ErrCallbackURLNotAllowed {
+		tc.recordFailure(logger, taskGuid, CallbackURLNotAllowed, 0)
+	}
+
+	return err
+}
+
+func (tc *CCTaskClient) lookupFailure(logger lager.Logger, taskGuid string) (TaskFailureRecord, bool) {
+	if tc.FailureStore == nil {
+		return TaskFailureRecord{}, false
+	}
+
+	record, found, err := tc.FailureStore.Lookup(taskGuid)
+	if err != nil {
+		logger.Error("failed-looking-up-task-failure", err, lager.Data{"task_guid": taskGuid})
+		return TaskFailureRecord{}, false
+	}
+
+	return record, found
+}
+
+func (tc *CCTaskClient) recordFailure(logger lager.Logger, taskGuid string, reason TaskFailureReason, attempts int) {
+	if tc.FailureStore == nil {
+		return
+	}
+
+	err := tc.FailureStore.Record(TaskFailureRecord{
+		TaskGuid:      taskGuid,
+		Reason:        reason,
+		FailureReason: reason.Message(),
+		FailedAt:      tc.clock().Now(),
+		Attempts:      attempts,
+	})
+	if err != nil {
+		logger.Error("failed-recording-task-failure", err, lager.Data{"task_guid": taskGuid})
+	}
+}
+
+// sendCallback posts the payload to CC, retrying transient failures, and
+// returns the number of attempts made. Closing cancel abandons the callback
+// while it waits to retry.
+func (tc *CCTaskClient) sendCallback(logger lager.Logger, cancel <-chan struct{}, taskGuid, callbackURL string, payload []byte, httpClient *http.Client) (int, error) {
+	err := tc.CallbackAllowlist.Validate(callbackURL)
+	if err != nil {
+		logger.Error("callback-url-not-allowed", err, lager.Data{"task_guid": taskGuid})
+		return 0, err
+	}
+
+	maxAttempts := tc.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	reauthenticated := false
+	for attempt := 1; ; attempt++ {
+		statusCode, err := tc.postCallback(logger, callbackURL, payload, httpClient)
+		if err == nil && statusCode == http.StatusOK {
+			return attempt, nil
+		}
+
+		if err == nil && statusCode == http.StatusUnauthorized && tc.Authenticator != nil && !reauthenticated {
+			logger.Info("reauthenticating", lager.Data{"task_guid": taskGuid})
+			tc.Authenticator.Invalidate()
+			reauthenticated = true
+			attempt--
+			continue
+		}
+
+		retryable := err != nil || statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+		if err == nil {
+			err = errors.New("received bad response from CC ")
+			logger.Error("bad-response-from-cc", err, lager.Data{"task_guid": taskGuid, "status-code": statusCode})
+		}
+
+		if !retryable || attempt >= maxAttempts {
+			return attempt, err
+		}
+
+		delay := backoffDelay(tc.RetryInterval, tc.MaxRetryInterval, attempt)
+		logger.Info("retrying-callback", lager.Data{
+			"task_guid": taskGuid,
+			"attempt":   attempt,
+			"delay":     delay.String(),
+			"error":     err.Error(),
+		})
+
+		timer := tc.clock().NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-cancel:
+			timer.Stop()
+			logger.Info("callback-cancelled", lager.Data{"task_guid": taskGuid, "attempt": attempt})
+			return attempt, errCallbackCancelled
+		}
+	}
+}
+
+func (tc *CCTaskClient) postCallback(logger lager.Logger, callbackURL string, payload []byte, httpClient *http.Client) (int, error) {
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
 	req.Header.Set("Content-Type", "application/json")
+
+	if len(tc.SigningKey) > 0 {
+		now := tc.clock().Now()
+		req.Header.Set(CallbackTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set(CallbackSignatureHeader, SignCallback(tc.SigningKey, now, payload))
+	}
+
+	if tc.Authenticator != nil {
+		err = tc.Authenticator.Authenticate(logger, httpClient, req)
+		if err != nil {
+			logger.Error("failed-to-authenticate", err)
+			return 0, err
+		}
+	}
+
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		logger.Error("bad-response-from-cc", err, lager.Data{"task_guid": taskGuid})
-		return errors.New("received bad response from CC ")
+	return resp.StatusCode, nil
+}
+
+func (tc *CCTaskClient) clock() clock.Clock {
+	if tc.Clock != nil {
+		return tc.Clock
 	}
 
-	return nil
+	return clock.NewClock()
 }
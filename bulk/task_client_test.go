@@ -2,14 +2,21 @@ package bulk_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/cloudfoundry-incubator/bbs/models"
 	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager"
 	"github.com/pivotal-golang/lager/lagertest"
 )
 
@@ -21,9 +28,11 @@ var _ = Describe("TaskClient", func() {
 		httpClient *http.Client
 		taskGuid   string
 		taskState  *cc_messages.CCTaskState
+		cancel     chan struct{}
 	)
 
 	BeforeEach(func() {
+		cancel = make(chan struct{})
 		fakeCC = ghttp.NewServer()
 		logger = lagertest.NewTestLogger("test")
 		httpClient = &http.Client{Timeout: time.Second}
@@ -46,7 +55,7 @@ var _ = Describe("TaskClient", func() {
 						ghttp.VerifyJSON(`{
 						"task_guid": "`+taskGuid+`",
 						"failed": true,
-						"failure_reason": "Unable to determine completion status"
+						"failure_reason": "Unable to determine completion status: task not found in Diego (task-missing-from-bbs)"
 					}`),
 						ghttp.RespondWith(200, "{}"),
 					),
@@ -54,7 +63,7 @@ var _ = Describe("TaskClient", func() {
 			})
 
 			It("sends a fail task request to CC", func() {
-				err := taskClient.FailTask(logger, taskState, httpClient)
+				err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(fakeCC.ReceivedRequests()).To(HaveLen(1))
@@ -67,7 +76,7 @@ var _ = Describe("TaskClient", func() {
 			})
 
 			It("returns an error", func() {
-				err := taskClient.FailTask(logger, taskState, httpClient)
+				err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
 				Expect(err).To(HaveOccurred())
 			})
 		})
@@ -78,9 +87,326 @@ var _ = Describe("TaskClient", func() {
 			})
 
 			It("returns an error", func() {
-				err := taskClient.FailTask(logger, taskState, httpClient)
+				err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
 				Expect(err).To(HaveOccurred())
 			})
 		})
+
+		Context("when CC fails transiently", func() {
+			BeforeEach(func() {
+				taskClient = &bulk.CCTaskClient{
+					MaxAttempts:   3,
+					RetryInterval: 10 * time.Millisecond,
+				}
+			})
+
+			Context("and then succeeds", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.RespondWith(503, ""),
+						ghttp.RespondWith(200, "{}"),
+					)
+				})
+
+				It("retries the callback", func() {
+					err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(2))
+				})
+			})
+
+			Context("on every attempt", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.RespondWith(500, ""),
+						ghttp.RespondWith(502, ""),
+						ghttp.RespondWith(503, ""),
+					)
+				})
+
+				It("gives up after the maximum number of attempts", func() {
+					err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+					Expect(err).To(HaveOccurred())
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(3))
+				})
+			})
+
+			Context("and the callback is cancelled while waiting to retry", func() {
+				var fakeClock *fakeclock.FakeClock
+
+				BeforeEach(func() {
+					fakeClock = fakeclock.NewFakeClock(time.Now())
+					taskClient.Clock = fakeClock
+					taskClient.RetryInterval = time.Minute
+
+					fakeCC.AppendHandlers(ghttp.RespondWith(503, ""))
+				})
+
+				It("stops waiting and gives up", func() {
+					errc := make(chan error, 1)
+					go func() {
+						errc <- taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+					}()
+
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					close(cancel)
+
+					Eventually(errc).Should(Receive(HaveOccurred()))
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(1))
+				})
+			})
+		})
+
+		Context("when a failure store is configured", func() {
+			var failureStore *fakes.FakeTaskFailureStore
+
+			var fakeClock *fakeclock.FakeClock
+
+			BeforeEach(func() {
+				fakeClock = fakeclock.NewFakeClock(time.Unix(1234, 0))
+				failureStore = new(fakes.FakeTaskFailureStore)
+				taskClient = &bulk.CCTaskClient{FailureStore: failureStore, Clock: fakeClock}
+			})
+
+			Context("and the task has not been failed before", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(ghttp.RespondWith(200, "{}"))
+				})
+
+				It("records the failure and the rule that fired", func() {
+					err := taskClient.FailTask(logger, cancel, taskState, bulk.PendingTaskExpired, httpClient)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(failureStore.RecordCallCount()).To(Equal(1))
+					record := failureStore.RecordArgsForCall(0)
+					Expect(record.TaskGuid).To(Equal(taskGuid))
+					Expect(record.Reason).To(Equal(bulk.PendingTaskExpired))
+					Expect(record.FailureReason).To(Equal(bulk.PendingTaskExpired.Message()))
+					Expect(record.Attempts).To(Equal(1))
+					Expect(record.FailedAt).To(Equal(fakeClock.Now()))
+				})
+			})
+
+			Context("and the task has already been failed", func() {
+				BeforeEach(func() {
+					failureStore.LookupReturns(bulk.TaskFailureRecord{TaskGuid: taskGuid}, true, nil)
+				})
+
+				It("does not fail it again", func() {
+					err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCC.ReceivedRequests()).To(BeEmpty())
+					Expect(failureStore.RecordCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("and CC rejects the callback", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(ghttp.RespondWith(400, "{}"))
+				})
+
+				It("does not record a failure", func() {
+					err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+					Expect(err).To(HaveOccurred())
+					Expect(failureStore.RecordCallCount()).To(Equal(0))
+				})
+			})
+		})
+
+		Context("when an authenticator is configured", func() {
+			var fakeAuthenticator *fakeAuthenticator
+
+			BeforeEach(func() {
+				fakeAuthenticator = &fakeAuthenticator{token: "first-token"}
+				taskClient = &bulk.CCTaskClient{Authenticator: fakeAuthenticator}
+			})
+
+			Context("and CC accepts the credentials", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("POST", fmt.Sprintf("/internal/v3/tasks/%s/completed", taskGuid)),
+							ghttp.VerifyHeaderKV("Authorization", "bearer first-token"),
+							ghttp.RespondWith(200, "{}"),
+						),
+					)
+				})
+
+				It("authenticates the callback with the authenticator", func() {
+					err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+
+			Context("and CC rejects the credentials once", func() {
+				BeforeEach(func() {
+					fakeCC.AppendHandlers(
+						ghttp.RespondWith(401, ""),
+						ghttp.CombineHandlers(
+							ghttp.VerifyHeaderKV("Authorization", "bearer second-token"),
+							ghttp.RespondWith(200, "{}"),
+						),
+					)
+				})
+
+				It("invalidates the credentials and retries", func() {
+					err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeAuthenticator.invalidations).To(Equal(1))
+					Expect(fakeCC.ReceivedRequests()).To(HaveLen(2))
+				})
+			})
+		})
+
+		Context("when a signing key is configured", func() {
+			BeforeEach(func() {
+				taskClient = &bulk.CCTaskClient{SigningKey: []byte("the-key")}
+
+				fakeCC.AppendHandlers(
+					func(w http.ResponseWriter, req *http.Request) {
+						defer GinkgoRecover()
+
+						payload, err := ioutil.ReadAll(req.Body)
+						Expect(err).NotTo(HaveOccurred())
+
+						unix, err := strconv.ParseInt(req.Header.Get(bulk.CallbackTimestampHeader), 10, 64)
+						Expect(err).NotTo(HaveOccurred())
+
+						expected := bulk.SignCallback([]byte("the-key"), time.Unix(unix, 0), payload)
+						Expect(req.Header.Get(bulk.CallbackSignatureHeader)).To(Equal(expected))
+					},
+				)
+			})
+
+			It("signs the callback payload", func() {
+				err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeCC.ReceivedRequests()).To(HaveLen(1))
+			})
+		})
+
+		Context("when the callback url is not in the allowlist", func() {
+			var failureStore bulk.TaskFailureStore
+
+			BeforeEach(func() {
+				allowlist, err := helpers.NewCallbackAllowlist([]string{"https://cc.internal"})
+				Expect(err).NotTo(HaveOccurred())
+
+				failureStore = bulk.NewInMemoryTaskFailureStore()
+				taskClient = &bulk.CCTaskClient{CallbackAllowlist: allowlist, FailureStore: failureStore}
+			})
+
+			It("records the task instead of sending the callback", func() {
+				err := taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeCC.ReceivedRequests()).To(BeEmpty())
+
+				record, found, err := failureStore.Lookup(taskGuid)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue())
+				Expect(record.Reason).To(Equal(bulk.CallbackURLNotAllowed))
+			})
+
+			It("only logs the rejection once", func() {
+				Expect(taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)).To(Succeed())
+				Expect(taskClient.FailTask(logger, cancel, taskState, bulk.TaskMissingFromBBS, httpClient)).To(Succeed())
+
+				Expect(logger.LogMessages()).To(HaveLen(2))
+				Expect(logger.LogMessages()[1]).To(ContainSubstring("task-already-failed"))
+			})
+		})
+	})
+
+	Describe("CompleteTask", func() {
+		var task *models.Task
+
+		BeforeEach(func() {
+			task = &models.Task{
+				TaskGuid: taskGuid,
+				TaskDefinition: &models.TaskDefinition{
+					Annotation: "some-annotation",
+				},
+				State:         models.Task_Completed,
+				Failed:        true,
+				FailureReason: "exit status 1",
+				CreatedAt:     1234,
+			}
+		})
+
+		Context("CC responds successfully", func() {
+			BeforeEach(func() {
+				fakeCC.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("POST", fmt.Sprintf("/internal/v3/tasks/%s/completed", taskGuid)),
+						ghttp.VerifyBasicAuth("utako", "luan"),
+						ghttp.VerifyJSON(`{
+							"task_guid": "`+taskGuid+`",
+							"failed": true,
+							"failure_reason": "exit status 1",
+							"result": "",
+							"annotation": "some-annotation",
+							"created_at": 1234
+						}`),
+						ghttp.RespondWith(200, "{}"),
+					),
+				)
+			})
+
+			It("sends the task's result to CC", func() {
+				err := taskClient.CompleteTask(logger, cancel, taskState, task, httpClient)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeCC.ReceivedRequests()).To(HaveLen(1))
+			})
+		})
+
+		Context("CC responds with an error", func() {
+			BeforeEach(func() {
+				fakeCC.AppendHandlers(ghttp.RespondWith(500, "{}"))
+			})
+
+			It("returns an error", func() {
+				err := taskClient.CompleteTask(logger, cancel, taskState, task, httpClient)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the callback url is not in the allowlist", func() {
+			var failureStore bulk.TaskFailureStore
+
+			BeforeEach(func() {
+				allowlist, err := helpers.NewCallbackAllowlist([]string{"https://cc.internal"})
+				Expect(err).NotTo(HaveOccurred())
+
+				failureStore = bulk.NewInMemoryTaskFailureStore()
+				taskClient = &bulk.CCTaskClient{CallbackAllowlist: allowlist, FailureStore: failureStore}
+			})
+
+			It("records the task and does not send the callback", func() {
+				err := taskClient.CompleteTask(logger, cancel, taskState, task, httpClient)
+				Expect(err).To(MatchError(helpers.ErrCallbackURLNotAllowed))
+				Expect(fakeCC.ReceivedRequests()).To(BeEmpty())
+
+				record, found, err := failureStore.Lookup(taskGuid)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue())
+				Expect(record.Reason).To(Equal(bulk.CallbackURLNotAllowed))
+			})
+		})
 	})
 })
+
+type fakeAuthenticator struct {
+	token         string
+	invalidations int
+}
+
+func (a *fakeAuthenticator) Authenticate(logger lager.Logger, httpClient *http.Client, req *http.Request) error {
+	req.Header.Set("Authorization", "bearer "+a.token)
+	return nil
+}
+
+func (a *fakeAuthenticator) Invalidate() {
+	a.invalidations++
+	a.token = "second-token"
+}
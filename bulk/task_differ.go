@@ -10,31 +10,50 @@ type TaskDiffer interface {
 	Diff(lager.Logger, <-chan []cc_messages.CCTaskState, <-chan struct{})
 	TasksToFail() <-chan []cc_messages.CCTaskState
 	TasksToCancel() <-chan []string
+	TasksToResubmit() <-chan []cc_messages.CCTaskState
+	TasksToComplete() <-chan []CompletedTask
+}
+
+// CompletedTask is a task that has completed in BBS while CC still considers
+// it running, typically because its completion callback was lost.
+type CompletedTask struct {
+	TaskState cc_messages.CCTaskState
+	Task      *models.Task
 }
 
 type taskDiffer struct {
-	bbsTasks      map[string]*models.Task
-	tasksToFail   chan []cc_messages.CCTaskState
-	tasksToCancel chan []string
+	bbsTasks        map[string]*models.Task
+	shard           Shard
+	tasksToFail     chan []cc_messages.CCTaskState
+	tasksToCancel   chan []string
+	tasksToResubmit chan []cc_messages.CCTaskState
+	tasksToComplete chan []CompletedTask
 }
 
-func NewTaskDiffer(bbsTasks map[string]*models.Task) TaskDiffer {
+// NewTaskDiffer returns a differ that only considers tasks whose guid is in
+// the shard.
+func NewTaskDiffer(bbsTasks map[string]*models.Task, shard Shard) TaskDiffer {
 	return &taskDiffer{
-		bbsTasks:      bbsTasks,
-		tasksToFail:   make(chan []cc_messages.CCTaskState, 1),
-		tasksToCancel: make(chan []string, 1),
+		bbsTasks:        bbsTasks,
+		shard:           shard,
+		tasksToFail:     make(chan []cc_messages.CCTaskState, 1),
+		tasksToCancel:   make(chan []string, 1),
+		tasksToResubmit: make(chan []cc_messages.CCTaskState, 1),
+		tasksToComplete: make(chan []CompletedTask, 1),
 	}
 }
 
 func (t *taskDiffer) Diff(logger lager.Logger, ccTasks <-chan []cc_messages.CCTaskState, cancelCh <-chan struct{}) {
 	logger = logger.Session("task_diff")
 
-	tasksToCancel := cloneBbsTasks(t.bbsTasks)
+	tasksToCancel := cloneBbsTasks(t.bbsTasks, t.shard)
 
 	go func() {
 		defer func() {
 			close(t.tasksToFail)
 			close(t.tasksToCancel)
+			close(t.tasksToResubmit)
+			close(t.tasksToComplete)
 		}()
 
 		for {
@@ -46,21 +65,38 @@ func (t *taskDiffer) Diff(logger lager.Logger, ccTasks <-chan []cc_messages.CCTa
 				if !open {
 					guids := filterTasksToCancel(logger, tasksToCancel)
 					if len(guids) > 0 {
-						t.tasksToCancel <- guids
+						select {
+						case t.tasksToCancel <- guids:
+						case <-cancelCh:
+						}
 					}
 
 					return
 				}
 
 				batchTasksToFail := []cc_messages.CCTaskState{}
+				batchTasksToResubmit := []cc_messages.CCTaskState{}
+				batchTasksToComplete := []CompletedTask{}
 				for _, ccTask := range batchCCTasks {
+					if !t.shard.Owns(ccTask.TaskGuid) {
+						continue
+					}
 
-					_, exists := t.bbsTasks[ccTask.TaskGuid]
+					bbsTask, exists := t.bbsTasks[ccTask.TaskGuid]
 
 					if exists {
 						if ccTask.State != cc_messages.TaskStateCanceling {
 							delete(tasksToCancel, ccTask.TaskGuid)
 						}
+
+						if bbsTask.State == models.Task_Completed &&
+							(ccTask.State == cc_messages.TaskStateRunning || ccTask.State == cc_messages.TaskStateCanceling) {
+							batchTasksToComplete = append(batchTasksToComplete, CompletedTask{TaskState: ccTask, Task: bbsTask})
+
+							logger.Info("found-task-to-complete", lager.Data{
+								"guid": ccTask.TaskGuid,
+							})
+						}
 					} else {
 						if ccTask.State == cc_messages.TaskStateRunning || ccTask.State == cc_messages.TaskStateCanceling {
 							batchTasksToFail = append(batchTasksToFail, ccTask)
@@ -68,12 +104,38 @@ func (t *taskDiffer) Diff(logger lager.Logger, ccTasks <-chan []cc_messages.CCTa
 							logger.Info("found-task-to-fail", lager.Data{
 								"guid": ccTask.TaskGuid,
 							})
+						} else if ccTask.State == cc_messages.TaskStatePending {
+							batchTasksToResubmit = append(batchTasksToResubmit, ccTask)
+
+							logger.Info("found-task-to-resubmit", lager.Data{
+								"guid": ccTask.TaskGuid,
+							})
 						}
 					}
 				}
 
 				if len(batchTasksToFail) > 0 {
-					t.tasksToFail <- batchTasksToFail
+					select {
+					case t.tasksToFail <- batchTasksToFail:
+					case <-cancelCh:
+						return
+					}
+				}
+
+				if len(batchTasksToResubmit) > 0 {
+					select {
+					case t.tasksToResubmit <- batchTasksToResubmit:
+					case <-cancelCh:
+						return
+					}
+				}
+
+				if len(batchTasksToComplete) > 0 {
+					select {
+					case t.tasksToComplete <- batchTasksToComplete:
+					case <-cancelCh:
+						return
+					}
 				}
 			}
 		}
@@ -88,10 +150,20 @@ func (t *taskDiffer) TasksToCancel() <-chan []string {
 	return t.tasksToCancel
 }
 
-func cloneBbsTasks(bbsTasks map[string]*models.Task) map[string]*models.Task {
+func (t *taskDiffer) TasksToResubmit() <-chan []cc_messages.CCTaskState {
+	return t.tasksToResubmit
+}
+
+func (t *taskDiffer) TasksToComplete() <-chan []CompletedTask {
+	return t.tasksToComplete
+}
+
+func cloneBbsTasks(bbsTasks map[string]*models.Task, shard Shard) map[string]*models.Task {
 	clone := map[string]*models.Task{}
 	for k, v := range bbsTasks {
-		clone[k] = v
+		if shard.Owns(k) {
+			clone[k] = v
+		}
 	}
 	return clone
 }
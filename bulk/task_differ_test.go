@@ -18,6 +18,7 @@ var _ = Describe("TaskDiffer", func() {
 		cancelCh chan struct{}
 		logger   *lagertest.TestLogger
 		differ   bulk.TaskDiffer
+		shard    bulk.Shard
 	)
 
 	BeforeEach(func() {
@@ -25,15 +26,47 @@ var _ = Describe("TaskDiffer", func() {
 		cancelCh = make(chan struct{})
 		ccTasks = make(chan []cc_messages.CCTaskState, 1)
 		bbsTasks = map[string]*models.Task{}
+		shard = bulk.Shard{}
 	})
 
 	JustBeforeEach(func() {
-		differ = bulk.NewTaskDiffer(bbsTasks)
+		differ = bulk.NewTaskDiffer(bbsTasks, shard)
 	})
 
 	AfterEach(func() {
 		Eventually(differ.TasksToFail()).Should(BeClosed())
 		Eventually(differ.TasksToCancel()).Should(BeClosed())
+		Eventually(differ.TasksToResubmit()).Should(BeClosed())
+		Eventually(differ.TasksToComplete()).Should(BeClosed())
+	})
+
+	Context("when sharded", func() {
+		var ownedTask, otherTask cc_messages.CCTaskState
+
+		BeforeEach(func() {
+			shard = bulk.Shard{Index: 0, Count: 3}
+
+			ownedTask = cc_messages.CCTaskState{TaskGuid: guidInShard("task-guid", shard, true), State: cc_messages.TaskStateRunning}
+			otherTask = cc_messages.CCTaskState{TaskGuid: guidInShard("task-guid", shard, false), State: cc_messages.TaskStateRunning}
+
+			otherBBSTask := guidInShard("bbs-task-guid", shard, false)
+			bbsTasks[otherBBSTask] = &models.Task{TaskGuid: otherBBSTask, State: models.Task_Running}
+
+			ccTasks <- []cc_messages.CCTaskState{ownedTask, otherTask}
+			close(ccTasks)
+		})
+
+		It("only fails tasks in the shard", func() {
+			differ.Diff(logger, ccTasks, cancelCh)
+
+			Eventually(differ.TasksToFail()).Should(Receive(ConsistOf(ownedTask)))
+		})
+
+		It("does not cancel tasks outside the shard", func() {
+			differ.Diff(logger, ccTasks, cancelCh)
+
+			Consistently(differ.TasksToCancel()).ShouldNot(Receive())
+		})
 	})
 
 	Context("tasks found in cc but not diego", func() {
@@ -65,6 +98,14 @@ var _ = Describe("TaskDiffer", func() {
 
 				Consistently(differ.TasksToFail()).Should(Not(Receive()))
 			})
+
+			It("includes it in TasksToResubmit", func() {
+				differ.Diff(logger, ccTasks, cancelCh)
+
+				Eventually(differ.TasksToResubmit()).Should(Receive(ConsistOf(
+					cc_messages.CCTaskState{TaskGuid: "task-guid-1", State: cc_messages.TaskStatePending},
+				)))
+			})
 		})
 
 		Context("when bbs does not know about a completed task", func() {
@@ -246,6 +287,44 @@ var _ = Describe("TaskDiffer", func() {
 		})
 	})
 
+	Context("tasks completed in diego but still running in cc", func() {
+		var completedTask *models.Task
+
+		BeforeEach(func() {
+			completedTask = &models.Task{TaskGuid: "task-guid-1", State: models.Task_Completed, Result: "some-result"}
+			bbsTasks = map[string]*models.Task{"task-guid-1": completedTask}
+		})
+
+		Context("when cc thinks the task is running", func() {
+			BeforeEach(func() {
+				ccTasks <- []cc_messages.CCTaskState{{TaskGuid: "task-guid-1", State: cc_messages.TaskStateRunning, CompletionCallbackUrl: "asdf"}}
+				close(ccTasks)
+			})
+
+			It("is included in TasksToComplete", func() {
+				differ.Diff(logger, ccTasks, cancelCh)
+
+				Eventually(differ.TasksToComplete()).Should(Receive(ConsistOf(bulk.CompletedTask{
+					TaskState: cc_messages.CCTaskState{TaskGuid: "task-guid-1", State: cc_messages.TaskStateRunning, CompletionCallbackUrl: "asdf"},
+					Task:      completedTask,
+				})))
+			})
+		})
+
+		Context("when cc already knows the task has finished", func() {
+			BeforeEach(func() {
+				ccTasks <- []cc_messages.CCTaskState{{TaskGuid: "task-guid-1", State: cc_messages.TaskStateSucceeded}}
+				close(ccTasks)
+			})
+
+			It("is not included in TasksToComplete", func() {
+				differ.Diff(logger, ccTasks, cancelCh)
+
+				Consistently(differ.TasksToComplete()).Should(Not(Receive()))
+			})
+		})
+	})
+
 	Context("canceling", func() {
 		Context("when it is receiving tasks", func() {
 			BeforeEach(func() {
@@ -0,0 +1,306 @@
+package bulk
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+)
+
+// TaskFailureReason identifies the reconciliation rule that led nsync to fail
+// a task.
+type TaskFailureReason string
+
+const (
+	// TaskMissingFromBBS fires when CC considers a task running or canceling
+	// but BBS has no record of it.
+	TaskMissingFromBBS TaskFailureReason = "task-missing-from-bbs"
+
+	// PendingTaskExpired fires when a pending task could not be resubmitted
+	// to BBS within the pending task max age.
+	PendingTaskExpired TaskFailureReason = "pending-task-expired"
+
+	// CallbackURLNotAllowed fires when a task's completion callback URL is
+	// not on the callback allowlist, so nsync can neither resubmit the task
+	// nor report it to CC.
+	CallbackURLNotAllowed TaskFailureReason = "callback-url-not-allowed"
+)
+
+// Message is the failure reason reported to CC, and so to the task's owner.
+func (r TaskFailureReason) Message() string {
+	switch r {
+	case TaskMissingFromBBS:
+		return "Unable to determine completion status: task not found in Diego (" + string(r) + ")"
+	case PendingTaskExpired:
+		return "Unable to start task: task never reached Diego (" + string(r) + ")"
+	case CallbackURLNotAllowed:
+		return "Unable to report task status: completion callback url is not allowed (" + string(r) + ")"
+	default:
+		return "Unable to determine completion status (" + string(r) + ")"
+	}
+}
+
+// TaskFailureRecord is the audit record of a task nsync failed, or could not
+// report to CC.
+type TaskFailureRecord struct {
+	TaskGuid      string            `json:"task_guid"`
+	Reason        TaskFailureReason `json:"reason"`
+	FailureReason string            `json:"failure_reason"`
+	FailedAt      time.Time         `json:"failed_at"`
+	Attempts      int               `json:"attempts"`
+}
+
+//go:generate counterfeiter -o fakes/fake_task_failure_store.go . TaskFailureStore
+
+type TaskFailureStore interface {
+	Record(record TaskFailureRecord) error
+	Lookup(taskGuid string) (TaskFailureRecord, bool, error)
+}
+
+type inMemoryTaskFailureStore struct {
+	lock    sync.RWMutex
+	records map[string]TaskFailureRecord
+}
+
+func NewInMemoryTaskFailureStore() TaskFailureStore {
+	return &inMemoryTaskFailureStore{
+		records: map[string]TaskFailureRecord{},
+	}
+}
+
+func (s *inMemoryTaskFailureStore) Record(record TaskFailureRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.records[record.TaskGuid] = record
+	return nil
+}
+
+func (s *inMemoryTaskFailureStore) Lookup(taskGuid string) (TaskFailureRecord, bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	record, found := s.records[taskGuid]
+	return record, found, nil
+}
+
+// prune drops the records of tasks failed before the given time.
+func (s *inMemoryTaskFailureStore) prune(before time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for taskGuid, record := range s.records {
+		if record.FailedAt.Before(before) {
+			delete(s.records, taskGuid)
+		}
+	}
+}
+
+func (s *inMemoryTaskFailureStore) snapshot() []TaskFailureRecord {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	records := make([]TaskFailureRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+
+	sort.Sort(byFailedAt(records))
+	return records
+}
+
+type byFailedAt []TaskFailureRecord
+
+func (r byFailedAt) Len() int           { return len(r) }
+func (r byFailedAt) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFailedAt) Less(i, j int) bool { return r[i].FailedAt.Before(r[j].FailedAt) }
+
+// minCompactLines is the size below which the failure log is not compacted.
+const minCompactLines = 1000
+
+// fileTaskFailureStore appends each record to a file as a line of JSON, so
+// that the history survives restarts and can be read by operators directly.
+//
+// Records older than the retention are forgotten, and the file is rewritten
+// with only the remaining records once it holds twice as many lines as when
+// it was last compacted, so it stays proportional to the records retained.
+type fileTaskFailureStore struct {
+	*inMemoryTaskFailureStore
+
+	path      string
+	retention time.Duration
+	clock     clock.Clock
+
+	fileLock       sync.Mutex
+	file           *os.File
+	lines          int
+	compactedLines int
+}
+
+// NewFileTaskFailureStore opens the failure log at path. A retention of 0
+// keeps records forever.
+func NewFileTaskFailureStore(path string, retention time.Duration, clock clock.Clock) (TaskFailureStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &fileTaskFailureStore{
+		inMemoryTaskFailureStore: &inMemoryTaskFailureStore{
+			records: map[string]TaskFailureRecord{},
+		},
+		path:      path,
+		retention: retention,
+		clock:     clock,
+		file:      file,
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		store.lines++
+
+		record := TaskFailureRecord{}
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			// skip a line truncated by a crash mid-write
+			continue
+		}
+		store.records[record.TaskGuid] = record
+	}
+
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	err = terminateLastLine(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	store.pruneExpired()
+	if store.lines > len(store.records) {
+		err = store.compact()
+		if err != nil {
+			store.file.Close()
+			return nil, err
+		}
+	}
+	store.compactedLines = len(store.records)
+
+	return store, nil
+}
+
+func (s *fileTaskFailureStore) Record(record TaskFailureRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	s.lines++
+
+	err = s.inMemoryTaskFailureStore.Record(record)
+	if err != nil {
+		return err
+	}
+
+	if s.lines < minCompactLines || s.lines < 2*s.compactedLines {
+		return nil
+	}
+
+	s.pruneExpired()
+	err = s.compact()
+	if err != nil {
+		return err
+	}
+	s.compactedLines = s.lines
+
+	return nil
+}
+
+func (s *fileTaskFailureStore) pruneExpired() {
+	if s.retention > 0 {
+		s.prune(s.clock.Now().Add(-s.retention))
+	}
+}
+
+// compact replaces the file with one holding only the retained records,
+// oldest first, and reopens it for appending.
+func (s *fileTaskFailureStore) compact() error {
+	records := s.snapshot()
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	writer := bufio.NewWriter(tmpFile)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			tmpFile.Close()
+			return err
+		}
+
+		writer.Write(append(line, '\n'))
+	}
+
+	err = writer.Flush()
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), s.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.lines = len(records)
+
+	return nil
+}
+
+// terminateLastLine ensures new records start on their own line, even after
+// a crash left a partial one at the end of the file.
+func terminateLastLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	lastByte := make([]byte, 1)
+	_, err = file.ReadAt(lastByte, info.Size()-1)
+	if err != nil {
+		return err
+	}
+
+	if lastByte[0] != '\n' {
+		_, err = file.Write([]byte{'\n'})
+	}
+
+	return err
+}
@@ -0,0 +1,156 @@
+package bulk_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/clock/fakeclock"
+)
+
+var _ = Describe("TaskFailureStore", func() {
+	var record bulk.TaskFailureRecord
+
+	BeforeEach(func() {
+		record = bulk.TaskFailureRecord{
+			TaskGuid:      "task-guid-1",
+			Reason:        bulk.TaskMissingFromBBS,
+			FailureReason: bulk.TaskMissingFromBBS.Message(),
+			FailedAt:      time.Unix(1234, 0).UTC(),
+			Attempts:      2,
+		}
+	})
+
+	Describe("the in-memory store", func() {
+		It("looks up recorded failures", func() {
+			store := bulk.NewInMemoryTaskFailureStore()
+
+			_, found, err := store.Lookup("task-guid-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeFalse())
+
+			Expect(store.Record(record)).To(Succeed())
+
+			foundRecord, found, err := store.Lookup("task-guid-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(foundRecord).To(Equal(record))
+		})
+	})
+
+	Describe("the file store", func() {
+		var (
+			tmpDir    string
+			path      string
+			fakeClock *fakeclock.FakeClock
+		)
+
+		BeforeEach(func() {
+			fakeClock = fakeclock.NewFakeClock(time.Unix(1234, 0))
+
+			var err error
+			tmpDir, err = ioutil.TempDir("", "task-failures")
+			Expect(err).NotTo(HaveOccurred())
+
+			path = filepath.Join(tmpDir, "failures.log")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("persists records across restarts", func() {
+			store, err := bulk.NewFileTaskFailureStore(path, 0, fakeClock)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.Record(record)).To(Succeed())
+
+			reopened, err := bulk.NewFileTaskFailureStore(path, 0, fakeClock)
+			Expect(err).NotTo(HaveOccurred())
+
+			foundRecord, found, err := reopened.Lookup("task-guid-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(foundRecord).To(Equal(record))
+		})
+
+		It("writes one JSON record per line", func() {
+			store, err := bulk.NewFileTaskFailureStore(path, 0, fakeClock)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.Record(record)).To(Succeed())
+
+			contents, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(`{"task_guid":"task-guid-1","reason":"task-missing-from-bbs","failure_reason":"Unable to determine completion status: task not found in Diego (task-missing-from-bbs)","failed_at":"1970-01-01T00:20:34Z","attempts":2}` + "\n"))
+		})
+
+		It("skips lines that cannot be parsed", func() {
+			err := ioutil.WriteFile(path, []byte(`{"task_guid":"task-guid-2"}`+"\n"+`{"task_gu`), 0600)
+			Expect(err).NotTo(HaveOccurred())
+
+			store, err := bulk.NewFileTaskFailureStore(path, 0, fakeClock)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, found, err := store.Lookup("task-guid-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+		})
+
+		Context("with a retention", func() {
+			var retention time.Duration
+
+			BeforeEach(func() {
+				retention = time.Hour
+			})
+
+			It("forgets records older than the retention when reopened", func() {
+				store, err := bulk.NewFileTaskFailureStore(path, retention, fakeClock)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(store.Record(record)).To(Succeed())
+
+				fakeClock.Increment(retention + time.Second)
+
+				reopened, err := bulk.NewFileTaskFailureStore(path, retention, fakeClock)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, found, err := reopened.Lookup("task-guid-1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeFalse())
+
+				contents, err := ioutil.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(BeEmpty())
+			})
+
+			It("keeps the file bounded by compacting it", func() {
+				store, err := bulk.NewFileTaskFailureStore(path, retention, fakeClock)
+				Expect(err).NotTo(HaveOccurred())
+
+				for i := 0; i < 6000; i++ {
+					record.TaskGuid = fmt.Sprintf("task-guid-%d", i)
+					record.FailedAt = fakeClock.Now()
+					Expect(store.Record(record)).To(Succeed())
+
+					fakeClock.Increment(time.Second)
+				}
+
+				contents, err := ioutil.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(strings.Count(string(contents), "\n")).To(BeNumerically("<=", 2*int(retention/time.Second)))
+
+				_, found, err := store.Lookup("task-guid-0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeFalse())
+
+				_, found, err = store.Lookup("task-guid-5999")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue())
+			})
+		})
+	})
+})
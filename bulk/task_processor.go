@@ -1,12 +1,16 @@
 package bulk
 
 import (
+	"crypto/tls"
+	"errors"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/cloudfoundry-incubator/bbs"
 	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/cloudfoundry/gunk/workpool"
 	"github.com/pivotal-golang/clock"
@@ -17,37 +21,70 @@ type TaskProcessor struct {
 	bbsClient          bbs.Client
 	taskClient         TaskClient
 	pollingInterval    time.Duration
+	domain             string
 	domainTTL          time.Duration
 	failTaskPoolSize   int
 	cancelTaskPoolSize int
 	httpClient         *http.Client
 	logger             lager.Logger
 	fetcher            Fetcher
+	builders           map[string]recipebuilder.RecipeBuilder
+	callbackAllowlist  *helpers.CallbackAllowlist
+	pendingTaskMaxAge  time.Duration
+	shard              Shard
+	writeLimiter       *WriteLimiter
+	ownership          *LockOwnership
 	clock              clock.Clock
+
+	// missingSince records the start of the first sync in which each pending
+	// task was missing from BBS. A task is only resubmitted once it has been
+	// missing on two consecutive syncs, and is failed once it has been missing
+	// for longer than pendingTaskMaxAge.
+	missingSince map[string]time.Time
+
+	*syncControl
 }
 
+var errNoBuilder = errors.New("no-builder")
+
 func NewTaskProcessor(
 	logger lager.Logger,
 	bbsClient bbs.Client,
 	taskClient TaskClient,
 	pollingInterval time.Duration,
+	domain string,
 	domainTTL time.Duration,
 	failTaskPoolSize int,
 	cancelTaskPoolSize int,
-	skipCertVerify bool,
+	tlsConfig *tls.Config,
 	fetcher Fetcher,
+	builders map[string]recipebuilder.RecipeBuilder,
+	callbackAllowlist *helpers.CallbackAllowlist,
+	pendingTaskMaxAge time.Duration,
+	shard Shard,
+	writeLimiter *WriteLimiter,
+	ownership *LockOwnership,
 	clock clock.Clock) *TaskProcessor {
 	return &TaskProcessor{
 		bbsClient:          bbsClient,
 		taskClient:         taskClient,
 		pollingInterval:    pollingInterval,
+		domain:             domain,
 		domainTTL:          domainTTL,
 		failTaskPoolSize:   failTaskPoolSize,
 		cancelTaskPoolSize: cancelTaskPoolSize,
-		httpClient:         initializeHttpClient(skipCertVerify),
+		httpClient:         initializeHttpClient(tlsConfig),
 		logger:             logger,
 		fetcher:            fetcher,
+		builders:           builders,
+		callbackAllowlist:  callbackAllowlist,
+		pendingTaskMaxAge:  pendingTaskMaxAge,
+		shard:              shard,
+		writeLimiter:       writeLimiter,
+		ownership:          ownership,
 		clock:              clock,
+		missingSince:       map[string]time.Time{},
+		syncControl:        newSyncControl(),
 	}
 }
 
@@ -65,23 +102,38 @@ func (t *TaskProcessor) Run(signals <-chan os.Signal, ready chan<- struct{}) err
 		select {
 		case <-signals:
 			return nil
+		case <-t.ownership.Lost():
+			t.logger.Info("lock-lost")
+			return nil
 		case <-timer.C():
 			stop = t.sync(signals)
 			timer.Reset(t.pollingInterval)
+		case <-t.triggered():
+			t.logger.Info("sync-triggered")
+			stop = t.sync(signals)
+			timer.Reset(t.pollingInterval)
 		}
 	}
 }
 
 func (t *TaskProcessor) sync(signals <-chan os.Signal) bool {
+	if t.Paused() {
+		t.logger.Info("sync-tasks-paused")
+		return false
+	}
+
 	logger := t.logger.Session("sync")
 	logger.Info("starting")
 
+	syncStart := t.clock.Now()
+
 	existingTasks, err := t.existingTasksMap()
 	if err != nil {
 		return false
 	}
 
 	cancelCh := make(chan struct{})
+	guard := newWriteGuard(cancelCh, t.ownership.Lost(), t.Paused, t.writeLimiter)
 
 	taskStateCh, taskStateErrorCh := t.fetcher.FetchTaskStates(
 		logger,
@@ -89,11 +141,17 @@ func (t *TaskProcessor) sync(signals <-chan os.Signal) bool {
 		t.httpClient,
 	)
 
-	taskDiffer := NewTaskDiffer(existingTasks)
+	taskDiffer := NewTaskDiffer(existingTasks, t.shard)
 	taskDiffer.Diff(logger, taskStateCh, cancelCh)
 
-	failTaskErrorCh := t.failTasks(logger, taskDiffer.TasksToFail())
-	cancelTaskErrorCh := t.cancelTasks(logger, taskDiffer.TasksToCancel())
+	failTaskErrorCh := t.failTasks(logger, cancelCh, guard, TaskMissingFromBBS, taskDiffer.TasksToFail())
+	cancelTaskErrorCh := t.cancelTasks(logger, guard, taskDiffer.TasksToCancel())
+
+	resubmitCh, expiredCh := t.expirePendingTasks(logger, cancelCh, syncStart, taskDiffer.TasksToResubmit())
+	taskRequestCh, taskRequestErrorCh := t.fetcher.FetchTasks(logger, cancelCh, t.httpClient, resubmitCh)
+	resubmitTaskErrorCh := t.resubmitTasks(logger, cancelCh, guard, taskRequestCh)
+	expiredTaskErrorCh := t.failTasks(logger, cancelCh, guard, PendingTaskExpired, expiredCh)
+	completeTaskErrorCh := t.completeTasks(logger, cancelCh, guard, taskDiffer.TasksToComplete())
 
 	taskStateErrorCh, taskStateErrorCount := countErrors(taskStateErrorCh)
 
@@ -101,6 +159,10 @@ func (t *TaskProcessor) sync(signals <-chan os.Signal) bool {
 		taskStateErrorCh,
 		failTaskErrorCh,
 		cancelTaskErrorCh,
+		taskRequestErrorCh,
+		resubmitTaskErrorCh,
+		expiredTaskErrorCh,
+		completeTaskErrorCh,
 	)
 
 	bumpFreshness := true
@@ -120,6 +182,10 @@ process_loop:
 			logger.Info("exiting", lager.Data{"received-signal": sig})
 			close(cancelCh)
 			return true
+		case <-t.ownership.Lost():
+			logger.Info("lock-lost-cancelling-sync")
+			abandonSync(logger, cancelCh, guard, t.domain, errors, signals)
+			return true
 		}
 	}
 	logger.Info("done-processing-updates-and-creates")
@@ -128,9 +194,26 @@ process_loop:
 		logger.Error("failed-to-fetch-all-cc-task-states", nil)
 	}
 
+	select {
+	case <-t.ownership.Lost():
+		logger.Info("lock-lost-cancelling-sync")
+		abandonSync(logger, cancelCh, guard, t.domain, nil, signals)
+		return true
+	default:
+	}
+
+	if t.Paused() {
+		logger.Info("paused-not-bumping-freshness")
+		bumpFreshness = false
+	}
+
 	if bumpFreshness {
-		t.bbsClient.UpsertDomain(logger, cc_messages.RunningTaskDomain, t.domainTTL)
 		logger.Info("bumpin-freshness")
+
+		err = markDomainFresh(logger, t.bbsClient, t.shard, t.domain, t.domainTTL)
+		if err != nil {
+			logger.Error("failed-to-upsert-domain", err)
+		}
 	}
 
 	return false
@@ -138,7 +221,7 @@ process_loop:
 
 func (t *TaskProcessor) existingTasksMap() (map[string]*models.Task, error) {
 	logger := t.logger.Session("exiting-task-map")
-	existingTasks, err := t.bbsClient.TasksByDomain(logger, cc_messages.RunningTaskDomain)
+	existingTasks, err := t.bbsClient.TasksByDomain(logger, t.domain)
 	if err != nil {
 		return nil, err
 	}
@@ -154,6 +237,9 @@ func (t *TaskProcessor) existingTasksMap() (map[string]*models.Task, error) {
 
 func (t *TaskProcessor) failTasks(
 	logger lager.Logger,
+	cancel <-chan struct{},
+	guard *writeGuard,
+	reason TaskFailureReason,
 	tasksCh <-chan []cc_messages.CCTaskState,
 ) <-chan error {
 
@@ -181,7 +267,14 @@ func (t *TaskProcessor) failTasks(
 				taskState := taskState
 
 				works[i] = func() {
-					err := t.taskClient.FailTask(logger, &taskState, t.httpClient)
+					if !guard.proceed() {
+						return
+					}
+
+					err := t.taskClient.FailTask(logger, cancel, &taskState, reason, t.httpClient)
+					if err == errCallbackCancelled {
+						return
+					}
 					if err != nil {
 						logger.Error("failed-failing-mismatched-task", err)
 						errc <- err
@@ -205,7 +298,7 @@ func (t *TaskProcessor) failTasks(
 	return errc
 }
 
-func (t *TaskProcessor) cancelTasks(logger lager.Logger, tasksCh <-chan []string) <-chan error {
+func (t *TaskProcessor) cancelTasks(logger lager.Logger, guard *writeGuard, tasksCh <-chan []string) <-chan error {
 	logger = logger.Session("cancel-mismatched-tasks")
 	errc := make(chan error, 1)
 
@@ -230,7 +323,12 @@ func (t *TaskProcessor) cancelTasks(logger lager.Logger, tasksCh <-chan []string
 				taskGuid := taskGuid
 
 				works[i] = func() {
-					err := t.bbsClient.CancelTask(logger, taskGuid)
+					err := guard.write(func() error {
+						return t.bbsClient.CancelTask(logger, taskGuid)
+					})
+					if err == errWriteAbandoned {
+						return
+					}
 					if err != nil {
 						logger.Error("failed-canceling-mismatched-task", err)
 						errc <- err
@@ -253,3 +351,320 @@ func (t *TaskProcessor) cancelTasks(logger lager.Logger, tasksCh <-chan []string
 	}()
 	return errc
 }
+
+// completeTasks redelivers the results of tasks that completed in BBS but are
+// still running in CC, then resolves them so BBS stops tracking them. BBS may
+// resolve or delete a task itself in the meantime, which is not an error.
+func (t *TaskProcessor) completeTasks(
+	logger lager.Logger,
+	cancel <-chan struct{},
+	guard *writeGuard,
+	tasksCh <-chan []CompletedTask,
+) <-chan error {
+	logger = logger.Session("complete-mismatched-tasks")
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+
+		for {
+			var tasksToComplete []CompletedTask
+
+			select {
+			case <-cancel:
+				return
+
+			case selected, open := <-tasksCh:
+				if !open {
+					return
+				}
+
+				tasksToComplete = selected
+			}
+
+			works := make([]func(), len(tasksToComplete))
+
+			for i, completedTask := range tasksToComplete {
+				completedTask := completedTask
+				taskGuid := completedTask.TaskState.TaskGuid
+
+				works[i] = func() {
+					if !guard.proceed() {
+						return
+					}
+
+					err := t.taskClient.CompleteTask(logger, cancel, &completedTask.TaskState, completedTask.Task, t.httpClient)
+					if err == errCallbackCancelled {
+						return
+					}
+					if err == helpers.ErrCallbackURLNotAllowed {
+						// the result stays in BBS, since CC cannot be told
+						logger.Debug("skipping-task-with-disallowed-callback", lager.Data{"task_guid": taskGuid})
+						return
+					}
+					if err != nil {
+						logger.Error("failed-completing-mismatched-task", err, lager.Data{"task_guid": taskGuid})
+						errc <- err
+						return
+					}
+
+					err = guard.write(func() error {
+						return t.bbsClient.ResolvingTask(logger, taskGuid)
+					})
+					if err == errWriteAbandoned {
+						return
+					}
+					if taskAlreadyResolved(err) {
+						logger.Debug("task-already-resolved", lager.Data{"task_guid": taskGuid})
+						return
+					}
+					if err != nil {
+						logger.Error("failed-resolving-task", err, lager.Data{"task_guid": taskGuid})
+						errc <- err
+						return
+					}
+
+					err = guard.write(func() error {
+						return t.bbsClient.DeleteTask(logger, taskGuid)
+					})
+					if err == errWriteAbandoned {
+						return
+					}
+					if taskAlreadyResolved(err) {
+						logger.Debug("task-already-deleted", lager.Data{"task_guid": taskGuid})
+						return
+					}
+					if err != nil {
+						logger.Error("failed-deleting-task", err, lager.Data{"task_guid": taskGuid})
+						errc <- err
+						return
+					}
+
+					logger.Debug("succeeded-completing-mismatched-task", lager.Data{"task_guid": taskGuid})
+				}
+			}
+
+			throttler, err := workpool.NewThrottler(t.failTaskPoolSize, works)
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			logger.Info("processing-batch", lager.Data{"size": len(tasksToComplete)})
+			throttler.Work()
+			logger.Info("done-processing-batch", lager.Data{"size": len(tasksToComplete)})
+		}
+	}()
+	return errc
+}
+
+// rejectTask records a pending task whose callback URL is not allowed with
+// the task client, which neither resubmits nor reports it, so it is not a
+// sync error.
+func (t *TaskProcessor) rejectTask(logger lager.Logger, cancel <-chan struct{}, task cc_messages.TaskRequestFromCC) {
+	taskState := cc_messages.CCTaskState{
+		TaskGuid:              task.TaskGuid,
+		State:                 cc_messages.TaskStatePending,
+		CompletionCallbackUrl: task.CompletionCallbackUrl,
+	}
+
+	err := t.taskClient.FailTask(logger, cancel, &taskState, CallbackURLNotAllowed, t.httpClient)
+	if err != nil && err != errCallbackCancelled {
+		logger.Error("failed-rejecting-task", err, lager.Data{"task_guid": task.TaskGuid})
+	}
+}
+
+// taskAlreadyResolved reports whether resolving or deleting a task failed
+// because BBS has already resolved or deleted it.
+func taskAlreadyResolved(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch models.ConvertError(err).Type {
+	case models.Error_ResourceNotFound, models.Error_InvalidStateTransition:
+		return true
+	default:
+		return false
+	}
+}
+
+// expirePendingTasks splits pending tasks missing from BBS into those to
+// resubmit and those that have been missing for longer than
+// pendingTaskMaxAge, which are failed instead.
+//
+// The BBS snapshot is taken before CC's task states are fetched, so a task
+// desired by the listener in between looks missing. Such tasks are held back
+// until they are still missing on the next sync; resubmitting them straight
+// away would race the listener's own DesireTask. CC's task states carry no
+// creation time, so a task's age is measured from the start of the first sync
+// that found it missing, which CC created it before.
+func (t *TaskProcessor) expirePendingTasks(
+	logger lager.Logger,
+	cancel <-chan struct{},
+	now time.Time,
+	pendingCh <-chan []cc_messages.CCTaskState,
+) (<-chan []cc_messages.CCTaskState, <-chan []cc_messages.CCTaskState) {
+	logger = logger.Session("expire-pending-tasks")
+	resubmit := make(chan []cc_messages.CCTaskState, 1)
+	expired := make(chan []cc_messages.CCTaskState, 1)
+
+	go func() {
+		defer close(resubmit)
+		defer close(expired)
+
+		missingSince := map[string]time.Time{}
+		defer func() {
+			t.missingSince = missingSince
+		}()
+
+		for {
+			var pendingTasks []cc_messages.CCTaskState
+
+			select {
+			case <-cancel:
+				return
+
+			case selected, open := <-pendingCh:
+				if !open {
+					return
+				}
+
+				pendingTasks = selected
+			}
+
+			tasksToResubmit := []cc_messages.CCTaskState{}
+			tasksToExpire := []cc_messages.CCTaskState{}
+
+			for _, taskState := range pendingTasks {
+				since, seen := t.missingSince[taskState.TaskGuid]
+				if !seen {
+					since = now
+				}
+				missingSince[taskState.TaskGuid] = since
+
+				switch {
+				case !seen:
+					logger.Info("pending-task-missing", lager.Data{"task_guid": taskState.TaskGuid})
+				case t.pendingTaskMaxAge > 0 && now.Sub(since) >= t.pendingTaskMaxAge:
+					logger.Info("pending-task-expired", lager.Data{
+						"task_guid":     taskState.TaskGuid,
+						"missing-since": since,
+					})
+					tasksToExpire = append(tasksToExpire, taskState)
+				default:
+					tasksToResubmit = append(tasksToResubmit, taskState)
+				}
+			}
+
+			if len(tasksToExpire) > 0 {
+				select {
+				case expired <- tasksToExpire:
+				case <-cancel:
+					return
+				}
+			}
+
+			if len(tasksToResubmit) > 0 {
+				select {
+				case resubmit <- tasksToResubmit:
+				case <-cancel:
+					return
+				}
+			}
+		}
+	}()
+
+	return resubmit, expired
+}
+
+func (t *TaskProcessor) resubmitTasks(
+	logger lager.Logger,
+	cancel <-chan struct{},
+	guard *writeGuard,
+	tasksCh <-chan []cc_messages.TaskRequestFromCC,
+) <-chan error {
+	logger = logger.Session("resubmit-pending-tasks")
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+
+		for {
+			var tasksToResubmit []cc_messages.TaskRequestFromCC
+
+			select {
+			case <-cancel:
+				return
+
+			case selected, open := <-tasksCh:
+				if !open {
+					return
+				}
+
+				tasksToResubmit = selected
+			}
+
+			works := make([]func(), len(tasksToResubmit))
+
+			for i, task := range tasksToResubmit {
+				task := task
+
+				works[i] = func() {
+					err := t.callbackAllowlist.Validate(task.CompletionCallbackUrl)
+					if err != nil {
+						logger.Error("callback-url-not-allowed", err, lager.Data{"task_guid": task.TaskGuid})
+						t.rejectTask(logger, cancel, task)
+						return
+					}
+
+					builder, ok := t.builders[task.Lifecycle]
+					if !ok {
+						logger.Error("builder-not-found", errNoBuilder, lager.Data{"task_guid": task.TaskGuid, "lifecycle": task.Lifecycle})
+						errc <- errNoBuilder
+						return
+					}
+
+					taskDefinition, err := builder.BuildTask(&task)
+					if err != nil {
+						logger.Error("failed-building-task", err, lager.Data{"task_guid": task.TaskGuid})
+						errc <- err
+						return
+					}
+
+					err = guard.write(func() error {
+						return t.bbsClient.DesireTask(logger, task.TaskGuid, t.domain, taskDefinition)
+					})
+					if err == errWriteAbandoned {
+						return
+					}
+					if err != nil {
+						if models.ConvertError(err).Type == models.Error_ResourceExists {
+							logger.Debug("task-already-desired", lager.Data{"task_guid": task.TaskGuid})
+							return
+						}
+
+						logger.Error("failed-resubmitting-task", err, lager.Data{"task_guid": task.TaskGuid})
+						errc <- err
+						return
+					}
+
+					logger.Info("resubmitted-task", lager.Data{"task_guid": task.TaskGuid})
+				}
+			}
+
+			// resubmissions share the fail pool; both repair tasks CC knows
+			// about but BBS does not
+			throttler, err := workpool.NewThrottler(t.failTaskPoolSize, works)
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			logger.Info("processing-batch", lager.Data{"size": len(tasksToResubmit)})
+			throttler.Work()
+			logger.Info("done-processing-batch", lager.Data{"size": len(tasksToResubmit)})
+		}
+	}()
+	return errc
+}
@@ -1,6 +1,7 @@
 package bulk_test
 
 import (
+	"crypto/tls"
 	"errors"
 	"net/http"
 	"sync"
@@ -10,9 +11,12 @@ import (
 	"github.com/cloudfoundry-incubator/bbs/models"
 	"github.com/cloudfoundry-incubator/nsync/bulk"
 	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/pivotal-golang/clock/fakeclock"
 	"github.com/pivotal-golang/lager"
 	"github.com/pivotal-golang/lager/lagertest"
@@ -34,6 +38,12 @@ var _ = Describe("Task Processor", func() {
 		pollingInterval time.Duration
 		clock           *fakeclock.FakeClock
 
+		tasksToFetch           []cc_messages.TaskRequestFromCC
+		buildpackRecipeBuilder *fakes.FakeRecipeBuilder
+		pendingTaskMaxAge      time.Duration
+		callbackAllowlist      *helpers.CallbackAllowlist
+		ownership              *bulk.LockOwnership
+
 		logger *lagertest.TestLogger
 	)
 
@@ -54,6 +64,33 @@ var _ = Describe("Task Processor", func() {
 			return results, errors
 		}
 
+		tasksToFetch = nil
+		fetcher.FetchTasksStub = func(
+			logger lager.Logger,
+			cancel <-chan struct{},
+			httpClient *http.Client,
+			taskStates <-chan []cc_messages.CCTaskState,
+		) (<-chan []cc_messages.TaskRequestFromCC, <-chan error) {
+			results := make(chan []cc_messages.TaskRequestFromCC, 1)
+			errors := make(chan error, 1)
+
+			go func() {
+				defer close(results)
+				defer close(errors)
+
+				for range taskStates {
+					results <- tasksToFetch
+				}
+			}()
+
+			return results, errors
+		}
+
+		buildpackRecipeBuilder = new(fakes.FakeRecipeBuilder)
+		buildpackRecipeBuilder.BuildTaskStub = func(task *cc_messages.TaskRequestFromCC) (*models.TaskDefinition, error) {
+			return &models.TaskDefinition{RootFs: "some-rootfs"}, nil
+		}
+
 		bbsClient = new(fake_bbs.FakeClient)
 		taskClient = new(fakes.FakeTaskClient)
 		clock = fakeclock.NewFakeClock(time.Now())
@@ -65,16 +102,28 @@ var _ = Describe("Task Processor", func() {
 		}
 
 		pollingInterval = 500 * time.Millisecond
+		callbackAllowlist = &helpers.CallbackAllowlist{}
+		ownership = bulk.NewLockOwnership()
+		pendingTaskMaxAge = time.Minute
 		processor = bulk.NewTaskProcessor(
 			logger,
 			bbsClient,
 			taskClient,
 			pollingInterval,
+			cc_messages.RunningTaskDomain,
 			time.Second,
 			50,
 			50,
-			false,
+			&tls.Config{},
 			fetcher,
+			map[string]recipebuilder.RecipeBuilder{
+				"buildpack": buildpackRecipeBuilder,
+			},
+			callbackAllowlist,
+			pendingTaskMaxAge,
+			bulk.Shard{},
+			nil,
+			ownership,
 			clock,
 		)
 	})
@@ -96,9 +145,10 @@ var _ = Describe("Task Processor", func() {
 
 		It("fails the task", func() {
 			Eventually(taskClient.FailTaskCallCount).Should(Equal(1))
-			_, taskState, _ := taskClient.FailTaskArgsForCall(0)
+			_, _, taskState, reason, _ := taskClient.FailTaskArgsForCall(0)
 			Expect(taskState.TaskGuid).Should(Equal("task-guid-1"))
 			Expect(taskState.CompletionCallbackUrl).Should(Equal("asdf"))
+			Expect(reason).To(Equal(bulk.TaskMissingFromBBS))
 		})
 
 		It("updates the domain", func() {
@@ -126,6 +176,241 @@ var _ = Describe("Task Processor", func() {
 		It("does not fail the task", func() {
 			Consistently(taskClient.FailTaskCallCount).Should(Equal(0))
 		})
+
+		Context("and CC returns its definition", func() {
+			BeforeEach(func() {
+				tasksToFetch = []cc_messages.TaskRequestFromCC{
+					{TaskGuid: "task-guid-1", Lifecycle: "buildpack"},
+				}
+			})
+
+			It("does not resubmit the task on the sync that first finds it missing", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+				Expect(bbsClient.DesireTaskCallCount()).To(Equal(0))
+			})
+
+			Context("and it is still missing on the next sync", func() {
+				JustBeforeEach(func() {
+					Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+					clock.Increment(pollingInterval)
+				})
+
+				It("fetches the task from CC", func() {
+					Eventually(fetcher.FetchTasksCallCount).Should(Equal(2))
+				})
+
+				It("rebuilds and desires the task", func() {
+					Eventually(bbsClient.DesireTaskCallCount).Should(Equal(1))
+
+					Expect(buildpackRecipeBuilder.BuildTaskArgsForCall(0)).To(Equal(&tasksToFetch[0]))
+
+					_, taskGuid, domain, taskDefinition := bbsClient.DesireTaskArgsForCall(0)
+					Expect(taskGuid).To(Equal("task-guid-1"))
+					Expect(domain).To(Equal(cc_messages.RunningTaskDomain))
+					Expect(taskDefinition).To(Equal(&models.TaskDefinition{RootFs: "some-rootfs"}))
+				})
+
+				It("updates the domain", func() {
+					Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+				})
+
+				Context("and the task was desired in the meantime", func() {
+					BeforeEach(func() {
+						bbsClient.DesireTaskReturns(models.ErrResourceExists)
+					})
+
+					It("still updates the domain", func() {
+						Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+					})
+				})
+
+				Context("and desiring the task fails", func() {
+					BeforeEach(func() {
+						bbsClient.DesireTaskReturns(errors.New("nope"))
+					})
+
+					It("does not update the domain", func() {
+						Eventually(bbsClient.DesireTaskCallCount).Should(Equal(1))
+						Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+					})
+				})
+
+				Context("and the task's callback url is not allowed", func() {
+					BeforeEach(func() {
+						allowlist, err := helpers.NewCallbackAllowlist([]string{"https://cc.internal"})
+						Expect(err).NotTo(HaveOccurred())
+						*callbackAllowlist = *allowlist
+
+						tasksToFetch[0].CompletionCallbackUrl = "http://elsewhere.example.com/completed"
+					})
+
+					It("does not resubmit the task", func() {
+						Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+						Expect(buildpackRecipeBuilder.BuildTaskCallCount()).To(Equal(0))
+						Expect(bbsClient.DesireTaskCallCount()).To(Equal(0))
+					})
+
+					It("hands the task to the task client as not allowed", func() {
+						Eventually(taskClient.FailTaskCallCount).Should(Equal(1))
+						_, _, taskState, reason, _ := taskClient.FailTaskArgsForCall(0)
+						Expect(taskState.TaskGuid).To(Equal("task-guid-1"))
+						Expect(taskState.CompletionCallbackUrl).To(Equal("http://elsewhere.example.com/completed"))
+						Expect(reason).To(Equal(bulk.CallbackURLNotAllowed))
+					})
+				})
+
+				Context("and the task has no recipe builder for its lifecycle", func() {
+					BeforeEach(func() {
+						tasksToFetch[0].Lifecycle = "unknown"
+					})
+
+					It("does not desire the task", func() {
+						Eventually(fetcher.FetchTasksCallCount).Should(Equal(2))
+						Consistently(bbsClient.DesireTaskCallCount).Should(Equal(0))
+						Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+					})
+				})
+			})
+
+			Context("and it reaches bbs before the next sync", func() {
+				It("never resubmits the task", func() {
+					Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+
+					bbsClient.TasksByDomainReturns([]*models.Task{{TaskGuid: "task-guid-1", State: models.Task_Pending}}, nil)
+					clock.Increment(pollingInterval)
+					Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+
+					bbsClient.TasksByDomainReturns(nil, nil)
+					clock.Increment(pollingInterval)
+					Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(3))
+
+					Expect(bbsClient.DesireTaskCallCount()).To(Equal(0))
+				})
+			})
+		})
+
+		Context("and it stays missing for longer than the max age", func() {
+			BeforeEach(func() {
+				taskStatesToFetch[0].CompletionCallbackUrl = "asdf"
+				tasksToFetch = []cc_messages.TaskRequestFromCC{
+					{TaskGuid: "task-guid-1", Lifecycle: "buildpack"},
+				}
+			})
+
+			It("fails the task instead of resubmitting it", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+
+				clock.Increment(pollingInterval)
+				Eventually(bbsClient.DesireTaskCallCount).Should(Equal(1))
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+
+				clock.Increment(pendingTaskMaxAge - pollingInterval)
+				Eventually(taskClient.FailTaskCallCount).Should(Equal(1))
+				_, _, taskState, reason, _ := taskClient.FailTaskArgsForCall(0)
+				Expect(taskState.TaskGuid).To(Equal("task-guid-1"))
+				Expect(reason).To(Equal(bulk.PendingTaskExpired))
+
+				Consistently(bbsClient.DesireTaskCallCount).Should(Equal(1))
+			})
+		})
+	})
+
+	Context("when a task completed in bbs but cc still thinks it is running", func() {
+		var completedTask *models.Task
+
+		BeforeEach(func() {
+			taskStatesToFetch = []cc_messages.CCTaskState{
+				{TaskGuid: "task-guid-1", State: cc_messages.TaskStateRunning, CompletionCallbackUrl: "asdf"},
+			}
+
+			completedTask = &models.Task{TaskGuid: "task-guid-1", State: models.Task_Completed, Result: "some-result"}
+			bbsClient.TasksByDomainReturns([]*models.Task{completedTask}, nil)
+		})
+
+		It("reports the completion to cc", func() {
+			Eventually(taskClient.CompleteTaskCallCount).Should(Equal(1))
+			_, _, taskState, task, _ := taskClient.CompleteTaskArgsForCall(0)
+			Expect(taskState.CompletionCallbackUrl).To(Equal("asdf"))
+			Expect(task).To(Equal(completedTask))
+		})
+
+		It("resolves and deletes the task in bbs", func() {
+			Eventually(bbsClient.DeleteTaskCallCount).Should(Equal(1))
+
+			_, resolvingGuid := bbsClient.ResolvingTaskArgsForCall(0)
+			Expect(resolvingGuid).To(Equal("task-guid-1"))
+			_, deletedGuid := bbsClient.DeleteTaskArgsForCall(0)
+			Expect(deletedGuid).To(Equal("task-guid-1"))
+		})
+
+		It("does not fail the task", func() {
+			Consistently(taskClient.FailTaskCallCount).Should(Equal(0))
+		})
+
+		Context("and reporting the completion fails", func() {
+			BeforeEach(func() {
+				taskClient.CompleteTaskReturns(errors.New("nope"))
+			})
+
+			It("leaves the task in bbs and does not update the domain", func() {
+				Consistently(bbsClient.ResolvingTaskCallCount).Should(Equal(0))
+				Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(0))
+			})
+		})
+
+		Context("and the task's callback url is not allowed", func() {
+			BeforeEach(func() {
+				taskClient.CompleteTaskReturns(helpers.ErrCallbackURLNotAllowed)
+			})
+
+			It("leaves the task in bbs but still updates the domain", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+				Expect(bbsClient.ResolvingTaskCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("and bbs has already deleted the task", func() {
+			BeforeEach(func() {
+				bbsClient.ResolvingTaskReturns(models.ErrResourceNotFound)
+			})
+
+			It("treats the task as completed and updates the domain", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+				Expect(bbsClient.DeleteTaskCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("and bbs is already resolving the task", func() {
+			BeforeEach(func() {
+				bbsClient.ResolvingTaskReturns(&models.Error{Type: models.Error_InvalidStateTransition})
+			})
+
+			It("treats the task as completed and updates the domain", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+				Expect(bbsClient.DeleteTaskCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("and bbs deletes the task before nsync does", func() {
+			BeforeEach(func() {
+				bbsClient.DeleteTaskReturns(models.ErrResourceNotFound)
+			})
+
+			It("updates the domain", func() {
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+			})
+		})
+
+		Context("and resolving the task fails", func() {
+			BeforeEach(func() {
+				bbsClient.ResolvingTaskReturns(errors.New("nope"))
+			})
+
+			It("does not update the domain", func() {
+				Eventually(bbsClient.ResolvingTaskCallCount).Should(Equal(1))
+				Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(0))
+			})
+		})
 	})
 
 	Context("when bbs does not know about a completed task", func() {
@@ -149,9 +434,10 @@ var _ = Describe("Task Processor", func() {
 
 		It("fails the task", func() {
 			Eventually(taskClient.FailTaskCallCount).Should(Equal(1))
-			_, taskState, _ := taskClient.FailTaskArgsForCall(0)
+			_, _, taskState, reason, _ := taskClient.FailTaskArgsForCall(0)
 			Expect(taskState.TaskGuid).Should(Equal("task-guid-1"))
 			Expect(taskState.CompletionCallbackUrl).Should(Equal("asdf"))
+			Expect(reason).To(Equal(bulk.TaskMissingFromBBS))
 		})
 
 		It("updates the domain", func() {
@@ -303,4 +589,88 @@ var _ = Describe("Task Processor", func() {
 			Consistently(taskClient.FailTaskCallCount).Should(Equal(0))
 		})
 	})
+
+	Context("when the lock is lost during a sync", func() {
+		BeforeEach(func() {
+			taskStatesToFetch = []cc_messages.CCTaskState{
+				{TaskGuid: "task-guid-1", State: cc_messages.TaskStateRunning, CompletionCallbackUrl: "asdf"},
+			}
+			bbsClient.TasksByDomainStub = func(lager.Logger, string) ([]*models.Task, error) {
+				ownership.Lose()
+				return nil, nil
+			}
+		})
+
+		It("abandons the sync's writes and does not bump freshness", func() {
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+
+			Expect(taskClient.FailTaskCallCount()).To(Equal(0))
+			Expect(bbsClient.UpsertDomainCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when syncing is paused during a sync", func() {
+		BeforeEach(func() {
+			taskStatesToFetch = []cc_messages.CCTaskState{
+				{TaskGuid: "task-guid-1", State: cc_messages.TaskStateRunning, CompletionCallbackUrl: "asdf"},
+			}
+			bbsClient.TasksByDomainStub = func(lager.Logger, string) ([]*models.Task, error) {
+				processor.(bulk.SyncController).Pause()
+				return nil, nil
+			}
+		})
+
+		It("makes no further writes and does not bump freshness", func() {
+			Eventually(fetcher.FetchTaskStatesCallCount).Should(Equal(1))
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("paused-not-bumping-freshness"))
+
+			Expect(taskClient.FailTaskCallCount()).To(Equal(0))
+			Expect(bbsClient.UpsertDomainCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when bumping the domain fails", func() {
+		BeforeEach(func() {
+			bbsClient.UpsertDomainReturns(errors.New("boom"))
+		})
+
+		It("logs the failure", func() {
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+			Eventually(logger.TestSink.Buffer).Should(gbytes.Say("failed-to-upsert-domain"))
+		})
+	})
+
+	Context("when a sync is triggered", func() {
+		It("syncs immediately without waiting for the polling interval", func() {
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+
+			processor.(bulk.SyncController).Trigger()
+
+			Eventually(bbsClient.TasksByDomainCallCount).Should(Equal(2))
+			Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(2))
+		})
+	})
+
+	Context("when syncing is paused", func() {
+		BeforeEach(func() {
+			processor.(bulk.SyncController).Pause()
+		})
+
+		It("does not sync or bump freshness", func() {
+			clock.Increment(pollingInterval + time.Millisecond)
+			processor.(bulk.SyncController).Trigger()
+
+			Consistently(bbsClient.TasksByDomainCallCount).Should(Equal(0))
+			Consistently(bbsClient.UpsertDomainCallCount).Should(Equal(0))
+		})
+
+		Context("and then resumed", func() {
+			It("syncs again on the next trigger", func() {
+				processor.(bulk.SyncController).Resume()
+				processor.(bulk.SyncController).Trigger()
+
+				Eventually(bbsClient.UpsertDomainCallCount).Should(Equal(1))
+			})
+		})
+	})
 })
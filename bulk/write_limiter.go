@@ -0,0 +1,186 @@
+package bulk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/runtime-schema/metric"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+)
+
+const bbsWriteRate = metric.Metric("NsyncBBSWriteRate")
+
+const (
+	// the rate never drops below this fraction of the configured rate
+	minWriteRateFraction = 20.0
+	// each healthy write recovers this fraction of the configured rate
+	writeRateRecoveryFraction = 50.0
+)
+
+// WriteLimiter is a token bucket shared by every processor's BBS writes. It
+// halves its rate whenever a write fails or is slow, and creeps back up to
+// the configured rate as writes succeed quickly again. A nil WriteLimiter
+// does not limit.
+type WriteLimiter struct {
+	logger      lager.Logger
+	maxRate     float64
+	minRate     float64
+	slowLatency time.Duration
+	clock       clock.Clock
+
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewWriteLimiter returns nil, which does not limit, when writesPerSecond is
+// not positive. A slowLatency of 0 slows down on errors only.
+func NewWriteLimiter(logger lager.Logger, writesPerSecond float64, slowLatency time.Duration, clock clock.Clock) *WriteLimiter {
+	if writesPerSecond <= 0 {
+		return nil
+	}
+
+	return &WriteLimiter{
+		logger:      logger.Session("write-limiter"),
+		maxRate:     writesPerSecond,
+		minRate:     writesPerSecond / minWriteRateFraction,
+		slowLatency: slowLatency,
+		clock:       clock,
+		rate:        writesPerSecond,
+		tokens:      1,
+		last:        clock.Now(),
+	}
+}
+
+// Rate returns the current writes per second.
+func (l *WriteLimiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.rate
+}
+
+// Wait blocks until a write may be made, returning false if cancel or lost
+// fire first.
+func (l *WriteLimiter) Wait(cancel, lost <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	for {
+		delay := l.take()
+		if delay == 0 {
+			return true
+		}
+
+		timer := l.clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-cancel:
+			timer.Stop()
+			return false
+		case <-lost:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// take consumes a token, or returns how long until one is available.
+func (l *WriteLimiter) take() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+
+	// allow bursts of up to a second's worth of writes
+	burst := l.rate
+	if burst < 1 {
+		burst = 1
+	}
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Do makes the write, adjusting the rate by how it went.
+func (l *WriteLimiter) Do(write func() error) error {
+	if l == nil {
+		return write()
+	}
+
+	start := l.clock.Now()
+	err := write()
+	latency := l.clock.Now().Sub(start)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	previous := l.rate
+	if overloaded(err) || (l.slowLatency > 0 && latency > l.slowLatency) {
+		l.rate /= 2
+		if l.rate < l.minRate {
+			l.rate = l.minRate
+		}
+	} else {
+		l.rate += l.maxRate / writeRateRecoveryFraction
+		if l.rate > l.maxRate {
+			l.rate = l.maxRate
+		}
+	}
+
+	if l.rate != previous {
+		if l.rate < previous {
+			l.logger.Info("reducing-write-rate", lager.Data{"rate": l.rate, "latency": latency.String(), "error": errString(err)})
+		}
+
+		sendErr := bbsWriteRate.Send(int(l.rate))
+		if sendErr != nil {
+			l.logger.Error("failed-to-send-bbs-write-rate-metric", sendErr)
+		}
+	}
+
+	return err
+}
+
+// overloaded reports whether a write error suggests BBS is struggling, as
+// opposed to rejecting that particular request.
+func overloaded(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch models.ConvertError(err).Type {
+	case models.Error_InvalidRequest,
+		models.Error_ResourceExists,
+		models.Error_ResourceNotFound,
+		models.Error_ResourceConflict:
+		return false
+	}
+
+	return true
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
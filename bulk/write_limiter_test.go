@@ -0,0 +1,112 @@
+package bulk_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+var _ = Describe("WriteLimiter", func() {
+	var (
+		clock   *fakeclock.FakeClock
+		limiter *bulk.WriteLimiter
+	)
+
+	BeforeEach(func() {
+		clock = fakeclock.NewFakeClock(time.Now())
+		limiter = bulk.NewWriteLimiter(lagertest.NewTestLogger("test"), 100, time.Second, clock)
+	})
+
+	It("starts at the configured rate", func() {
+		Expect(limiter.Rate()).To(Equal(100.0))
+	})
+
+	Context("when a write fails", func() {
+		It("halves the rate", func() {
+			err := limiter.Do(func() error { return errors.New("boom") })
+			Expect(err).To(MatchError("boom"))
+			Expect(limiter.Rate()).To(Equal(50.0))
+		})
+
+		It("never drops below a twentieth of the configured rate", func() {
+			for i := 0; i < 10; i++ {
+				limiter.Do(func() error { return errors.New("boom") })
+			}
+			Expect(limiter.Rate()).To(Equal(5.0))
+		})
+	})
+
+	Context("when BBS rejects the request itself", func() {
+		It("keeps the rate", func() {
+			limiter.Do(func() error { return models.ErrResourceExists })
+			Expect(limiter.Rate()).To(Equal(100.0))
+		})
+	})
+
+	Context("when a write is slow", func() {
+		It("halves the rate", func() {
+			limiter.Do(func() error {
+				clock.Increment(2 * time.Second)
+				return nil
+			})
+			Expect(limiter.Rate()).To(Equal(50.0))
+		})
+	})
+
+	Context("when writes succeed quickly after a slowdown", func() {
+		It("recovers towards the configured rate", func() {
+			limiter.Do(func() error { return errors.New("boom") })
+
+			limiter.Do(func() error { return nil })
+			Expect(limiter.Rate()).To(Equal(52.0))
+
+			for i := 0; i < 100; i++ {
+				limiter.Do(func() error { return nil })
+			}
+			Expect(limiter.Rate()).To(Equal(100.0))
+		})
+	})
+
+	Describe("Wait", func() {
+		BeforeEach(func() {
+			limiter = bulk.NewWriteLimiter(lagertest.NewTestLogger("test"), 1, 0, clock)
+		})
+
+		It("waits for a token once the burst is used", func() {
+			Expect(limiter.Wait(nil, nil)).To(BeTrue())
+
+			waited := make(chan bool)
+			go func() {
+				waited <- limiter.Wait(nil, nil)
+			}()
+
+			Consistently(waited).ShouldNot(Receive())
+			Eventually(clock.WatcherCount).Should(Equal(1))
+
+			clock.Increment(time.Second)
+			Eventually(waited).Should(Receive(BeTrue()))
+		})
+
+		It("gives up when cancelled", func() {
+			Expect(limiter.Wait(nil, nil)).To(BeTrue())
+
+			cancel := make(chan struct{})
+			close(cancel)
+			Expect(limiter.Wait(cancel, nil)).To(BeFalse())
+		})
+	})
+
+	Context("when no rate is configured", func() {
+		It("does not limit", func() {
+			limiter = bulk.NewWriteLimiter(lagertest.NewTestLogger("test"), 0, 0, clock)
+			Expect(limiter).To(BeNil())
+			Expect(limiter.Wait(nil, nil)).To(BeTrue())
+		})
+	})
+})
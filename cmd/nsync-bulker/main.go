@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/cloudfoundry-incubator/bbs"
@@ -14,17 +19,24 @@ import (
 	"github.com/cloudfoundry-incubator/consuladapter"
 	"github.com/cloudfoundry-incubator/diego-ssh/keys"
 	"github.com/cloudfoundry-incubator/locket"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages/flags"
 	"github.com/cloudfoundry/dropsonde"
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/nu7hatch/gouuid"
 	"github.com/pivotal-golang/clock"
 	"github.com/pivotal-golang/lager"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
+	"github.com/tedsuo/ifrit/http_server"
 	"github.com/tedsuo/ifrit/sigmon"
 
 	"github.com/cloudfoundry-incubator/nsync"
 	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/cloudfoundry-incubator/nsync/config"
+	"github.com/cloudfoundry-incubator/nsync/handlers"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
+	"github.com/cloudfoundry-incubator/nsync/lock"
 	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 )
 
@@ -58,6 +70,42 @@ var lockRetryInterval = flag.Duration(
 	"interval to wait before retrying a failed lock acquisition",
 )
 
+var lockBackend = flag.String(
+	"lockBackend",
+	"consul",
+	"where the bulker lock is held: consul, file (flock on a local file, for single-host deployments) or sql (a lease in a SQL table)",
+)
+
+var lockFile = flag.String(
+	"lockFile",
+	"",
+	"path to the lock file when lockBackend is file",
+)
+
+var lockSQLDriver = flag.String(
+	"lockSQLDriver",
+	"mysql",
+	"database/sql driver used when lockBackend is sql; only mysql is supported",
+)
+
+var lockSQLDataSource = flag.String(
+	"lockSQLDataSource",
+	"",
+	"data source name of the database holding the lock lease table when lockBackend is sql",
+)
+
+var shardCount = flag.Int(
+	"shardCount",
+	1,
+	"number of shards the process and task guids are split into, each synced by its own bulker",
+)
+
+var shardIndex = flag.Int(
+	"shardIndex",
+	0,
+	"the shard this bulker syncs, from 0 to shardCount-1; bulkers for the same shard share a lock",
+)
+
 var dropsondePort = flag.Int(
 	"dropsondePort",
 	3457,
@@ -70,6 +118,12 @@ var ccBaseURL = flag.String(
 	"base URL of the cloud controller",
 )
 
+var ccSources = flag.String(
+	"ccSources",
+	"",
+	"path to a JSON file listing several cloud controllers to sync, each with its own credentials, TLS settings, batch size and BBS domains, instead of ccBaseURL and the cc credential and TLS flags; sync metrics of sources with their own domains are named with the domain appended",
+)
+
 var ccUsername = flag.String(
 	"ccUsername",
 	"",
@@ -82,6 +136,78 @@ var ccPassword = flag.String(
 	"basic auth password for CC bulk API",
 )
 
+var ccAuthMethod = flag.String(
+	"ccAuthMethod",
+	"basic",
+	"how to authenticate to the CC bulk API: basic, oauth (client credentials), or none (client certificate only)",
+)
+
+var ccOAuthTokenURL = flag.String(
+	"ccOAuthTokenURL",
+	"",
+	"URL of the OAuth token endpoint (e.g. https://uaa.example.com/oauth/token) when ccAuthMethod is oauth",
+)
+
+var ccOAuthClientID = flag.String(
+	"ccOAuthClientID",
+	"",
+	"OAuth client ID used to obtain tokens for the CC bulk API",
+)
+
+var ccOAuthClientSecret = flag.String(
+	"ccOAuthClientSecret",
+	"",
+	"OAuth client secret used to obtain tokens for the CC bulk API",
+)
+
+var ccCACert = flag.String(
+	"ccCACert",
+	"",
+	"path to certificate authority cert used to verify CC; ignored with ccSources, which configure TLS per source",
+)
+
+var ccClientCert = flag.String(
+	"ccClientCert",
+	"",
+	"path to client cert presented to CC for mutually authenticated TLS; ignored with ccSources, which configure TLS per source",
+)
+
+var ccClientKey = flag.String(
+	"ccClientKey",
+	"",
+	"path to client key presented to CC for mutually authenticated TLS; ignored with ccSources, which configure TLS per source",
+)
+
+var ccFetchAttempts = flag.Int(
+	"ccFetchAttempts",
+	3,
+	"number of times a request to the CC bulk API or a task callback is tried before giving up on transient failures",
+)
+
+var ccRetryInterval = flag.Duration(
+	"ccRetryInterval",
+	time.Second,
+	"initial delay before retrying a failed CC bulk API request; doubled on each attempt",
+)
+
+var ccMaxRetryInterval = flag.Duration(
+	"ccMaxRetryInterval",
+	10*time.Second,
+	"maximum delay between retries of a failed CC bulk API request",
+)
+
+var ccPrefetchDepth = flag.Int(
+	"ccPrefetchDepth",
+	1,
+	"number of fingerprint and task state pages to fetch from CC ahead of processing",
+)
+
+var ccFetchConcurrency = flag.Int(
+	"ccFetchConcurrency",
+	2,
+	"number of concurrent desired app requests to CC",
+)
+
 var communicationTimeout = flag.Duration(
 	"communicationTimeout",
 	30*time.Second,
@@ -100,6 +226,18 @@ var domainTTL = flag.Duration(
 	"duration of the domain; bumped on every bulk sync",
 )
 
+var deepReconcileInterval = flag.Duration(
+	"deepReconcileInterval",
+	0,
+	"how often to compare every desired LRP's instances, routes and resources against CC, repairing drift; 0 disables",
+)
+
+var eventSyncBatchInterval = flag.Duration(
+	"eventSyncBatchInterval",
+	0,
+	"when set, re-check LRPs changed in BBS against CC after collecting events for this long; removed LRPs are left to the full sync; 0 disables",
+)
+
 var bulkBatchSize = flag.Uint(
 	"bulkBatchSize",
 	500,
@@ -109,7 +247,7 @@ var bulkBatchSize = flag.Uint(
 var skipCertVerify = flag.Bool(
 	"skipCertVerify",
 	false,
-	"skip SSL certificate verification",
+	"skip SSL certificate verification; ignored with ccSources, which configure TLS per source",
 )
 
 var fileServerURL = flag.String(
@@ -118,6 +256,36 @@ var fileServerURL = flag.String(
 	"URL of the file server",
 )
 
+var sshKeyStoreDir = flag.String(
+	"sshKeyStoreDir",
+	"",
+	"directory keeping each LRP's SSH keys, so that rebuilding its recipe keeps its host fingerprint; share it between the listener and bulker. Keys rotated through the admin server only apply once the LRP is recreated",
+)
+
+var recipeRevision = flag.String(
+	"recipeRevision",
+	"",
+	"recorded on every LRP with nsync's recipe version; change it on the listener and bulker together, or reload both with SIGHUP, to migrate existing LRPs, e.g. to a new lifecycle bundle",
+)
+
+var migrateRecipes = flag.Bool(
+	"migrateRecipes",
+	false,
+	"replace LRPs built with another recipe version; a copy of each app runs in the LRP domain with a \"-migration\" suffix while it is replaced, so the cells need room for twice its instances",
+)
+
+var recipeMigrationInterval = flag.Duration(
+	"recipeMigrationInterval",
+	time.Minute,
+	"with migrateRecipes, how often to replace the next outdated LRP",
+)
+
+var recipeMigrationMaxInstances = flag.Int(
+	"recipeMigrationMaxInstances",
+	0,
+	"with migrateRecipes, leave LRPs with more instances than this on their old recipe; 0 migrates every LRP",
+)
+
 var bbsCACert = flag.String(
 	"bbsCACert",
 	"",
@@ -154,6 +322,18 @@ var updateLRPWorkers = flag.Int(
 	"Max concurrency for updating/creating lrps",
 )
 
+var bbsWriteRate = flag.Float64(
+	"bbsWriteRate",
+	0,
+	"maximum BBS writes per second shared by all syncs, slowed down while BBS errors or is slow; 0 disables",
+)
+
+var bbsWriteSlowLatency = flag.Duration(
+	"bbsWriteSlowLatency",
+	time.Second,
+	"BBS write latency above which the write rate is slowed down",
+)
+
 var failTaskPoolSize = flag.Int(
 	"failTaskPoolSize",
 	50,
@@ -166,6 +346,48 @@ var cancelTaskPoolSize = flag.Int(
 	"Max concurrency for canceling mismatched tasks",
 )
 
+var taskFailureLog = flag.String(
+	"taskFailureLog",
+	"",
+	"file in which to record every task nsync fails, so that repeated syncs do not fail them again; kept in memory when empty",
+)
+
+var taskFailureRetention = flag.Duration(
+	"taskFailureRetention",
+	7*24*time.Hour,
+	"how long to keep tasks in the task failure log; 0 keeps them forever",
+)
+
+var callbackAllowlist = flag.String(
+	"callbackAllowlist",
+	"",
+	"comma-separated list of scheme://host[:port] entries allowed as task completion callback URLs; a host of *.domain matches its subdomains. If empty, any URL is allowed",
+)
+
+var callbackSigningKeyFile = flag.String(
+	"callbackSigningKeyFile",
+	"",
+	"path to a file holding the key used to sign task completion callbacks with HMAC-SHA256; callbacks are unsigned when empty",
+)
+
+var pendingTaskMaxAge = flag.Duration(
+	"pendingTaskMaxAge",
+	10*time.Minute,
+	"how long a pending CC task may stay missing from BBS, measured from the first sync that finds it missing, before it is failed; 0 never fails it",
+)
+
+var adminAddress = flag.String(
+	"adminAddress",
+	"",
+	"Address to serve the admin API for triggering, pausing and resuming syncs; disabled if empty",
+)
+
+var configFile = flag.String(
+	"config",
+	"",
+	"path to a JSON or YAML file of flag values, with secrets optionally read from their own files; flags given on the command line override it",
+)
+
 const (
 	dropsondeOrigin = "nsync_bulker"
 )
@@ -178,69 +400,153 @@ func main() {
 	flag.Var(&lifecycles, "lifecycle", "app lifecycle binary bundle mapping (lifecycle[/stack]:bundle-filepath-in-fileserver)")
 	flag.Parse()
 
+	var configErr error
+	if *configFile != "" {
+		configErr = config.Apply(flag.CommandLine, *configFile)
+	}
+
 	cf_http.Initialize(*communicationTimeout)
 
 	logger, reconfigurableSink := cf_lager.New("nsync-bulker")
+	if configErr != nil {
+		logger.Fatal("invalid-config-file", configErr)
+	}
+	validateFlags(logger)
+
 	initializeDropsonde(logger)
 
-	serviceClient := initializeServiceClient(logger)
 	uuid, err := uuid.NewV4()
 	if err != nil {
 		logger.Fatal("Couldn't generate uuid", err)
 	}
-	lockMaintainer := serviceClient.NewNsyncBulkerLockRunner(logger, uuid.String(), *lockRetryInterval, *lockTTL)
+	shard := initializeShard(logger)
+	ownership := bulk.NewLockOwnership()
+	lockMaintainer := ownership.Watch(initializeLockBackend(logger, shard).NewLockRunner(logger, uuid.String(), *lockRetryInterval, *lockTTL))
 
 	recipeBuilderConfig := recipebuilder.Config{
 		Lifecycles:           lifecycles,
 		FileServerURL:        *fileServerURL,
 		KeyFactory:           keys.RSAKeyPairFactory,
 		PrivilegedContainers: false,
+		RecipeRevision:       *recipeRevision,
+		KeyStore:             initializeSSHKeyStore(),
+	}
+	recipeRegistry := recipebuilder.NewRegistry(logger, recipeBuilderConfig)
+	recipeBuilders := recipeRegistry.Builders()
+	reload := func() ([]string, error) {
+		return reloadRecipeConfig(recipeRegistry)
 	}
-	recipeBuilders := map[string]recipebuilder.RecipeBuilder{
-		"buildpack": recipebuilder.NewBuildpackRecipeBuilder(logger, recipeBuilderConfig),
-		"docker":    recipebuilder.NewDockerRecipeBuilder(logger, recipeBuilderConfig),
-	}
-
-	lrpRunner := bulk.NewLRPProcessor(
-		logger,
-		initializeBBSClient(logger),
-		*pollingInterval,
-		*domainTTL,
-		*bulkBatchSize,
-		*updateLRPWorkers,
-		*skipCertVerify,
-		&bulk.CCFetcher{
-			BaseURI:   *ccBaseURL,
-			BatchSize: int(*bulkBatchSize),
-			Username:  *ccUsername,
-			Password:  *ccPassword,
-		},
-		recipeBuilders,
-		clock.NewClock(),
-	)
-
-	taskRunner := bulk.NewTaskProcessor(
-		logger,
-		initializeBBSClient(logger),
-		&bulk.CCTaskClient{},
-		*pollingInterval,
-		*domainTTL,
-		*failTaskPoolSize,
-		*cancelTaskPoolSize,
-		*skipCertVerify,
-		&bulk.CCFetcher{
-			BaseURI:   *ccBaseURL,
-			BatchSize: int(*bulkBatchSize),
-			Username:  *ccUsername,
-			Password:  *ccPassword,
-		},
-		clock.NewClock(),
-	)
+
+	sources := initializeCCSources(logger)
+	failureStore := initializeTaskFailureStore(logger)
+	allowlist := initializeCallbackAllowlist(logger)
+	signingKey := initializeCallbackSigningKey(logger)
+
+	writeLimiter := bulk.NewWriteLimiter(logger, *bbsWriteRate, *bbsWriteSlowLatency, clock.NewClock())
 
 	members := grouper.Members{
+		// reload while waiting for the lock, too; an unhandled SIGHUP
+		// would otherwise terminate the bulker
+		{"config-reloader", config.NewSignalReloader(logger, reload)},
 		{"lock-maintainer", lockMaintainer},
-		{"lrp-runner", lrpRunner},
-		{"task-runner", taskRunner},
+	}
+	lrpSyncers := bulk.SyncControllers{}
+	taskSyncers := bulk.SyncControllers{}
+
+	for _, source := range sources {
+		sourceLogger := logger
+		memberSuffix := ""
+		if source.Name != "" {
+			sourceLogger = logger.Session("cc-source", lager.Data{"name": source.Name})
+			memberSuffix = "-" + source.Name
+		}
+
+		ccAuthenticator := initializeCCAuthenticator(sourceLogger, source)
+
+		ccTLSConfig, err := bulk.NewTLSConfig(source.SkipCertVerify, source.CACert, source.ClientCert, source.ClientKey)
+		if err != nil {
+			sourceLogger.Fatal("failed-to-configure-cc-tls", err)
+		}
+
+		// callbacks embed basic auth credentials in their URL; only override
+		// them when the bulker authenticates to CC with tokens
+		var callbackAuthenticator bulk.Authenticator
+		if source.AuthMethod == "oauth" {
+			callbackAuthenticator = ccAuthenticator
+		}
+
+		lrpRunner := bulk.NewLRPProcessor(
+			sourceLogger,
+			initializeBBSClient(logger),
+			*pollingInterval,
+			source.LRPDomain,
+			*domainTTL,
+			*deepReconcileInterval,
+			source.BatchSize,
+			*updateLRPWorkers,
+			ccTLSConfig,
+			newCCFetcher(source, ccAuthenticator),
+			recipeBuilders,
+			recipeBuilderConfig.KeyStore,
+			shard,
+			writeLimiter,
+			ownership,
+			clock.NewClock(),
+		)
+
+		taskRunner := bulk.NewTaskProcessor(
+			sourceLogger,
+			initializeBBSClient(logger),
+			&bulk.CCTaskClient{
+				Authenticator:    callbackAuthenticator,
+				FailureStore:     failureStore,
+				MaxAttempts:      *ccFetchAttempts,
+				RetryInterval:    *ccRetryInterval,
+				MaxRetryInterval: *ccMaxRetryInterval,
+				Clock:            clock.NewClock(),
+
+				CallbackAllowlist: allowlist,
+				SigningKey:        signingKey,
+			},
+			*pollingInterval,
+			source.TaskDomain,
+			*domainTTL,
+			*failTaskPoolSize,
+			*cancelTaskPoolSize,
+			ccTLSConfig,
+			newCCFetcher(source, ccAuthenticator),
+			recipeBuilders,
+			allowlist,
+			*pendingTaskMaxAge,
+			shard,
+			writeLimiter,
+			ownership,
+			clock.NewClock(),
+		)
+
+		members = append(members,
+			grouper.Member{"lrp-runner" + memberSuffix, lrpRunner},
+			grouper.Member{"task-runner" + memberSuffix, taskRunner},
+		)
+
+		if *eventSyncBatchInterval > 0 {
+			members = append(members, grouper.Member{"lrp-event-syncer" + memberSuffix, lrpRunner.NewEventSyncer(*eventSyncBatchInterval)})
+		}
+
+		if *migrateRecipes {
+			migrator := lrpRunner.NewMigrator(*recipeMigrationInterval, *recipeMigrationMaxInstances, func() string {
+				return recipeRegistry.Config().RecipeStamp()
+			})
+			members = append(members, grouper.Member{"lrp-migrator" + memberSuffix, migrator})
+		}
+
+		lrpSyncers = append(lrpSyncers, lrpRunner)
+		taskSyncers = append(taskSyncers, taskRunner)
+	}
+
+	if *adminAddress != "" {
+		adminHandler := handlers.NewAdmin(logger, lrpSyncers, taskSyncers, failureStore, reload, recipeBuilderConfig.KeyStore)
+		members = append(members, grouper.Member{"admin-server", http_server.New(*adminAddress, adminHandler)})
 	}
 
 	if dbgAddr := cf_debug_server.DebugAddress(flag.CommandLine); dbgAddr != "" {
@@ -267,6 +573,48 @@ func main() {
 	os.Exit(0)
 }
 
+func validateFlags(logger lager.Logger) {
+	var errs config.Errors
+
+	err := config.Require(flag.CommandLine, "bbsAddress", "fileServerURL")
+	if err != nil {
+		errs = append(errs, err.(config.Errors)...)
+	}
+
+	if *ccBaseURL == "" && *ccSources == "" {
+		errs = append(errs, errors.New("ccBaseURL or ccSources is required"))
+	}
+
+	if *migrateRecipes && *recipeMigrationInterval <= 0 {
+		errs = append(errs, errors.New("recipeMigrationInterval must be positive with migrateRecipes"))
+	}
+
+	if len(errs) > 0 {
+		logger.Fatal("invalid-configuration", errs)
+	}
+}
+
+func reloadRecipeConfig(registry *recipebuilder.Registry) ([]string, error) {
+	if *configFile == "" {
+		return nil, errors.New("no config file to reload; start with -config")
+	}
+
+	recipeConfig, err := config.ReloadRecipeConfig(flag.CommandLine, *configFile, registry.Config())
+	if err != nil {
+		return nil, err
+	}
+
+	return registry.Reload(recipeConfig), nil
+}
+
+func initializeSSHKeyStore() recipebuilder.SSHKeyStore {
+	if *sshKeyStoreDir == "" {
+		return nil
+	}
+
+	return recipebuilder.NewFileSSHKeyStore(*sshKeyStoreDir, keys.RSAKeyPairFactory)
+}
+
 func initializeDropsonde(logger lager.Logger) {
 	dropsondeDestination := fmt.Sprint("localhost:", *dropsondePort)
 	err := dropsonde.Initialize(dropsondeDestination, dropsondeOrigin)
@@ -275,6 +623,61 @@ func initializeDropsonde(logger lager.Logger) {
 	}
 }
 
+func initializeShard(logger lager.Logger) bulk.Shard {
+	if *shardCount < 1 || *shardIndex < 0 || *shardIndex >= *shardCount {
+		logger.Fatal("invalid-shard", errors.New("shardIndex must be in [0, shardCount)"), lager.Data{
+			"shard-index": *shardIndex,
+			"shard-count": *shardCount,
+		})
+	}
+
+	return bulk.Shard{Index: *shardIndex, Count: *shardCount}
+}
+
+func initializeLockBackend(logger lager.Logger, shard bulk.Shard) lock.Backend {
+	sharded := shard.Count > 1
+
+	switch *lockBackend {
+	case "consul":
+		if sharded {
+			return lock.NewConsulShardBackend(initializeServiceClient(logger), shard.Index)
+		}
+		return lock.NewConsulBackend(initializeServiceClient(logger))
+	case "file":
+		if *lockFile == "" {
+			logger.Fatal("missing-lock-file", errors.New("lockFile is required when lockBackend is file"))
+		}
+		path := *lockFile
+		if sharded {
+			path = fmt.Sprintf("%s.shard-%d", path, shard.Index)
+		}
+		return lock.NewFileBackend(path, clock.NewClock())
+	case "sql":
+		if *lockSQLDriver != lock.SQLLeaseTableDriver {
+			logger.Fatal("unsupported-lock-sql-driver", fmt.Errorf("lockSQLDriver must be %s", lock.SQLLeaseTableDriver), lager.Data{"driver": *lockSQLDriver})
+		}
+
+		db, err := sql.Open(*lockSQLDriver, *lockSQLDataSource)
+		if err != nil {
+			logger.Fatal("failed-to-open-lock-database", err)
+		}
+
+		table, err := lock.NewSQLLeaseTable(db, "locks", clock.NewClock())
+		if err != nil {
+			logger.Fatal("failed-to-create-lock-table", err)
+		}
+		key := nsync.NysncBulkerLockSchemaKey
+		if sharded {
+			key = nsync.NsyncBulkerShardLockSchemaKey(shard.Index)
+		}
+		return lock.NewLeaseBackend(table, key, clock.NewClock())
+	default:
+		logger.Fatal("invalid-lock-backend", errors.New("unknown lock backend"), lager.Data{"lock-backend": *lockBackend})
+	}
+
+	return nil
+}
+
 func initializeServiceClient(logger lager.Logger) nsync.ServiceClient {
 	consulClient, err := consuladapter.NewClientFromUrl(*consulCluster)
 	if err != nil {
@@ -284,6 +687,99 @@ func initializeServiceClient(logger lager.Logger) nsync.ServiceClient {
 	return nsync.NewServiceClient(consulClient, clock.NewClock())
 }
 
+// initializeCCSources returns the sources in the ccSources file, or else a
+// single source configured by the cc* flags that syncs the default domains.
+func initializeCCSources(logger lager.Logger) []config.CCSource {
+	var sources []config.CCSource
+
+	if *ccSources != "" {
+		if *ccBaseURL != "" {
+			logger.Fatal("conflicting-cc-configuration", errors.New("ccBaseURL cannot be combined with ccSources"))
+		}
+
+		var err error
+		sources, err = config.LoadCCSources(*ccSources)
+		if err != nil {
+			logger.Fatal("invalid-cc-sources", err)
+		}
+	} else {
+		sources = []config.CCSource{{
+			BaseURL:           *ccBaseURL,
+			AuthMethod:        *ccAuthMethod,
+			Username:          *ccUsername,
+			Password:          *ccPassword,
+			OAuthTokenURL:     *ccOAuthTokenURL,
+			OAuthClientID:     *ccOAuthClientID,
+			OAuthClientSecret: *ccOAuthClientSecret,
+			SkipCertVerify:    *skipCertVerify,
+			CACert:            *ccCACert,
+			ClientCert:        *ccClientCert,
+			ClientKey:         *ccClientKey,
+			LRPDomain:         cc_messages.AppLRPDomain,
+			TaskDomain:        cc_messages.RunningTaskDomain,
+		}}
+	}
+
+	for i := range sources {
+		if sources[i].AuthMethod == "" {
+			sources[i].AuthMethod = "basic"
+		}
+		if sources[i].BatchSize == 0 {
+			sources[i].BatchSize = *bulkBatchSize
+		}
+	}
+
+	return sources
+}
+
+func initializeCCAuthenticator(logger lager.Logger, source config.CCSource) bulk.Authenticator {
+	switch source.AuthMethod {
+	case "basic":
+		return &bulk.BasicAuthenticator{Username: source.Username, Password: source.Password}
+	case "oauth":
+		if source.OAuthTokenURL == "" {
+			logger.Fatal("missing-oauth-token-url", errors.New("ccOAuthTokenURL is required when ccAuthMethod is oauth"))
+		}
+		return bulk.NewOAuthAuthenticator(source.OAuthTokenURL, source.OAuthClientID, source.OAuthClientSecret, clock.NewClock())
+	case "none":
+		return bulk.NoAuthenticator{}
+	default:
+		logger.Fatal("invalid-cc-auth-method", fmt.Errorf("unknown auth method %q", source.AuthMethod))
+	}
+
+	return nil
+}
+
+func newCCFetcher(source config.CCSource, authenticator bulk.Authenticator) *bulk.CCFetcher {
+	return &bulk.CCFetcher{
+		BaseURI:          source.BaseURL,
+		BatchSize:        int(source.BatchSize),
+		Username:         source.Username,
+		Password:         source.Password,
+		Authenticator:    authenticator,
+		MaxAttempts:      *ccFetchAttempts,
+		RetryInterval:    *ccRetryInterval,
+		MaxRetryInterval: *ccMaxRetryInterval,
+		Clock:            clock.NewClock(),
+
+		PrefetchDepth:         *ccPrefetchDepth,
+		DesiredAppConcurrency: *ccFetchConcurrency,
+	}
+}
+
+func initializeTaskFailureStore(logger lager.Logger) bulk.TaskFailureStore {
+	if *taskFailureLog == "" {
+		return bulk.NewInMemoryTaskFailureStore()
+	}
+
+	store, err := bulk.NewFileTaskFailureStore(*taskFailureLog, *taskFailureRetention, clock.NewClock())
+	if err != nil {
+		logger.Fatal("failed-to-open-task-failure-log", err)
+	}
+
+	return store
+}
+
 func initializeBBSClient(logger lager.Logger) bbs.Client {
 	bbsURL, err := url.Parse(*bbsAddress)
 	if err != nil {
@@ -300,3 +796,29 @@ func initializeBBSClient(logger lager.Logger) bbs.Client {
 	}
 	return bbsClient
 }
+
+func initializeCallbackAllowlist(logger lager.Logger) *helpers.CallbackAllowlist {
+	allowlist, err := helpers.NewCallbackAllowlist(strings.Split(*callbackAllowlist, ","))
+	if err != nil {
+		logger.Fatal("invalid-callback-allowlist", err)
+	}
+	return allowlist
+}
+
+func initializeCallbackSigningKey(logger lager.Logger) []byte {
+	if *callbackSigningKeyFile == "" {
+		return nil
+	}
+
+	key, err := ioutil.ReadFile(*callbackSigningKeyFile)
+	if err != nil {
+		logger.Fatal("failed-to-read-callback-signing-key", err)
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		logger.Fatal("empty-callback-signing-key", errors.New("callback signing key file is empty"))
+	}
+
+	return key
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/cloudfoundry-incubator/bbs"
@@ -15,7 +17,10 @@ import (
 	"github.com/cloudfoundry-incubator/consuladapter"
 	"github.com/cloudfoundry-incubator/diego-ssh/keys"
 	"github.com/cloudfoundry-incubator/locket"
+	"github.com/cloudfoundry-incubator/nsync/config"
 	"github.com/cloudfoundry-incubator/nsync/handlers"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages/flags"
 	"github.com/hashicorp/consul/api"
 	"github.com/pivotal-golang/clock"
@@ -47,6 +52,18 @@ var fileServerURL = flag.String(
 	"URL of the file server",
 )
 
+var sshKeyStoreDir = flag.String(
+	"sshKeyStoreDir",
+	"",
+	"directory keeping each LRP's SSH keys, so that rebuilding its recipe keeps its host fingerprint; share it between the listener and bulker",
+)
+
+var recipeRevision = flag.String(
+	"recipeRevision",
+	"",
+	"recorded on every LRP with nsync's recipe version; change it on the listener and bulker together to migrate existing LRPs, e.g. to a new lifecycle bundle",
+)
+
 var communicationTimeout = flag.Duration(
 	"communicationTimeout",
 	30*time.Second,
@@ -95,6 +112,36 @@ var bbsMaxIdleConnsPerHost = flag.Int(
 	"Controls the maximum number of idle (keep-alive) connctions per host. If zero, golang's default will be used",
 )
 
+var callbackAllowlist = flag.String(
+	"callbackAllowlist",
+	"",
+	"comma-separated list of scheme://host[:port] entries allowed as task completion callback URLs; a host of *.domain matches its subdomains. If empty, any URL is allowed",
+)
+
+var ccSources = flag.String(
+	"ccSources",
+	"",
+	"path to the bulker's JSON file of cloud controllers; with ccSource, LRPs and tasks are desired into that source's BBS domains",
+)
+
+var ccSource = flag.String(
+	"ccSource",
+	"",
+	"name of the cloud controller in ccSources this listener serves; run one listener per cloud controller",
+)
+
+var adminAddress = flag.String(
+	"adminAddress",
+	"",
+	"Address to serve the admin API for reloading the config file; disabled if empty",
+)
+
+var configFile = flag.String(
+	"config",
+	"",
+	"path to a JSON or YAML file of flag values, with secrets optionally read from their own files; flags given on the command line override it",
+)
+
 const (
 	dropsondeOrigin = "nsync_listener"
 )
@@ -107,22 +154,39 @@ func main() {
 	flag.Var(&lifecycles, "lifecycle", "app lifecycle binary bundle mapping (lifecycle[/stack]:bundle-filepath-in-fileserver)")
 	flag.Parse()
 
+	var configErr error
+	if *configFile != "" {
+		configErr = config.Apply(flag.CommandLine, *configFile)
+	}
+
 	cf_http.Initialize(*communicationTimeout)
 	logger, reconfigurableSink := cf_lager.New("nsync-listener")
+	if configErr != nil {
+		logger.Fatal("invalid-config-file", configErr)
+	}
+
+	err := config.Require(flag.CommandLine, "bbsAddress", "listenAddress", "fileServerURL")
+	if err != nil {
+		logger.Fatal("invalid-configuration", err)
+	}
 
 	initializeDropsonde(logger)
 
 	recipeBuilderConfig := recipebuilder.Config{
-		Lifecycles:    lifecycles,
-		FileServerURL: *fileServerURL,
-		KeyFactory:    keys.RSAKeyPairFactory,
+		Lifecycles:     lifecycles,
+		FileServerURL:  *fileServerURL,
+		KeyFactory:     keys.RSAKeyPairFactory,
+		RecipeRevision: *recipeRevision,
+		KeyStore:       initializeSSHKeyStore(),
 	}
-	recipeBuilders := map[string]recipebuilder.RecipeBuilder{
-		"buildpack": recipebuilder.NewBuildpackRecipeBuilder(logger, recipeBuilderConfig),
-		"docker":    recipebuilder.NewDockerRecipeBuilder(logger, recipeBuilderConfig),
+	recipeRegistry := recipebuilder.NewRegistry(logger, recipeBuilderConfig)
+	recipeBuilders := recipeRegistry.Builders()
+	reload := func() ([]string, error) {
+		return reloadRecipeConfig(recipeRegistry)
 	}
 
-	handler := handlers.New(logger, initializeBBSClient(logger), recipeBuilders)
+	lrpDomain, taskDomain := initializeDomains(logger)
+	handler := handlers.New(logger, initializeBBSClient(logger), recipeBuilders, initializeCallbackAllowlist(logger), lrpDomain, taskDomain, recipeBuilderConfig.KeyStore)
 
 	consulClient, err := consuladapter.NewClientFromUrl(*consulCluster)
 	if err != nil {
@@ -142,10 +206,17 @@ func main() {
 	registrationRunner := initializeRegistrationRunner(logger, consulClient, portNum, clock)
 
 	members := grouper.Members{
+		// handle SIGHUP before anything else starts; an unhandled SIGHUP
+		// would otherwise terminate the listener
+		{"config-reloader", config.NewSignalReloader(logger, reload)},
 		{"server", http_server.New(*listenAddress, handler)},
 		{"registration-runner", registrationRunner},
 	}
 
+	if *adminAddress != "" {
+		members = append(members, grouper.Member{"admin-server", http_server.New(*adminAddress, handlers.NewListenerAdmin(logger, reload))})
+	}
+
 	if dbgAddr := cf_debug_server.DebugAddress(flag.CommandLine); dbgAddr != "" {
 		members = append(grouper.Members{
 			{"debug-server", cf_debug_server.Runner(dbgAddr, reconfigurableSink)},
@@ -167,6 +238,56 @@ func main() {
 	logger.Info("exited")
 }
 
+func reloadRecipeConfig(registry *recipebuilder.Registry) ([]string, error) {
+	if *configFile == "" {
+		return nil, errors.New("no config file to reload; start with -config")
+	}
+
+	recipeConfig, err := config.ReloadRecipeConfig(flag.CommandLine, *configFile, registry.Config())
+	if err != nil {
+		return nil, err
+	}
+
+	return registry.Reload(recipeConfig), nil
+}
+
+// initializeDomains returns the BBS domains of the ccSource entry in
+// ccSources, or the default domains when no sources are configured.
+func initializeDomains(logger lager.Logger) (string, string) {
+	if *ccSources == "" {
+		if *ccSource != "" {
+			logger.Fatal("invalid-cc-source", errors.New("ccSource requires ccSources"))
+		}
+		return cc_messages.AppLRPDomain, cc_messages.RunningTaskDomain
+	}
+
+	if *ccSource == "" {
+		logger.Fatal("invalid-cc-source", errors.New("ccSource is required with ccSources"))
+	}
+
+	sources, err := config.LoadCCSources(*ccSources)
+	if err != nil {
+		logger.Fatal("invalid-cc-sources", err)
+	}
+
+	source, err := config.FindCCSource(sources, *ccSource)
+	if err != nil {
+		logger.Fatal("invalid-cc-source", err)
+	}
+
+	logger.Info("serving-cc-source", lager.Data{"name": source.Name, "lrp-domain": source.LRPDomain, "task-domain": source.TaskDomain})
+
+	return source.LRPDomain, source.TaskDomain
+}
+
+func initializeSSHKeyStore() recipebuilder.SSHKeyStore {
+	if *sshKeyStoreDir == "" {
+		return nil
+	}
+
+	return recipebuilder.NewFileSSHKeyStore(*sshKeyStoreDir, keys.RSAKeyPairFactory)
+}
+
 func initializeDropsonde(logger lager.Logger) {
 	dropsondeDestination := fmt.Sprint("localhost:", *dropsondePort)
 	err := dropsonde.Initialize(dropsondeDestination, dropsondeOrigin)
@@ -192,6 +313,14 @@ func initializeBBSClient(logger lager.Logger) bbs.Client {
 	return bbsClient
 }
 
+func initializeCallbackAllowlist(logger lager.Logger) *helpers.CallbackAllowlist {
+	allowlist, err := helpers.NewCallbackAllowlist(strings.Split(*callbackAllowlist, ","))
+	if err != nil {
+		logger.Fatal("invalid-callback-allowlist", err)
+	}
+	return allowlist
+}
+
 func initializeRegistrationRunner(
 	logger lager.Logger,
 	consulClient consuladapter.Client,
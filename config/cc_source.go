@@ -0,0 +1,123 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+)
+
+// CCSource is one Cloud Controller reconciled by the bulker. Each source
+// syncs its own pair of BBS domains, so that a stale or unreachable CC only
+// lets its own domains expire. The listener serving a CC reads the same file
+// to find the domains to desire into.
+type CCSource struct {
+	Name    string `json:"name"`
+	BaseURL string `json:"base_url"`
+
+	// AuthMethod is "basic" (the default), "oauth" or "none", as for the
+	// bulker's ccAuthMethod flag.
+	AuthMethod        string `json:"auth_method,omitempty"`
+	Username          string `json:"username,omitempty"`
+	Password          string `json:"password,omitempty"`
+	OAuthTokenURL     string `json:"oauth_token_url,omitempty"`
+	OAuthClientID     string `json:"oauth_client_id,omitempty"`
+	OAuthClientSecret string `json:"oauth_client_secret,omitempty"`
+
+	// SkipCertVerify and the paths below configure TLS to this CC alone;
+	// the bulker's TLS flags do not apply to sources read from a file.
+	SkipCertVerify bool   `json:"skip_cert_verify,omitempty"`
+	CACert         string `json:"ca_cert,omitempty"`
+	ClientCert     string `json:"client_cert,omitempty"`
+	ClientKey      string `json:"client_key,omitempty"`
+
+	// BatchSize defaults to the bulker's bulkBatchSize when 0.
+	BatchSize uint `json:"batch_size,omitempty"`
+
+	LRPDomain  string `json:"lrp_domain"`
+	TaskDomain string `json:"task_domain"`
+}
+
+// LoadCCSources reads a JSON array of sources from path and validates it.
+func LoadCCSources(path string) ([]CCSource, error) {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []CCSource
+	err = json.Unmarshal(payload, &sources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cc sources: %s", err)
+	}
+
+	err = ValidateCCSources(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// FindCCSource returns the source with the given name, so that the listener
+// serving that CC desires into the domains its bulker syncs.
+func FindCCSource(sources []CCSource, name string) (CCSource, error) {
+	for _, source := range sources {
+		if source.Name == name {
+			return source, nil
+		}
+	}
+
+	return CCSource{}, fmt.Errorf("no cc source named %q", name)
+}
+
+// ValidateCCSources checks that every source is complete and that no two
+// sources share a name or a BBS domain, since each source's sync removes
+// whatever in its domains its CC does not desire.
+func ValidateCCSources(sources []CCSource) error {
+	if len(sources) == 0 {
+		return errors.New("no cc sources configured")
+	}
+
+	names := map[string]bool{}
+	domains := map[string]string{}
+
+	for i, source := range sources {
+		if source.Name == "" {
+			return fmt.Errorf("cc source %d: name is required", i)
+		}
+		if names[source.Name] {
+			return fmt.Errorf("cc source %q: duplicate name", source.Name)
+		}
+		names[source.Name] = true
+
+		baseURL, err := url.Parse(source.BaseURL)
+		if err != nil || baseURL.Scheme == "" || baseURL.Host == "" {
+			return fmt.Errorf("cc source %q: invalid base_url %q", source.Name, source.BaseURL)
+		}
+
+		switch source.AuthMethod {
+		case "", "basic", "none":
+		case "oauth":
+			if source.OAuthTokenURL == "" {
+				return fmt.Errorf("cc source %q: oauth_token_url is required when auth_method is oauth", source.Name)
+			}
+		default:
+			return fmt.Errorf("cc source %q: unknown auth_method %q", source.Name, source.AuthMethod)
+		}
+
+		if source.LRPDomain == "" || source.TaskDomain == "" {
+			return fmt.Errorf("cc source %q: lrp_domain and task_domain are required", source.Name)
+		}
+
+		for _, domain := range []string{source.LRPDomain, source.TaskDomain} {
+			if owner, taken := domains[domain]; taken {
+				return fmt.Errorf("cc source %q: domain %q is already synced by cc source %q", source.Name, domain, owner)
+			}
+			domains[domain] = source.Name
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/cloudfoundry-incubator/nsync/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CCSource", func() {
+	var sources []config.CCSource
+
+	BeforeEach(func() {
+		sources = []config.CCSource{
+			{
+				Name:       "east",
+				BaseURL:    "https://cc.east.example.com",
+				Username:   "user",
+				Password:   "pass",
+				LRPDomain:  "cf-apps-east",
+				TaskDomain: "cf-tasks-east",
+			},
+			{
+				Name:          "west",
+				BaseURL:       "https://cc.west.example.com",
+				AuthMethod:    "oauth",
+				OAuthTokenURL: "https://uaa.west.example.com/oauth/token",
+				LRPDomain:     "cf-apps-west",
+				TaskDomain:    "cf-tasks-west",
+			},
+		}
+	})
+
+	Describe("ValidateCCSources", func() {
+		It("accepts complete, distinct sources", func() {
+			Expect(config.ValidateCCSources(sources)).To(Succeed())
+		})
+
+		It("rejects an empty list", func() {
+			Expect(config.ValidateCCSources(nil)).NotTo(Succeed())
+		})
+
+		It("rejects duplicate names", func() {
+			sources[1].Name = "east"
+			Expect(config.ValidateCCSources(sources)).To(MatchError(ContainSubstring("duplicate name")))
+		})
+
+		It("rejects sources sharing a domain", func() {
+			sources[1].TaskDomain = "cf-tasks-east"
+			Expect(config.ValidateCCSources(sources)).To(MatchError(ContainSubstring(`already synced by cc source "east"`)))
+		})
+
+		It("rejects a source without domains", func() {
+			sources[0].LRPDomain = ""
+			Expect(config.ValidateCCSources(sources)).To(MatchError(ContainSubstring("lrp_domain and task_domain are required")))
+		})
+
+		It("rejects an invalid base url", func() {
+			sources[0].BaseURL = "cc.east.example.com"
+			Expect(config.ValidateCCSources(sources)).To(MatchError(ContainSubstring("invalid base_url")))
+		})
+
+		It("rejects oauth without a token url", func() {
+			sources[1].OAuthTokenURL = ""
+			Expect(config.ValidateCCSources(sources)).To(MatchError(ContainSubstring("oauth_token_url is required")))
+		})
+	})
+
+	Describe("LoadCCSources", func() {
+		var path string
+
+		BeforeEach(func() {
+			file, err := ioutil.TempFile("", "cc-sources")
+			Expect(err).NotTo(HaveOccurred())
+			path = file.Name()
+
+			_, err = file.WriteString(`[
+				{
+					"name": "east",
+					"base_url": "https://cc.east.example.com",
+					"username": "user",
+					"password": "pass",
+					"batch_size": 100,
+					"skip_cert_verify": true,
+					"lrp_domain": "cf-apps-east",
+					"task_domain": "cf-tasks-east"
+				}
+			]`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.Remove(path)
+		})
+
+		It("reads the sources", func() {
+			loaded, err := config.LoadCCSources(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			expected := sources[0]
+			expected.BatchSize = 100
+			expected.SkipCertVerify = true
+			Expect(loaded).To(Equal([]config.CCSource{expected}))
+		})
+	})
+
+	Describe("FindCCSource", func() {
+		It("returns the named source", func() {
+			source, err := config.FindCCSource(sources, "west")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(source.LRPDomain).To(Equal("cf-apps-west"))
+		})
+
+		It("errors for an unknown name", func() {
+			_, err := config.FindCCSource(sources, "north")
+			Expect(err).To(MatchError(`no cc source named "north"`))
+		})
+	})
+})
@@ -0,0 +1,260 @@
+// Package config loads flag values from a JSON or YAML file, so that the
+// nsync commands can be configured without putting every setting, and
+// especially secrets, on the command line.
+//
+// The file maps flag names to values. Repeatable flags such as -lifecycle
+// take a list. A "secrets" section maps flag names to files holding their
+// values:
+//
+//	ccBaseURL: https://cloud-controller-ng.service.cf.internal:9023
+//	ccUsername: internal_user
+//	lifecycle:
+//	  - buildpack/cflinuxfs2:buildpack_app_lifecycle/buildpack_app_lifecycle.tgz
+//	secrets:
+//	  ccPassword: /var/vcap/jobs/nsync/secrets/cc_password
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages/flags"
+	"gopkg.in/yaml.v2"
+)
+
+const secretsKey = "secrets"
+
+// Errors reports every problem found in a configuration at once.
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Apply sets the flags in fs from the file at path. Flags already set on the
+// command line keep their values, so that flags override the file.
+func Apply(fs *flag.FlagSet, path string) error {
+	return applyFile(fs, path, setFlags(fs), false)
+}
+
+// ReloadRecipeConfig re-reads the settings that shape recipes, the lifecycle
+// mappings, fileServerURL and recipeRevision, from the file at path. Settings given on
+// commandLine keep their current values.
+func ReloadRecipeConfig(commandLine *flag.FlagSet, path string, current recipebuilder.Config) (recipebuilder.Config, error) {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+
+	defaultFileServerURL := ""
+	if f := commandLine.Lookup("fileServerURL"); f != nil {
+		defaultFileServerURL = f.DefValue
+	}
+	fileServerURL := fs.String("fileServerURL", defaultFileServerURL, "")
+
+	defaultRecipeRevision := ""
+	if f := commandLine.Lookup("recipeRevision"); f != nil {
+		defaultRecipeRevision = f.DefValue
+	}
+	recipeRevision := fs.String("recipeRevision", defaultRecipeRevision, "")
+
+	lifecycles := flags.LifecycleMap{}
+	fs.Var(&lifecycles, "lifecycle", "")
+
+	setOnCommandLine := setFlags(commandLine)
+
+	err := applyFile(fs, path, setOnCommandLine, true)
+	if err != nil {
+		return current, err
+	}
+
+	reloaded := current
+	if !setOnCommandLine["fileServerURL"] {
+		if *fileServerURL == "" {
+			return current, errors.New("fileServerURL is required")
+		}
+		reloaded.FileServerURL = *fileServerURL
+	}
+	if !setOnCommandLine["lifecycle"] {
+		reloaded.Lifecycles = lifecycles
+	}
+	if !setOnCommandLine["recipeRevision"] {
+		reloaded.RecipeRevision = *recipeRevision
+	}
+
+	return reloaded, nil
+}
+
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// applyFile sets the flags in fs from the file at path, skipping those in
+// skip. Settings fs does not define are errors unless ignoreUnknown is set.
+func applyFile(fs *flag.FlagSet, path string, skip map[string]bool, ignoreUnknown bool) error {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// YAML is a superset of JSON, so this reads either
+	values := map[string]interface{}{}
+	err = yaml.Unmarshal(payload, &values)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+
+	secrets, err := secretPaths(values[secretsKey])
+	if err != nil {
+		return err
+	}
+	delete(values, secretsKey)
+
+	var errs Errors
+
+	for _, name := range sortedKeys(values) {
+		if _, isSecret := secrets[name]; isSecret {
+			errs = append(errs, fmt.Errorf("%s: set both directly and in secrets", name))
+			continue
+		}
+
+		err := apply(fs, skip, ignoreUnknown, name, values[name])
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	secretNames := make([]string, 0, len(secrets))
+	for name := range secrets {
+		secretNames = append(secretNames, name)
+	}
+	sort.Strings(secretNames)
+
+	for _, name := range secretNames {
+		if skip[name] || (ignoreUnknown && fs.Lookup(name) == nil) {
+			continue
+		}
+
+		secret, err := ioutil.ReadFile(secrets[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: failed to read secret: %s", name, err))
+			continue
+		}
+
+		err = apply(fs, skip, ignoreUnknown, name, strings.TrimSpace(string(secret)))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Require checks that each of the named flags has a value.
+func Require(fs *flag.FlagSet, names ...string) error {
+	var errs Errors
+
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || f.Value.String() == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func apply(fs *flag.FlagSet, skip map[string]bool, ignoreUnknown bool, name string, value interface{}) error {
+	if fs.Lookup(name) == nil {
+		if ignoreUnknown {
+			return nil
+		}
+		return fmt.Errorf("%s: unknown setting", name)
+	}
+
+	if skip[name] {
+		return nil
+	}
+
+	var settings []interface{}
+	switch value := value.(type) {
+	case nil:
+		return fmt.Errorf("%s: no value", name)
+	case []interface{}:
+		settings = value
+	default:
+		settings = []interface{}{value}
+	}
+
+	for _, setting := range settings {
+		switch setting.(type) {
+		case string, bool, int, int64, uint64, float64:
+		default:
+			return fmt.Errorf("%s: unsupported value %v", name, setting)
+		}
+
+		err := fs.Set(name, fmt.Sprint(setting))
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %v: %s", name, setting, err)
+		}
+	}
+
+	return nil
+}
+
+func secretPaths(section interface{}) (map[string]string, error) {
+	paths := map[string]string{}
+	if section == nil {
+		return paths, nil
+	}
+
+	entries, ok := section.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("secrets: must map setting names to files")
+	}
+
+	for name, path := range entries {
+		nameString, ok := name.(string)
+		if !ok {
+			return nil, fmt.Errorf("secrets: invalid setting name %v", name)
+		}
+
+		pathString, ok := path.(string)
+		if !ok || pathString == "" {
+			return nil, fmt.Errorf("secrets: %s: must be a file path", nameString)
+		}
+
+		paths[nameString] = pathString
+	}
+
+	return paths, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
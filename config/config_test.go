@@ -0,0 +1,205 @@
+package config_test
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry-incubator/nsync/config"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages/flags"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		dir string
+		fs  *flag.FlagSet
+
+		ccBaseURL       *string
+		ccPassword      *string
+		pollingInterval *time.Duration
+		bulkBatchSize   *uint
+		skipCertVerify  *bool
+		lifecycles      flags.LifecycleMap
+	)
+
+	writeFile := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Expect(err).NotTo(HaveOccurred())
+
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		ccBaseURL = fs.String("ccBaseURL", "", "")
+		ccPassword = fs.String("ccPassword", "", "")
+		pollingInterval = fs.Duration("pollingInterval", 30*time.Second, "")
+		bulkBatchSize = fs.Uint("bulkBatchSize", 500, "")
+		skipCertVerify = fs.Bool("skipCertVerify", false, "")
+		lifecycles = flags.LifecycleMap{}
+		fs.Var(&lifecycles, "lifecycle", "")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("Apply", func() {
+		It("sets flags from a YAML file", func() {
+			path := writeFile("config.yml", `
+ccBaseURL: https://cc.example.com
+pollingInterval: 10s
+bulkBatchSize: 100
+skipCertVerify: true
+lifecycle:
+  - buildpack/cflinuxfs2:buildpack.tgz
+  - docker:docker.tgz
+`)
+
+			Expect(config.Apply(fs, path)).To(Succeed())
+			Expect(*ccBaseURL).To(Equal("https://cc.example.com"))
+			Expect(*pollingInterval).To(Equal(10 * time.Second))
+			Expect(*bulkBatchSize).To(BeEquivalentTo(100))
+			Expect(*skipCertVerify).To(BeTrue())
+			Expect(lifecycles).To(Equal(flags.LifecycleMap{
+				"buildpack/cflinuxfs2": "buildpack.tgz",
+				"docker":               "docker.tgz",
+			}))
+		})
+
+		It("sets flags from a JSON file", func() {
+			path := writeFile("config.json", `{"ccBaseURL": "https://cc.example.com", "bulkBatchSize": 100}`)
+
+			Expect(config.Apply(fs, path)).To(Succeed())
+			Expect(*ccBaseURL).To(Equal("https://cc.example.com"))
+			Expect(*bulkBatchSize).To(BeEquivalentTo(100))
+		})
+
+		It("reads secrets from their own files", func() {
+			secretPath := writeFile("cc_password", "s3cret\n")
+			path := writeFile("config.yml", "secrets:\n  ccPassword: "+secretPath+"\n")
+
+			Expect(config.Apply(fs, path)).To(Succeed())
+			Expect(*ccPassword).To(Equal("s3cret"))
+		})
+
+		It("lets flags given on the command line override the file", func() {
+			Expect(fs.Parse([]string{"-ccBaseURL", "https://override.example.com"})).To(Succeed())
+			path := writeFile("config.yml", "ccBaseURL: https://cc.example.com\nbulkBatchSize: 100\n")
+
+			Expect(config.Apply(fs, path)).To(Succeed())
+			Expect(*ccBaseURL).To(Equal("https://override.example.com"))
+			Expect(*bulkBatchSize).To(BeEquivalentTo(100))
+		})
+
+		It("reports every problem at once", func() {
+			path := writeFile("config.yml", `
+ccBaseURL: https://cc.example.com
+pollingInterval: soon
+bogus: true
+secrets:
+  ccPassword: /nonexistent/cc_password
+`)
+
+			err := config.Apply(fs, path)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(config.Errors)).To(HaveLen(3))
+			Expect(err.Error()).To(ContainSubstring("bogus: unknown setting"))
+			Expect(err.Error()).To(ContainSubstring("pollingInterval: invalid value soon"))
+			Expect(err.Error()).To(ContainSubstring("ccPassword: failed to read secret"))
+		})
+
+		It("rejects a setting given both directly and as a secret", func() {
+			path := writeFile("config.yml", "ccPassword: plain\nsecrets:\n  ccPassword: /some/file\n")
+
+			Expect(config.Apply(fs, path)).To(MatchError(ContainSubstring("set both directly and in secrets")))
+		})
+
+		It("rejects a file that does not parse", func() {
+			path := writeFile("config.yml", "ccBaseURL: [")
+
+			Expect(config.Apply(fs, path)).To(MatchError(ContainSubstring("invalid config file")))
+		})
+	})
+
+	Describe("ReloadRecipeConfig", func() {
+		var current recipebuilder.Config
+
+		BeforeEach(func() {
+			fs.String("fileServerURL", "", "")
+			current = recipebuilder.Config{
+				Lifecycles:           map[string]string{"buildpack/cflinuxfs2": "old.tgz"},
+				FileServerURL:        "http://old-file-server.com",
+				PrivilegedContainers: true,
+			}
+		})
+
+		It("re-reads the lifecycles and file server, ignoring other settings", func() {
+			path := writeFile("config.yml", `
+ccBaseURL: https://cc.example.com
+fileServerURL: http://new-file-server.com
+lifecycle:
+  - buildpack/cflinuxfs2:new.tgz
+`)
+
+			reloaded, err := config.ReloadRecipeConfig(fs, path, current)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded).To(Equal(recipebuilder.Config{
+				Lifecycles:           map[string]string{"buildpack/cflinuxfs2": "new.tgz"},
+				FileServerURL:        "http://new-file-server.com",
+				PrivilegedContainers: true,
+			}))
+			Expect(*ccBaseURL).To(BeEmpty())
+		})
+
+		It("re-reads the recipe revision", func() {
+			fs.String("recipeRevision", "", "")
+			path := writeFile("config.yml", `
+fileServerURL: http://new-file-server.com
+recipeRevision: new-lifecycles
+`)
+
+			reloaded, err := config.ReloadRecipeConfig(fs, path, current)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded.RecipeRevision).To(Equal("new-lifecycles"))
+			Expect(reloaded.RecipeStamp()).To(Equal(fmt.Sprintf("%d+new-lifecycles", recipebuilder.RecipeVersion)))
+		})
+
+		It("keeps settings given on the command line", func() {
+			Expect(fs.Parse([]string{"-lifecycle", "buildpack/cflinuxfs2:old.tgz"})).To(Succeed())
+			path := writeFile("config.yml", `
+fileServerURL: http://new-file-server.com
+lifecycle:
+  - buildpack/cflinuxfs2:new.tgz
+`)
+
+			reloaded, err := config.ReloadRecipeConfig(fs, path, current)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded.Lifecycles).To(Equal(current.Lifecycles))
+			Expect(reloaded.FileServerURL).To(Equal("http://new-file-server.com"))
+		})
+
+		It("rejects a config without a file server", func() {
+			path := writeFile("config.yml", "lifecycle:\n  - buildpack/cflinuxfs2:new.tgz\n")
+
+			_, err := config.ReloadRecipeConfig(fs, path, current)
+			Expect(err).To(MatchError("fileServerURL is required"))
+		})
+	})
+
+	Describe("Require", func() {
+		It("reports each missing flag", func() {
+			err := config.Require(fs, "ccBaseURL", "ccPassword", "pollingInterval")
+			Expect(err).To(MatchError("ccBaseURL is required; ccPassword is required"))
+		})
+	})
+})
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+// NewSignalReloader returns a runner that calls reload whenever the process
+// receives SIGHUP. A failed reload is logged and the previous configuration
+// stays in effect. SIGHUP is caught from the moment the runner is created, so
+// one arriving before the runner starts is handled once it does rather than
+// terminating the process.
+func NewSignalReloader(logger lager.Logger, reload func() ([]string, error)) ifrit.Runner {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		logger := logger.Session("signal-reloader")
+
+		defer signal.Stop(hup)
+
+		close(ready)
+
+		for {
+			select {
+			case <-signals:
+				return nil
+			case <-hup:
+				logger.Info("reloading")
+				changes, err := reload()
+				if err != nil {
+					logger.Error("failed-to-reload", err)
+					continue
+				}
+				logger.Info("reloaded", lager.Data{"changes": changes})
+			}
+		}
+	})
+}
@@ -8,8 +8,6 @@ import (
 	"github.com/cloudfoundry-incubator/bbs/models"
 	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
-	"github.com/cloudfoundry-incubator/routing-info/cfroutes"
-	"github.com/cloudfoundry-incubator/routing-info/tcp_routes"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/cloudfoundry-incubator/runtime-schema/metric"
 	"github.com/pivotal-golang/lager"
@@ -22,13 +20,15 @@ const (
 type DesireAppHandler struct {
 	recipeBuilders map[string]recipebuilder.RecipeBuilder
 	bbsClient      bbs.Client
+	lrpDomain      string
 	logger         lager.Logger
 }
 
-func NewDesireAppHandler(logger lager.Logger, bbsClient bbs.Client, builders map[string]recipebuilder.RecipeBuilder) DesireAppHandler {
+func NewDesireAppHandler(logger lager.Logger, bbsClient bbs.Client, builders map[string]recipebuilder.RecipeBuilder, lrpDomain string) DesireAppHandler {
 	return DesireAppHandler{
 		recipeBuilders: builders,
 		bbsClient:      bbsClient,
+		lrpDomain:      lrpDomain,
 		logger:         logger,
 	}
 }
@@ -89,9 +89,10 @@ func (h *DesireAppHandler) DesireApp(resp http.ResponseWriter, req *http.Request
 			case models.Error_ResourceExists:
 				statusCode = http.StatusConflict
 			default:
-				if _, ok := err.(recipebuilder.Error); ok {
+				switch err.(type) {
+				case recipebuilder.Error, helpers.RouteValidationError:
 					statusCode = http.StatusBadRequest
-				} else {
+				default:
 					statusCode = http.StatusServiceUnavailable
 				}
 			}
@@ -138,6 +139,9 @@ func (h *DesireAppHandler) createDesiredApp(
 		return err
 	}
 
+	// the bulker syncs the same domain for this CC
+	desiredLRP.Domain = h.lrpDomain
+
 	logger.Debug("creating-desired-lrp", lager.Data{"routes": sanitizeRoutes(desiredLRP.Routes)})
 	err = h.bbsClient.DesireLRP(logger, desiredLRP)
 	if err != nil {
@@ -170,25 +174,20 @@ func (h *DesireAppHandler) updateDesiredApp(
 		return err
 	}
 
-	routes := existingLRP.Routes
-	if routes == nil {
-		routes = &models.Routes{}
+	var existingRoutes models.Routes
+	if existingLRP.Routes != nil {
+		existingRoutes = *existingLRP.Routes
 	}
+	routes := helpers.MergeRoutes(existingRoutes, updateRoutes)
 
-	if value, ok := updateRoutes[cfroutes.CF_ROUTER]; ok {
-		(*routes)[cfroutes.CF_ROUTER] = value
-	}
-	if value, ok := updateRoutes[tcp_routes.TCP_ROUTER]; ok {
-		(*routes)[tcp_routes.TCP_ROUTER] = value
-	}
 	instances := int32(desireAppMessage.NumInstances)
 	updateRequest := &models.DesiredLRPUpdate{
 		Annotation: &desireAppMessage.ETag,
 		Instances:  &instances,
-		Routes:     routes,
+		Routes:     &routes,
 	}
 
-	logger.Debug("updating-desired-lrp", lager.Data{"routes": sanitizeRoutes(existingLRP.Routes)})
+	logger.Debug("updating-desired-lrp", lager.Data{"routes": sanitizeRoutes(&routes)})
 	err = h.bbsClient.UpdateDesiredLRP(logger, desireAppMessage.ProcessGuid, updateRequest)
 	if err != nil {
 		logger.Error("failed-to-update-lrp", err)
@@ -203,8 +202,9 @@ func sanitizeRoutes(routes *models.Routes) *models.Routes {
 	newRoutes := make(models.Routes)
 	if routes != nil {
 		cfRoutes := *routes
-		newRoutes[cfroutes.CF_ROUTER] = cfRoutes[cfroutes.CF_ROUTER]
-		newRoutes[tcp_routes.TCP_ROUTER] = cfRoutes[tcp_routes.TCP_ROUTER]
+		for _, key := range helpers.CCRouteKeys() {
+			newRoutes[key] = cfRoutes[key]
+		}
 	}
 	return &newRoutes
 }
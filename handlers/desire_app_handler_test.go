@@ -14,6 +14,7 @@ import (
 	"github.com/cloudfoundry-incubator/bbs/models"
 	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
 	"github.com/cloudfoundry-incubator/nsync/handlers"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 	"github.com/cloudfoundry-incubator/routing-info/cfroutes"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
@@ -96,7 +97,7 @@ var _ = Describe("DesireAppHandler", func() {
 		handler := handlers.NewDesireAppHandler(logger, fakeBBS, map[string]recipebuilder.RecipeBuilder{
 			"buildpack": buildpackBuilder,
 			"docker":    dockerBuilder,
-		})
+		}, "the-cc-apps")
 		handler.DesireApp(responseRecorder, request)
 	})
 
@@ -134,6 +135,11 @@ var _ = Describe("DesireAppHandler", func() {
 			Expect(buildpackBuilder.BuildArgsForCall(0)).To(Equal(&desireAppRequest))
 		})
 
+		It("desires the LRP in the configured domain", func() {
+			_, desiredLRP := fakeBBS.DesireLRPArgsForCall(0)
+			Expect(desiredLRP.Domain).To(Equal("the-cc-apps"))
+		})
+
 		It("responds with 202 Accepted", func() {
 			Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
 		})
@@ -201,6 +207,20 @@ var _ = Describe("DesireAppHandler", func() {
 			})
 		})
 
+		Context("when CC's routes are invalid", func() {
+			BeforeEach(func() {
+				buildpackBuilder.BuildReturns(nil, helpers.RouteValidationError{Problems: []string{`invalid hostname "-"`}})
+			})
+
+			It("does not desire the LRP", func() {
+				Consistently(fakeBBS.DesireLRPCallCount).Should(Equal(0))
+			})
+
+			It("responds with 400 Bad Request", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+
 		Context("when the LRP has docker image", func() {
 			var newlyDesiredDockerLRP *models.DesiredLRP
 
@@ -278,6 +298,24 @@ var _ = Describe("DesireAppHandler", func() {
 			Eventually(fakeBBS.DesiredLRPByProcessGuidCallCount).Should(Equal(1))
 		})
 
+		Context("when CC's routes are invalid", func() {
+			BeforeEach(func() {
+				routingInfo, err := cc_messages.CCHTTPRoutes{
+					{Hostname: "route1", Port: 9090},
+				}.CCRouteInfo()
+				Expect(err).NotTo(HaveOccurred())
+				desireAppRequest.RoutingInfo = routingInfo
+			})
+
+			It("does not update the LRP", func() {
+				Consistently(fakeBBS.UpdateDesiredLRPCallCount).Should(Equal(0))
+			})
+
+			It("responds with 400 Bad Request", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+
 		opaqueRoutingDataCheck := func(expectedRoutes cfroutes.CFRoutes) {
 			Eventually(fakeBBS.UpdateDesiredLRPCallCount).Should(Equal(1))
 
@@ -6,26 +6,33 @@ import (
 	"net/http"
 
 	"github.com/cloudfoundry-incubator/bbs"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/pivotal-golang/lager"
 )
 
 type TaskHandler struct {
-	logger         lager.Logger
-	recipeBuilders map[string]recipebuilder.RecipeBuilder
-	bbsClient      bbs.Client
+	logger            lager.Logger
+	recipeBuilders    map[string]recipebuilder.RecipeBuilder
+	bbsClient         bbs.Client
+	callbackAllowlist *helpers.CallbackAllowlist
+	taskDomain        string
 }
 
 func NewTaskHandler(
 	logger lager.Logger,
 	bbsClient bbs.Client,
 	recipeBuilders map[string]recipebuilder.RecipeBuilder,
+	callbackAllowlist *helpers.CallbackAllowlist,
+	taskDomain string,
 ) TaskHandler {
 	return TaskHandler{
-		logger:         logger,
-		recipeBuilders: recipeBuilders,
-		bbsClient:      bbsClient,
+		logger:            logger,
+		recipeBuilders:    recipeBuilders,
+		bbsClient:         bbsClient,
+		callbackAllowlist: callbackAllowlist,
+		taskDomain:        taskDomain,
 	}
 }
 
@@ -46,6 +53,13 @@ func (h *TaskHandler) DesireTask(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	err = h.callbackAllowlist.Validate(task.CompletionCallbackUrl)
+	if err != nil {
+		logger.Error("callback-url-not-allowed", err, lager.Data{"task-guid": task.TaskGuid})
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	builder, ok := h.recipeBuilders[task.Lifecycle]
 	if !ok {
 		logger.Error("builder-not-found", errors.New("no-builder"), lager.Data{"lifecycle": task.Lifecycle})
@@ -61,7 +75,7 @@ func (h *TaskHandler) DesireTask(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	logger.Info("desiring-task", lager.Data{"task-guid": task.TaskGuid})
-	err = h.bbsClient.DesireTask(logger, task.TaskGuid, cc_messages.RunningTaskDomain, desiredTask)
+	err = h.bbsClient.DesireTask(logger, task.TaskGuid, h.taskDomain, desiredTask)
 	if err != nil {
 		logger.Error("desire-task-failed", err)
 		resp.WriteHeader(http.StatusBadRequest)
@@ -12,6 +12,7 @@ import (
 	"github.com/cloudfoundry-incubator/bbs/models"
 	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
 	"github.com/cloudfoundry-incubator/nsync/handlers"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/pivotal-golang/lager/lagertest"
@@ -23,10 +24,11 @@ import (
 
 var _ = Describe("DesireTaskHandler", func() {
 	var (
-		logger           *lagertest.TestLogger
-		fakeBBSClient    *fake_bbs.FakeClient
-		buildpackBuilder *fakes.FakeRecipeBuilder
-		taskRequest      cc_messages.TaskRequestFromCC
+		logger            *lagertest.TestLogger
+		fakeBBSClient     *fake_bbs.FakeClient
+		buildpackBuilder  *fakes.FakeRecipeBuilder
+		taskRequest       cc_messages.TaskRequestFromCC
+		callbackAllowlist *helpers.CallbackAllowlist
 
 		request          *http.Request
 		responseRecorder *httptest.ResponseRecorder
@@ -38,6 +40,7 @@ var _ = Describe("DesireTaskHandler", func() {
 		logger = lagertest.NewTestLogger("test")
 		fakeBBSClient = new(fake_bbs.FakeClient)
 		buildpackBuilder = new(fakes.FakeRecipeBuilder)
+		callbackAllowlist = nil
 
 		taskRequest = cc_messages.TaskRequestFromCC{
 			TaskGuid:  "the-task-guid",
@@ -72,7 +75,7 @@ var _ = Describe("DesireTaskHandler", func() {
 
 		handler := handlers.NewTaskHandler(logger, fakeBBSClient, map[string]recipebuilder.RecipeBuilder{
 			"test": buildpackBuilder,
-		})
+		}, callbackAllowlist, cc_messages.RunningTaskDomain)
 		handler.DesireTask(responseRecorder, request)
 	})
 
@@ -143,6 +146,36 @@ var _ = Describe("DesireTaskHandler", func() {
 			})
 		})
 
+		Context("when the completion callback url is not allowed", func() {
+			BeforeEach(func() {
+				var err error
+				callbackAllowlist, err = helpers.NewCallbackAllowlist([]string{"https://cc.internal"})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("responds with a 400 Bad Request", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			})
+
+			It("does not build or desire the task", func() {
+				Expect(buildpackBuilder.BuildTaskCallCount()).To(Equal(0))
+				Expect(fakeBBSClient.DesireTaskCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the completion callback url is allowed", func() {
+			BeforeEach(func() {
+				var err error
+				callbackAllowlist, err = helpers.NewCallbackAllowlist([]string{"http://api.cc.com"})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("desires the task", func() {
+				Expect(fakeBBSClient.DesireTaskCallCount()).To(Equal(1))
+				Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+			})
+		})
+
 		Context("when there is an error building the task definition", func() {
 			BeforeEach(func() {
 				buildpackBuilder.BuildTaskReturns(nil, errors.New("boom!"))
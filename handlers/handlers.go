@@ -5,16 +5,25 @@ import (
 
 	"github.com/cloudfoundry-incubator/bbs"
 	"github.com/cloudfoundry-incubator/nsync"
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
 	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 	"github.com/pivotal-golang/lager"
 	"github.com/tedsuo/rata"
 )
 
-func New(logger lager.Logger, bbsClient bbs.Client, recipebuilders map[string]recipebuilder.RecipeBuilder) http.Handler {
-	desireAppHandler := NewDesireAppHandler(logger, bbsClient, recipebuilders)
-	stopAppHandler := NewStopAppHandler(logger, bbsClient)
+func New(
+	logger lager.Logger,
+	bbsClient bbs.Client,
+	recipebuilders map[string]recipebuilder.RecipeBuilder,
+	callbackAllowlist *helpers.CallbackAllowlist,
+	lrpDomain, taskDomain string,
+	keyStore recipebuilder.SSHKeyStore,
+) http.Handler {
+	desireAppHandler := NewDesireAppHandler(logger, bbsClient, recipebuilders, lrpDomain)
+	stopAppHandler := NewStopAppHandler(logger, bbsClient, keyStore)
 	killIndexHandler := NewKillIndexHandler(logger, bbsClient)
-	taskHandler := NewTaskHandler(logger, bbsClient, recipebuilders)
+	taskHandler := NewTaskHandler(logger, bbsClient, recipebuilders, callbackAllowlist, taskDomain)
 	cancelTaskHandler := NewCancelTaskHandler(logger, bbsClient)
 
 	actions := rata.Handlers{
@@ -32,3 +41,52 @@ func New(logger lager.Logger, bbsClient bbs.Client, recipebuilders map[string]re
 
 	return handler
 }
+
+func NewAdmin(
+	logger lager.Logger,
+	lrpSyncer, taskSyncer bulk.SyncController,
+	failureStore bulk.TaskFailureStore,
+	reload func() ([]string, error),
+	keyStore recipebuilder.SSHKeyStore,
+) http.Handler {
+	syncHandler := NewSyncHandler(logger, lrpSyncer, taskSyncer)
+	taskFailureHandler := NewTaskFailureHandler(logger, failureStore)
+	reloadHandler := NewReloadHandler(logger, reload)
+	sshKeysHandler := NewSSHKeysHandler(logger, keyStore)
+
+	actions := rata.Handlers{
+		nsync.SyncStatusRoute: http.HandlerFunc(syncHandler.Status),
+		nsync.SyncLRPsRoute:   http.HandlerFunc(syncHandler.SyncLRPs),
+		nsync.SyncTasksRoute:  http.HandlerFunc(syncHandler.SyncTasks),
+		nsync.PauseSyncRoute:  http.HandlerFunc(syncHandler.Pause),
+		nsync.ResumeSyncRoute: http.HandlerFunc(syncHandler.Resume),
+
+		nsync.TaskFailureRoute: http.HandlerFunc(taskFailureHandler.TaskFailure),
+
+		nsync.ReloadConfigRoute: http.HandlerFunc(reloadHandler.Reload),
+
+		nsync.RotateSSHKeysRoute: http.HandlerFunc(sshKeysHandler.Rotate),
+	}
+
+	handler, err := rata.NewRouter(nsync.BulkerRoutes, actions)
+	if err != nil {
+		panic("unable to create router: " + err.Error())
+	}
+
+	return handler
+}
+
+func NewListenerAdmin(logger lager.Logger, reload func() ([]string, error)) http.Handler {
+	reloadHandler := NewReloadHandler(logger, reload)
+
+	actions := rata.Handlers{
+		nsync.ReloadConfigRoute: http.HandlerFunc(reloadHandler.Reload),
+	}
+
+	handler, err := rata.NewRouter(nsync.ListenerAdminRoutes, actions)
+	if err != nil {
+		panic("unable to create router: " + err.Error())
+	}
+
+	return handler
+}
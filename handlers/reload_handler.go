@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pivotal-golang/lager"
+)
+
+type ReloadResult struct {
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type ReloadHandler struct {
+	logger lager.Logger
+	reload func() ([]string, error)
+}
+
+func NewReloadHandler(logger lager.Logger, reload func() ([]string, error)) ReloadHandler {
+	return ReloadHandler{
+		logger: logger,
+		reload: reload,
+	}
+}
+
+// Reload re-reads the configuration file and reports what changed. A
+// configuration that fails to load is rejected and the previous one stays in
+// effect.
+func (h *ReloadHandler) Reload(resp http.ResponseWriter, req *http.Request) {
+	logger := h.logger.Session("reload-config")
+	logger.Info("reloading")
+
+	status := http.StatusOK
+	result := ReloadResult{Changes: []string{}}
+
+	changes, err := h.reload()
+	if err != nil {
+		logger.Error("failed-to-reload", err)
+		status = http.StatusUnprocessableEntity
+		result.Error = err.Error()
+	} else if changes != nil {
+		result.Changes = changes
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("failed-to-marshal-reload-result", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(payload)
+}
@@ -0,0 +1,81 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/cloudfoundry-incubator/nsync/handlers"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReloadHandler", func() {
+	var (
+		logger      *lagertest.TestLogger
+		changes     []string
+		reloadErr   error
+		reloadCalls int
+
+		responseRecorder *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		changes = nil
+		reloadErr = nil
+		reloadCalls = 0
+		responseRecorder = httptest.NewRecorder()
+	})
+
+	JustBeforeEach(func() {
+		handler := handlers.NewReloadHandler(logger, func() ([]string, error) {
+			reloadCalls++
+			return changes, reloadErr
+		})
+
+		request, err := http.NewRequest("POST", "", nil)
+		Expect(err).NotTo(HaveOccurred())
+		handler.Reload(responseRecorder, request)
+	})
+
+	decode := func() handlers.ReloadResult {
+		var result handlers.ReloadResult
+		err := json.Unmarshal(responseRecorder.Body.Bytes(), &result)
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	Context("when the config reloads", func() {
+		BeforeEach(func() {
+			changes = []string{`fileServerURL: "a" -> "b"`}
+		})
+
+		It("responds with what changed", func() {
+			Expect(reloadCalls).To(Equal(1))
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(decode()).To(Equal(handlers.ReloadResult{Changes: changes}))
+		})
+	})
+
+	Context("when nothing changed", func() {
+		It("responds with no changes", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(decode().Changes).To(BeEmpty())
+		})
+	})
+
+	Context("when the config fails to reload", func() {
+		BeforeEach(func() {
+			reloadErr = errors.New("fileServerURL is required")
+		})
+
+		It("responds with the error", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(decode().Error).To(Equal("fileServerURL is required"))
+		})
+	})
+})
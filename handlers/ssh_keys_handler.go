@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	"github.com/pivotal-golang/lager"
+)
+
+type SSHKeysRotation struct {
+	HostFingerprint string `json:"host_fingerprint"`
+}
+
+type SSHKeysHandler struct {
+	logger   lager.Logger
+	keyStore recipebuilder.SSHKeyStore
+}
+
+func NewSSHKeysHandler(logger lager.Logger, keyStore recipebuilder.SSHKeyStore) SSHKeysHandler {
+	return SSHKeysHandler{
+		logger:   logger,
+		keyStore: keyStore,
+	}
+}
+
+// Rotate replaces the SSH keys of the given LRP in the key store and responds
+// with the new host fingerprint. It only applies to the LRP once it is
+// recreated: BBS cannot update a running LRP's actions, and updates for CC's
+// ETags leave its diego-ssh route and action alone, so it keeps serving its
+// old keys until it is desired again, e.g. when the app is restaged or
+// restarted, or when the bulker migrates its recipe.
+func (h *SSHKeysHandler) Rotate(resp http.ResponseWriter, req *http.Request) {
+	processGuid := req.FormValue(":process_guid")
+	logger := h.logger.Session("rotate-ssh-keys", lager.Data{"process-guid": processGuid})
+
+	if h.keyStore == nil {
+		logger.Info("no-ssh-key-store")
+		resp.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	sshKeys, err := h.keyStore.Rotate(processGuid)
+	if err != nil {
+		logger.Error("failed-to-rotate-ssh-keys", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("rotated-ssh-keys", lager.Data{"host-fingerprint": sshKeys.HostFingerprint})
+
+	payload, err := json.Marshal(SSHKeysRotation{HostFingerprint: sshKeys.HostFingerprint})
+	if err != nil {
+		logger.Error("failed-to-marshal-ssh-keys-rotation", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(payload)
+}
@@ -0,0 +1,86 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
+	"github.com/cloudfoundry-incubator/nsync/handlers"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SSHKeysHandler", func() {
+	var (
+		logger   *lagertest.TestLogger
+		keyStore *fakes.FakeSSHKeyStore
+		handler  handlers.SSHKeysHandler
+
+		request          *http.Request
+		responseRecorder *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		keyStore = new(fakes.FakeSSHKeyStore)
+		handler = handlers.NewSSHKeysHandler(logger, keyStore)
+		responseRecorder = httptest.NewRecorder()
+
+		var err error
+		request, err = http.NewRequest("POST", "", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Form = url.Values{
+			":process_guid": []string{"some-guid"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		handler.Rotate(responseRecorder, request)
+	})
+
+	Context("when the keys are rotated", func() {
+		BeforeEach(func() {
+			keyStore.RotateReturns(recipebuilder.SSHKeys{
+				HostPrivateKey:  "private-key",
+				HostFingerprint: "new-fingerprint",
+			}, nil)
+		})
+
+		It("responds with the new host fingerprint only", func() {
+			Expect(keyStore.RotateArgsForCall(0)).To(Equal("some-guid"))
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+
+			var rotation handlers.SSHKeysRotation
+			err := json.Unmarshal(responseRecorder.Body.Bytes(), &rotation)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rotation).To(Equal(handlers.SSHKeysRotation{HostFingerprint: "new-fingerprint"}))
+			Expect(responseRecorder.Body.String()).NotTo(ContainSubstring("private-key"))
+		})
+	})
+
+	Context("when rotating fails", func() {
+		BeforeEach(func() {
+			keyStore.RotateReturns(recipebuilder.SSHKeys{}, errors.New("boom"))
+		})
+
+		It("responds with 500 Internal Server Error", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
+		})
+	})
+
+	Context("when there is no key store", func() {
+		BeforeEach(func() {
+			handler = handlers.NewSSHKeysHandler(logger, nil)
+		})
+
+		It("responds with 501 Not Implemented", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusNotImplemented))
+		})
+	})
+})
@@ -5,18 +5,21 @@ import (
 
 	"github.com/cloudfoundry-incubator/bbs"
 	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
 	"github.com/pivotal-golang/lager"
 )
 
 type StopAppHandler struct {
 	bbsClient bbs.Client
+	keyStore  recipebuilder.SSHKeyStore
 	logger    lager.Logger
 }
 
-func NewStopAppHandler(logger lager.Logger, bbsClient bbs.Client) *StopAppHandler {
+func NewStopAppHandler(logger lager.Logger, bbsClient bbs.Client, keyStore recipebuilder.SSHKeyStore) *StopAppHandler {
 	return &StopAppHandler{
 		logger:    logger,
 		bbsClient: bbsClient,
+		keyStore:  keyStore,
 	}
 }
 
@@ -45,6 +48,7 @@ func (h *StopAppHandler) StopApp(resp http.ResponseWriter, req *http.Request) {
 
 		bbsError := models.ConvertError(err)
 		if bbsError.Type == models.Error_ResourceNotFound {
+			h.deleteSSHKeys(logger, processGuid)
 			resp.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -54,5 +58,21 @@ func (h *StopAppHandler) StopApp(resp http.ResponseWriter, req *http.Request) {
 	}
 	logger.Debug("removed-desired-lrp")
 
+	h.deleteSSHKeys(logger, processGuid)
+
 	resp.WriteHeader(http.StatusAccepted)
 }
+
+// deleteSSHKeys drops the keys of a removed LRP, so that the key store does
+// not keep one pair per stopped app. Failing to is logged but does not fail
+// the request, as the LRP is already gone.
+func (h *StopAppHandler) deleteSSHKeys(logger lager.Logger, processGuid string) {
+	if h.keyStore == nil {
+		return
+	}
+
+	err := h.keyStore.Delete(processGuid)
+	if err != nil {
+		logger.Error("failed-deleting-ssh-keys", err)
+	}
+}
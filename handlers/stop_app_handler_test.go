@@ -8,6 +8,7 @@ import (
 
 	"github.com/cloudfoundry-incubator/bbs/fake_bbs"
 	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
 	"github.com/cloudfoundry-incubator/nsync/handlers"
 	"github.com/pivotal-golang/lager/lagertest"
 
@@ -17,8 +18,9 @@ import (
 
 var _ = Describe("StopAppHandler", func() {
 	var (
-		logger  *lagertest.TestLogger
-		fakeBBS *fake_bbs.FakeClient
+		logger      *lagertest.TestLogger
+		fakeBBS     *fake_bbs.FakeClient
+		sshKeyStore *fakes.FakeSSHKeyStore
 
 		request          *http.Request
 		responseRecorder *httptest.ResponseRecorder
@@ -27,6 +29,7 @@ var _ = Describe("StopAppHandler", func() {
 	BeforeEach(func() {
 		logger = lagertest.NewTestLogger("test")
 		fakeBBS = new(fake_bbs.FakeClient)
+		sshKeyStore = new(fakes.FakeSSHKeyStore)
 
 		responseRecorder = httptest.NewRecorder()
 
@@ -39,7 +42,7 @@ var _ = Describe("StopAppHandler", func() {
 	})
 
 	JustBeforeEach(func() {
-		stopAppHandler := handlers.NewStopAppHandler(logger, fakeBBS)
+		stopAppHandler := handlers.NewStopAppHandler(logger, fakeBBS, sshKeyStore)
 		stopAppHandler.StopApp(responseRecorder, request)
 	})
 
@@ -53,6 +56,21 @@ var _ = Describe("StopAppHandler", func() {
 		Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
 	})
 
+	It("deletes the app's SSH keys", func() {
+		Expect(sshKeyStore.DeleteCallCount()).To(Equal(1))
+		Expect(sshKeyStore.DeleteArgsForCall(0)).To(Equal("process-guid"))
+	})
+
+	Context("when deleting the SSH keys fails", func() {
+		BeforeEach(func() {
+			sshKeyStore.DeleteReturns(errors.New("disk full"))
+		})
+
+		It("still responds with 202 Accepted", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+		})
+	})
+
 	Context("when the bbs fails", func() {
 		BeforeEach(func() {
 			fakeBBS.RemoveDesiredLRPReturns(errors.New("oh no"))
@@ -61,6 +79,10 @@ var _ = Describe("StopAppHandler", func() {
 		It("responds with a ServiceUnavailabe error", func() {
 			Expect(responseRecorder.Code).To(Equal(http.StatusServiceUnavailable))
 		})
+
+		It("keeps the app's SSH keys", func() {
+			Expect(sshKeyStore.DeleteCallCount()).To(Equal(0))
+		})
 	})
 
 	Context("when the process guid is missing", func() {
@@ -85,5 +107,9 @@ var _ = Describe("StopAppHandler", func() {
 		It("responds with a 404", func() {
 			Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
 		})
+
+		It("deletes any SSH keys left for it", func() {
+			Expect(sshKeyStore.DeleteCallCount()).To(Equal(1))
+		})
 	})
 })
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/pivotal-golang/lager"
+)
+
+type SyncStatus struct {
+	LRPsPaused  bool `json:"lrps_paused"`
+	TasksPaused bool `json:"tasks_paused"`
+}
+
+type SyncHandler struct {
+	logger     lager.Logger
+	lrpSyncer  bulk.SyncController
+	taskSyncer bulk.SyncController
+}
+
+func NewSyncHandler(logger lager.Logger, lrpSyncer, taskSyncer bulk.SyncController) SyncHandler {
+	return SyncHandler{
+		logger:     logger,
+		lrpSyncer:  lrpSyncer,
+		taskSyncer: taskSyncer,
+	}
+}
+
+func (h *SyncHandler) Status(resp http.ResponseWriter, req *http.Request) {
+	logger := h.logger.Session("sync-status")
+	h.writeStatus(logger, resp)
+}
+
+func (h *SyncHandler) SyncLRPs(resp http.ResponseWriter, req *http.Request) {
+	logger := h.logger.Session("sync-lrps")
+
+	if h.lrpSyncer.Paused() {
+		logger.Info("rejected-while-paused")
+		resp.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	logger.Info("triggering")
+	h.lrpSyncer.Trigger()
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func (h *SyncHandler) SyncTasks(resp http.ResponseWriter, req *http.Request) {
+	logger := h.logger.Session("sync-tasks")
+
+	if h.taskSyncer.Paused() {
+		logger.Info("rejected-while-paused")
+		resp.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	logger.Info("triggering")
+	h.taskSyncer.Trigger()
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func (h *SyncHandler) Pause(resp http.ResponseWriter, req *http.Request) {
+	logger := h.logger.Session("pause-sync")
+	logger.Info("pausing")
+
+	h.lrpSyncer.Pause()
+	h.taskSyncer.Pause()
+
+	h.writeStatus(logger, resp)
+}
+
+func (h *SyncHandler) Resume(resp http.ResponseWriter, req *http.Request) {
+	logger := h.logger.Session("resume-sync")
+	logger.Info("resuming")
+
+	h.lrpSyncer.Resume()
+	h.taskSyncer.Resume()
+
+	h.writeStatus(logger, resp)
+}
+
+func (h *SyncHandler) writeStatus(logger lager.Logger, resp http.ResponseWriter) {
+	payload, err := json.Marshal(SyncStatus{
+		LRPsPaused:  h.lrpSyncer.Paused(),
+		TasksPaused: h.taskSyncer.Paused(),
+	})
+	if err != nil {
+		logger.Error("failed-to-marshal-status", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(payload)
+}
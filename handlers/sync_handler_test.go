@@ -0,0 +1,139 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
+	"github.com/cloudfoundry-incubator/nsync/handlers"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SyncHandler", func() {
+	var (
+		logger     *lagertest.TestLogger
+		lrpSyncer  *fakes.FakeSyncController
+		taskSyncer *fakes.FakeSyncController
+
+		request          *http.Request
+		responseRecorder *httptest.ResponseRecorder
+		handler          handlers.SyncHandler
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		lrpSyncer = new(fakes.FakeSyncController)
+		taskSyncer = new(fakes.FakeSyncController)
+
+		responseRecorder = httptest.NewRecorder()
+
+		var err error
+		request, err = http.NewRequest("POST", "", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		handler = handlers.NewSyncHandler(logger, lrpSyncer, taskSyncer)
+	})
+
+	decodeStatus := func() handlers.SyncStatus {
+		status := handlers.SyncStatus{}
+		err := json.Unmarshal(responseRecorder.Body.Bytes(), &status)
+		Expect(err).NotTo(HaveOccurred())
+		return status
+	}
+
+	Describe("SyncLRPs", func() {
+		It("triggers an lrp sync", func() {
+			handler.SyncLRPs(responseRecorder, request)
+
+			Expect(lrpSyncer.TriggerCallCount()).To(Equal(1))
+			Expect(taskSyncer.TriggerCallCount()).To(Equal(0))
+		})
+
+		It("responds with 202 Accepted", func() {
+			handler.SyncLRPs(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+		})
+
+		Context("when lrp syncing is paused", func() {
+			BeforeEach(func() {
+				lrpSyncer.PausedReturns(true)
+			})
+
+			It("does not trigger a sync and responds with 409 Conflict", func() {
+				handler.SyncLRPs(responseRecorder, request)
+
+				Expect(lrpSyncer.TriggerCallCount()).To(Equal(0))
+				Expect(responseRecorder.Code).To(Equal(http.StatusConflict))
+			})
+		})
+	})
+
+	Describe("SyncTasks", func() {
+		It("triggers a task sync", func() {
+			handler.SyncTasks(responseRecorder, request)
+
+			Expect(taskSyncer.TriggerCallCount()).To(Equal(1))
+			Expect(lrpSyncer.TriggerCallCount()).To(Equal(0))
+			Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+		})
+
+		Context("when task syncing is paused", func() {
+			BeforeEach(func() {
+				taskSyncer.PausedReturns(true)
+			})
+
+			It("does not trigger a sync and responds with 409 Conflict", func() {
+				handler.SyncTasks(responseRecorder, request)
+
+				Expect(taskSyncer.TriggerCallCount()).To(Equal(0))
+				Expect(responseRecorder.Code).To(Equal(http.StatusConflict))
+			})
+		})
+	})
+
+	Describe("Pause", func() {
+		BeforeEach(func() {
+			lrpSyncer.PausedReturns(true)
+			taskSyncer.PausedReturns(true)
+		})
+
+		It("pauses both syncers and reports the status", func() {
+			handler.Pause(responseRecorder, request)
+
+			Expect(lrpSyncer.PauseCallCount()).To(Equal(1))
+			Expect(taskSyncer.PauseCallCount()).To(Equal(1))
+
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(decodeStatus()).To(Equal(handlers.SyncStatus{LRPsPaused: true, TasksPaused: true}))
+		})
+	})
+
+	Describe("Resume", func() {
+		It("resumes both syncers and reports the status", func() {
+			handler.Resume(responseRecorder, request)
+
+			Expect(lrpSyncer.ResumeCallCount()).To(Equal(1))
+			Expect(taskSyncer.ResumeCallCount()).To(Equal(1))
+
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(decodeStatus()).To(Equal(handlers.SyncStatus{LRPsPaused: false, TasksPaused: false}))
+		})
+	})
+
+	Describe("Status", func() {
+		BeforeEach(func() {
+			taskSyncer.PausedReturns(true)
+		})
+
+		It("reports whether each syncer is paused", func() {
+			handler.Status(responseRecorder, request)
+
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(decodeStatus()).To(Equal(handlers.SyncStatus{LRPsPaused: false, TasksPaused: true}))
+		})
+	})
+})
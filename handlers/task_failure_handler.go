@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/pivotal-golang/lager"
+)
+
+type TaskFailureHandler struct {
+	logger       lager.Logger
+	failureStore bulk.TaskFailureStore
+}
+
+func NewTaskFailureHandler(logger lager.Logger, failureStore bulk.TaskFailureStore) TaskFailureHandler {
+	return TaskFailureHandler{
+		logger:       logger,
+		failureStore: failureStore,
+	}
+}
+
+// TaskFailure reports whether, when and why nsync failed the given task.
+func (h *TaskFailureHandler) TaskFailure(resp http.ResponseWriter, req *http.Request) {
+	taskGuid := req.FormValue(":task_guid")
+	logger := h.logger.Session("task-failure", lager.Data{"task-guid": taskGuid})
+
+	record, found, err := h.failureStore.Lookup(taskGuid)
+	if err != nil {
+		logger.Error("failed-to-look-up-task-failure", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	payload, err := json.Marshal(record)
+	if err != nil {
+		logger.Error("failed-to-marshal-task-failure", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(payload)
+}
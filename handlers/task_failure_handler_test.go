@@ -0,0 +1,85 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/cloudfoundry-incubator/nsync/bulk"
+	"github.com/cloudfoundry-incubator/nsync/bulk/fakes"
+	"github.com/cloudfoundry-incubator/nsync/handlers"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TaskFailureHandler", func() {
+	var (
+		logger       *lagertest.TestLogger
+		failureStore *fakes.FakeTaskFailureStore
+
+		request          *http.Request
+		responseRecorder *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		failureStore = new(fakes.FakeTaskFailureStore)
+		responseRecorder = httptest.NewRecorder()
+
+		var err error
+		request, err = http.NewRequest("GET", "", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Form = url.Values{
+			":task_guid": []string{"some-guid"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		handler := handlers.NewTaskFailureHandler(logger, failureStore)
+		handler.TaskFailure(responseRecorder, request)
+	})
+
+	Context("when nsync failed the task", func() {
+		var record bulk.TaskFailureRecord
+
+		BeforeEach(func() {
+			record = bulk.TaskFailureRecord{
+				TaskGuid:      "some-guid",
+				Reason:        bulk.TaskMissingFromBBS,
+				FailureReason: bulk.TaskMissingFromBBS.Message(),
+				Attempts:      1,
+			}
+			failureStore.LookupReturns(record, true, nil)
+		})
+
+		It("responds with the failure record", func() {
+			Expect(failureStore.LookupArgsForCall(0)).To(Equal("some-guid"))
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+
+			returned := bulk.TaskFailureRecord{}
+			err := json.Unmarshal(responseRecorder.Body.Bytes(), &returned)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(returned).To(Equal(record))
+		})
+	})
+
+	Context("when nsync has not failed the task", func() {
+		It("responds with 404 Not Found", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Context("when the lookup fails", func() {
+		BeforeEach(func() {
+			failureStore.LookupReturns(bulk.TaskFailureRecord{}, false, errors.New("boom"))
+		})
+
+		It("responds with 500 Internal Server Error", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
+		})
+	})
+})
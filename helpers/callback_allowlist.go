@@ -0,0 +1,114 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var ErrCallbackURLNotAllowed = errors.New("completion callback url is not allowed")
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// CallbackAllowlist restricts the completion callback URLs nsync will accept
+// from CC. Each entry is scheme://host[:port]; a host of the form *.domain
+// matches any subdomain of domain, and an entry without a port matches any
+// port. URLs without a port use their scheme's default port, so
+// https://host matches https://host:443. A nil or empty allowlist allows
+// every URL.
+type CallbackAllowlist struct {
+	entries []callbackAllowlistEntry
+}
+
+type callbackAllowlistEntry struct {
+	scheme string
+	host   string
+	port   string
+}
+
+func NewCallbackAllowlist(entries []string) (*CallbackAllowlist, error) {
+	allowlist := &CallbackAllowlist{}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parsed, err := url.Parse(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid callback allowlist entry %q: expected scheme://host[:port]", entry)
+		}
+
+		host, port := splitHostPort(parsed.Host)
+		allowlist.entries = append(allowlist.entries, callbackAllowlistEntry{
+			scheme: strings.ToLower(parsed.Scheme),
+			host:   strings.ToLower(host),
+			port:   port,
+		})
+	}
+
+	return allowlist, nil
+}
+
+// Validate returns ErrCallbackURLNotAllowed unless the callback URL matches an
+// entry. An empty callback URL is allowed, as no callback will be made.
+func (a *CallbackAllowlist) Validate(callbackURL string) error {
+	if a == nil || len(a.entries) == 0 || callbackURL == "" {
+		return nil
+	}
+
+	parsed, err := url.Parse(callbackURL)
+	if err != nil {
+		return ErrCallbackURLNotAllowed
+	}
+
+	scheme := strings.ToLower(parsed.Scheme)
+	host, port := splitHostPort(parsed.Host)
+	host = strings.ToLower(host)
+	if port == "" {
+		port = defaultPorts[scheme]
+	}
+
+	for _, entry := range a.entries {
+		if entry.matches(scheme, host, port) {
+			return nil
+		}
+	}
+
+	return ErrCallbackURLNotAllowed
+}
+
+func (e callbackAllowlistEntry) matches(scheme, host, port string) bool {
+	if e.scheme != scheme {
+		return false
+	}
+
+	if e.port != "" && e.port != port {
+		return false
+	}
+
+	if strings.HasPrefix(e.host, "*.") {
+		return strings.HasSuffix(host, e.host[1:])
+	}
+
+	return e.host == host
+}
+
+func splitHostPort(hostPort string) (string, string) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort, ""
+	}
+
+	return host, port
+}
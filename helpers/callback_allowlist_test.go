@@ -0,0 +1,67 @@
+package helpers_test
+
+import (
+	"github.com/cloudfoundry-incubator/nsync/helpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CallbackAllowlist", func() {
+	var allowlist *helpers.CallbackAllowlist
+
+	BeforeEach(func() {
+		var err error
+		allowlist, err = helpers.NewCallbackAllowlist([]string{
+			"https://cloud-controller-ng.service.cf.internal:9023",
+			"https://*.cc.example.com",
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("allows URLs matching an entry", func() {
+		Expect(allowlist.Validate("https://cloud-controller-ng.service.cf.internal:9023/internal/v3/tasks/guid/completed")).To(Succeed())
+		Expect(allowlist.Validate("https://api.cc.example.com/internal/v3/tasks/guid/completed")).To(Succeed())
+		Expect(allowlist.Validate("https://api.cc.example.com:8443/internal/v3/tasks/guid/completed")).To(Succeed())
+	})
+
+	It("rejects URLs with another scheme, host or port", func() {
+		Expect(allowlist.Validate("http://cloud-controller-ng.service.cf.internal:9023/completed")).To(MatchError(helpers.ErrCallbackURLNotAllowed))
+		Expect(allowlist.Validate("https://cloud-controller-ng.service.cf.internal:9024/completed")).To(MatchError(helpers.ErrCallbackURLNotAllowed))
+		Expect(allowlist.Validate("https://169.254.169.254/latest/meta-data")).To(MatchError(helpers.ErrCallbackURLNotAllowed))
+		Expect(allowlist.Validate("https://cc.example.com.evil.com/completed")).To(MatchError(helpers.ErrCallbackURLNotAllowed))
+	})
+
+	It("treats a missing port as the scheme's default port", func() {
+		allowlist, err := helpers.NewCallbackAllowlist([]string{
+			"https://cc.internal:443",
+			"http://plain.internal",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(allowlist.Validate("https://cc.internal/completed")).To(Succeed())
+		Expect(allowlist.Validate("https://cc.internal:443/completed")).To(Succeed())
+		Expect(allowlist.Validate("http://cc.internal/completed")).To(MatchError(helpers.ErrCallbackURLNotAllowed))
+		Expect(allowlist.Validate("http://plain.internal:80/completed")).To(Succeed())
+	})
+
+	It("allows an empty callback URL", func() {
+		Expect(allowlist.Validate("")).To(Succeed())
+	})
+
+	Context("when the allowlist is empty", func() {
+		BeforeEach(func() {
+			allowlist = nil
+		})
+
+		It("allows every URL", func() {
+			Expect(allowlist.Validate("http://anywhere.example.com")).To(Succeed())
+		})
+	})
+
+	Context("when an entry is not a URL", func() {
+		It("returns an error", func() {
+			_, err := helpers.NewCallbackAllowlist([]string{"cc.example.com"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
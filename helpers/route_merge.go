@@ -0,0 +1,46 @@
+package helpers
+
+import "github.com/cloudfoundry-incubator/bbs/models"
+
+// CCRouteKeys returns the route keys whose values nsync takes from CC: the
+// router key of every registered RouteTranslator. Every other key belongs to
+// another system, such as diego-ssh, and is never changed when CC's routes
+// are.
+func CCRouteKeys() []string {
+	translators := registeredRouteTranslators()
+
+	keys := make([]string, 0, len(translators))
+	for _, translator := range translators {
+		keys = append(keys, translator.RouterKey)
+	}
+	return keys
+}
+
+func IsCCRouteKey(key string) bool {
+	for _, ccKey := range CCRouteKeys() {
+		if key == ccKey {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeRoutes returns the routes to update an LRP with: the CC owned keys of
+// ccRoutes and every other key of existing. Neither argument is modified.
+func MergeRoutes(existing, ccRoutes models.Routes) models.Routes {
+	merged := models.Routes{}
+
+	for key, value := range existing {
+		if !IsCCRouteKey(key) {
+			merged[key] = value
+		}
+	}
+
+	for key, value := range ccRoutes {
+		if IsCCRouteKey(key) {
+			merged[key] = value
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,67 @@
+package helpers_test
+
+import (
+	"encoding/json"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
+	"github.com/cloudfoundry-incubator/routing-info/cfroutes"
+	"github.com/cloudfoundry-incubator/routing-info/tcp_routes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MergeRoutes", func() {
+	var (
+		oldHttp, newHttp, oldTcp, newTcp, ssh, custom json.RawMessage
+
+		existing models.Routes
+	)
+
+	BeforeEach(func() {
+		oldHttp = json.RawMessage(`[{"hostnames":["old"],"port":8080}]`)
+		newHttp = json.RawMessage(`[{"hostnames":["new"],"port":8080}]`)
+		oldTcp = json.RawMessage(`[{"router_group_guid":"old","external_port":5222,"container_port":8080}]`)
+		newTcp = json.RawMessage(`[]`)
+		ssh = json.RawMessage(`{"container_port":2222}`)
+		custom = json.RawMessage(`{"some":"value"}`)
+
+		existing = models.Routes{
+			cfroutes.CF_ROUTER:    &oldHttp,
+			tcp_routes.TCP_ROUTER: &oldTcp,
+			"diego-ssh":           &ssh,
+			"custom-router":       &custom,
+		}
+	})
+
+	It("takes CC's routes and keeps every other system's", func() {
+		merged := helpers.MergeRoutes(existing, models.Routes{
+			cfroutes.CF_ROUTER:    &newHttp,
+			tcp_routes.TCP_ROUTER: &newTcp,
+		})
+
+		Expect(merged).To(Equal(models.Routes{
+			cfroutes.CF_ROUTER:    &newHttp,
+			tcp_routes.TCP_ROUTER: &newTcp,
+			"diego-ssh":           &ssh,
+			"custom-router":       &custom,
+		}))
+	})
+
+	It("ignores keys CC does not own in CC's routes", func() {
+		otherSsh := json.RawMessage(`{"container_port":2223}`)
+		merged := helpers.MergeRoutes(existing, models.Routes{"diego-ssh": &otherSsh})
+
+		Expect(merged["diego-ssh"]).To(Equal(&ssh))
+	})
+
+	It("does not modify the existing routes", func() {
+		helpers.MergeRoutes(existing, models.Routes{cfroutes.CF_ROUTER: &newHttp})
+		Expect(existing[cfroutes.CF_ROUTER]).To(Equal(&oldHttp))
+	})
+
+	It("handles an LRP without routes", func() {
+		merged := helpers.MergeRoutes(nil, models.Routes{cfroutes.CF_ROUTER: &newHttp})
+		Expect(merged).To(Equal(models.Routes{cfroutes.CF_ROUTER: &newHttp}))
+	})
+})
@@ -0,0 +1,82 @@
+package helpers
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/routing-info/cfroutes"
+	"github.com/cloudfoundry-incubator/routing-info/tcp_routes"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+)
+
+// RouteTranslator converts one type of CC route into the routes of the router
+// that serves it.
+type RouteTranslator struct {
+	// CCKey is the type's key in the routes CC sends.
+	CCKey string
+
+	// RouterKey is the key in the LRP's routes that the router reads.
+	RouterKey string
+
+	// Translate converts CC's routes, which are nil when CC sent none of
+	// this type, for an app exposing ports. Invalid routes are dropped and
+	// reported in a RouteValidationError, returned along with the routing
+	// info of the remaining routes.
+	Translate func(ccRoutes *json.RawMessage, ports []uint32) (*json.RawMessage, error)
+}
+
+var routeTranslators struct {
+	sync.RWMutex
+	list []RouteTranslator
+}
+
+func init() {
+	RegisterRouteTranslator(RouteTranslator{
+		CCKey:     cc_messages.CC_HTTP_ROUTES,
+		RouterKey: cfroutes.CF_ROUTER,
+		Translate: translateHttpRoutes,
+	})
+	RegisterRouteTranslator(RouteTranslator{
+		CCKey:     cc_messages.CC_TCP_ROUTES,
+		RouterKey: tcp_routes.TCP_ROUTER,
+		Translate: translateTcpRoutes,
+	})
+}
+
+// RegisterRouteTranslator adds a router type, replacing the translator
+// registered for the same CC key, if any. Its router key becomes CC owned, so
+// it is overwritten whenever CC's routes change.
+func RegisterRouteTranslator(translator RouteTranslator) {
+	routeTranslators.Lock()
+	defer routeTranslators.Unlock()
+
+	for i, registered := range routeTranslators.list {
+		if registered.CCKey == translator.CCKey {
+			routeTranslators.list[i] = translator
+			return
+		}
+	}
+
+	routeTranslators.list = append(routeTranslators.list, translator)
+}
+
+// UnregisterRouteTranslator removes the translator for a CC key. Routes of
+// that type are dropped from then on.
+func UnregisterRouteTranslator(ccKey string) {
+	routeTranslators.Lock()
+	defer routeTranslators.Unlock()
+
+	for i, registered := range routeTranslators.list {
+		if registered.CCKey == ccKey {
+			routeTranslators.list = append(routeTranslators.list[:i], routeTranslators.list[i+1:]...)
+			return
+		}
+	}
+}
+
+func registeredRouteTranslators() []RouteTranslator {
+	routeTranslators.RLock()
+	defer routeTranslators.RUnlock()
+
+	return append([]RouteTranslator{}, routeTranslators.list...)
+}
@@ -0,0 +1,138 @@
+package helpers_test
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/nsync/helpers"
+	"github.com/cloudfoundry-incubator/routing-info/cfroutes"
+	"github.com/cloudfoundry-incubator/routing-info/tcp_routes"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Route Translators", func() {
+	var (
+		udpRoutes  json.RawMessage
+		translated json.RawMessage
+		routeInfo  cc_messages.CCRouteInfo
+		translator helpers.RouteTranslator
+
+		translatedPorts []uint32
+	)
+
+	BeforeEach(func() {
+		udpRoutes = json.RawMessage(`[{"external_port":5353,"container_port":8080}]`)
+		translated = json.RawMessage(`[{"port":5353}]`)
+		routeInfo = cc_messages.CCRouteInfo{"udp_routes": &udpRoutes}
+		translatedPorts = nil
+
+		translator = helpers.RouteTranslator{
+			CCKey:     "udp_routes",
+			RouterKey: "udp-router",
+			Translate: func(ccRoutes *json.RawMessage, ports []uint32) (*json.RawMessage, error) {
+				translatedPorts = ports
+				if ccRoutes == nil {
+					empty := json.RawMessage(`[]`)
+					return &empty, nil
+				}
+				return &translated, nil
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		helpers.RegisterRouteTranslator(translator)
+	})
+
+	AfterEach(func() {
+		helpers.UnregisterRouteTranslator("udp_routes")
+	})
+
+	It("translates the router type's routes alongside http and tcp", func() {
+		routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(routes).To(HaveLen(3))
+		Expect(routes["udp-router"]).To(Equal(&translated))
+		Expect(routes).To(HaveKey(cfroutes.CF_ROUTER))
+		Expect(routes).To(HaveKey(tcp_routes.TCP_ROUTER))
+		Expect(translatedPorts).To(Equal([]uint32{8080}))
+	})
+
+	It("asks for the router's routes when CC sent none", func() {
+		routes, err := helpers.CCRouteInfoToRoutes(cc_messages.CCRouteInfo{}, []uint32{8080})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(routes["udp-router"]).To(MatchJSON(`[]`))
+	})
+
+	It("makes the router key CC owned", func() {
+		Expect(helpers.CCRouteKeys()).To(Equal([]string{cfroutes.CF_ROUTER, tcp_routes.TCP_ROUTER, "udp-router"}))
+
+		oldUdp := json.RawMessage(`[{"port":1}]`)
+		merged := helpers.MergeRoutes(models.Routes{"udp-router": &oldUdp}, models.Routes{"udp-router": &translated})
+		Expect(merged["udp-router"]).To(Equal(&translated))
+	})
+
+	It("drops the router type's routes once unregistered", func() {
+		helpers.UnregisterRouteTranslator("udp_routes")
+
+		routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).NotTo(HaveKey("udp-router"))
+		Expect(helpers.IsCCRouteKey("udp-router")).To(BeFalse())
+	})
+
+	Context("when the router type's routes are invalid", func() {
+		BeforeEach(func() {
+			translator.Translate = func(ccRoutes *json.RawMessage, ports []uint32) (*json.RawMessage, error) {
+				return nil, helpers.RouteValidationError{Problems: []string{"udp route 5353: port 8080 is not exposed by the app"}}
+			}
+
+			httpRoutes := json.RawMessage(`[{"hostname":"bad host","port":8080}]`)
+			routeInfo[cc_messages.CC_HTTP_ROUTES] = &httpRoutes
+		})
+
+		It("reports its problems with those of the other types", func() {
+			routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+			Expect(err).To(Equal(helpers.RouteValidationError{Problems: []string{
+				`invalid hostname "bad host"`,
+				"udp route 5353: port 8080 is not exposed by the app",
+			}}))
+
+			Expect(routes).To(HaveKey(cfroutes.CF_ROUTER))
+			Expect(routes).NotTo(HaveKey("udp-router"))
+		})
+	})
+
+	Context("when translating fails", func() {
+		BeforeEach(func() {
+			translator.Translate = func(ccRoutes *json.RawMessage, ports []uint32) (*json.RawMessage, error) {
+				return nil, errors.New("boom")
+			}
+		})
+
+		It("returns the error", func() {
+			_, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+			Expect(err).To(MatchError("boom"))
+		})
+	})
+
+	Context("when a translator is registered again for the same CC key", func() {
+		JustBeforeEach(func() {
+			replacement := translator
+			replacement.RouterKey = "other-udp-router"
+			helpers.RegisterRouteTranslator(replacement)
+		})
+
+		It("replaces the earlier translator", func() {
+			routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveKey("other-udp-router"))
+			Expect(routes).NotTo(HaveKey("udp-router"))
+		})
+	})
+})
@@ -0,0 +1,132 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+)
+
+const maxExternalPort = 65535
+
+// RouteValidationError reports every route from CC that nsync refuses to
+// desire. It is returned along with the routes that remain.
+type RouteValidationError struct {
+	Problems []string
+}
+
+func (e RouteValidationError) Error() string {
+	return "invalid routes: " + strings.Join(e.Problems, "; ")
+}
+
+// routeValidator collects the problems with a set of routes, checking
+// container ports against the ports the app exposes. Without exposed ports,
+// any container port is accepted.
+type routeValidator struct {
+	exposedPorts []uint32
+	problems     []string
+}
+
+func newRouteValidator(exposedPorts []uint32) *routeValidator {
+	return &routeValidator{exposedPorts: exposedPorts}
+}
+
+// Each check records the problem it finds and reports whether the route
+// passed, so that only the routes that fail are dropped.
+
+func (v *routeValidator) checkHostname(hostname string) bool {
+	if !validHostname(hostname) {
+		v.reject("invalid hostname %q", hostname)
+		return false
+	}
+	return true
+}
+
+func (v *routeValidator) checkContainerPort(route string, port uint32) bool {
+	if len(v.exposedPorts) == 0 {
+		return true
+	}
+
+	for _, exposed := range v.exposedPorts {
+		if port == exposed {
+			return true
+		}
+	}
+
+	v.reject("%s: port %d is not exposed by the app", route, port)
+	return false
+}
+
+func (v *routeValidator) checkExternalPort(route string, port uint32) bool {
+	if port == 0 || port > maxExternalPort {
+		v.reject("%s: external port %d is out of range", route, port)
+		return false
+	}
+	return true
+}
+
+func (v *routeValidator) checkRouterGroup(route string, routerGroupGuid string) bool {
+	if routerGroupGuid == "" {
+		v.reject("%s: router group guid is required", route)
+		return false
+	}
+	return true
+}
+
+func (v *routeValidator) reject(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	for _, existing := range v.problems {
+		if existing == problem {
+			return
+		}
+	}
+
+	v.problems = append(v.problems, problem)
+}
+
+func (v *routeValidator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	return RouteValidationError{Problems: v.problems}
+}
+
+// validHostname accepts DNS names, optionally with a leading wildcard label.
+// Underscores are allowed, as some CF domains use them.
+func validHostname(hostname string) bool {
+	if hostname == "" || len(hostname) > 253 {
+		return false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(hostname, "."), ".")
+	for i, label := range labels {
+		if i == 0 && label == "*" && len(labels) > 1 {
+			continue
+		}
+
+		if !validHostnameLabel(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validHostnameLabel(label string) bool {
+	if label == "" || len(label) > 63 {
+		return false
+	}
+
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
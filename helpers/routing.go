@@ -2,6 +2,8 @@ package helpers
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 
 	"github.com/cloudfoundry-incubator/bbs/models"
 	"github.com/cloudfoundry-incubator/routing-info/cfroutes"
@@ -14,7 +16,47 @@ type routingKey struct {
 	RouteServiceUrl string
 }
 
+// CCRouteInfoToRoutes converts CC's routes for an app exposing ports into
+// BBS routes, using the translator registered for each type of route. Types
+// without a translator are dropped. Routes that are invalid or use ports the
+// app does not expose are dropped too, and reported together in a
+// RouteValidationError returned along with the remaining routes, so that
+// callers that must not fail on one bad route can still apply the rest.
+// Duplicates are collapsed.
 func CCRouteInfoToRoutes(ccRoutes cc_messages.CCRouteInfo, ports []uint32) (models.Routes, error) {
+	routes := models.Routes{}
+	var problems []string
+
+	for _, translator := range registeredRouteTranslators() {
+		routingInfo, err := translator.Translate(ccRoutes[translator.CCKey], ports)
+		if validationErr, ok := err.(RouteValidationError); ok {
+			for _, problem := range validationErr.Problems {
+				if !containsString(problems, problem) {
+					problems = append(problems, problem)
+				}
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		if routingInfo != nil {
+			routes[translator.RouterKey] = routingInfo
+		}
+	}
+
+	if len(problems) > 0 {
+		return routes, RouteValidationError{Problems: problems}
+	}
+
+	return routes, nil
+}
+
+func translateHttpRoutes(ccRoutes *json.RawMessage, ports []uint32) (*json.RawMessage, error) {
+	if ccRoutes == nil {
+		cfRoutes := cfroutes.CFRoutes{}
+		return cfRoutes.RoutingInfo()[cfroutes.CF_ROUTER], nil
+	}
+
 	var defaultPort uint32
 	if len(ports) > 0 {
 		defaultPort = ports[0]
@@ -22,48 +64,60 @@ func CCRouteInfoToRoutes(ccRoutes cc_messages.CCRouteInfo, ports []uint32) (mode
 		defaultPort = 8080
 	}
 
-	routes := models.Routes{}
+	validator := newRouteValidator(ports)
 
-	if ccRoutes[cc_messages.CC_HTTP_ROUTES] != nil {
-		httpRoutingInfo, err := constructHttpRoutes(ccRoutes, defaultPort)
-		if err != nil {
-			return nil, err
-		}
-		routes[cfroutes.CF_ROUTER] = httpRoutingInfo[cfroutes.CF_ROUTER]
-	} else {
-		cfRoutes := cfroutes.CFRoutes{}
-		httpRoutingInfo := cfRoutes.RoutingInfo()
-		routes[cfroutes.CF_ROUTER] = httpRoutingInfo[cfroutes.CF_ROUTER]
+	httpRoutingInfo, err := constructHttpRoutes(ccRoutes, defaultPort, validator)
+	if err != nil {
+		return nil, err
 	}
 
-	if ccRoutes[cc_messages.CC_TCP_ROUTES] != nil {
-		tcpRoutingInfo, err := constructTcpRoutes(ccRoutes)
-		if err != nil {
-			return nil, err
-		}
-		routes[tcp_routes.TCP_ROUTER] = tcpRoutingInfo[tcp_routes.TCP_ROUTER]
-	} else {
+	return httpRoutingInfo[cfroutes.CF_ROUTER], validator.err()
+}
+
+func translateTcpRoutes(ccRoutes *json.RawMessage, ports []uint32) (*json.RawMessage, error) {
+	if ccRoutes == nil {
 		tcpRoutes := tcp_routes.TCPRoutes{}
-		tcpRoutingInfo := tcpRoutes.RoutingInfo()
-		routes[tcp_routes.TCP_ROUTER] = (*tcpRoutingInfo)[tcp_routes.TCP_ROUTER]
+		return (*tcpRoutes.RoutingInfo())[tcp_routes.TCP_ROUTER], nil
 	}
 
-	return routes, nil
+	validator := newRouteValidator(ports)
+
+	tcpRoutingInfo, err := constructTcpRoutes(ccRoutes, validator)
+	if err != nil {
+		return nil, err
+	}
+
+	return tcpRoutingInfo[tcp_routes.TCP_ROUTER], validator.err()
 }
 
-func constructTcpRoutes(ccRoutes cc_messages.CCRouteInfo) (models.Routes, error) {
+func constructTcpRoutes(ccRoutes *json.RawMessage, validator *routeValidator) (models.Routes, error) {
 	var ccTcpRoutes cc_messages.CCTCPRoutes
-	err := json.Unmarshal(*ccRoutes[cc_messages.CC_TCP_ROUTES], &ccTcpRoutes)
+	err := json.Unmarshal(*ccRoutes, &ccTcpRoutes)
 	if err != nil {
 		return nil, err
 	}
 	tcpRoutes := tcp_routes.TCPRoutes{}
-	for _, tcpRoute := range ccTcpRoutes {
-		tcpRoutes = append(tcpRoutes, tcp_routes.TCPRoute{
-			RouterGroupGuid: tcpRoute.RouterGroupGuid,
-			ExternalPort:    tcpRoute.ExternalPort,
-			ContainerPort:   tcpRoute.ContainerPort,
-		})
+	seen := map[tcp_routes.TCPRoute]bool{}
+	for _, ccTcpRoute := range ccTcpRoutes {
+		tcpRoute := tcp_routes.TCPRoute{
+			RouterGroupGuid: ccTcpRoute.RouterGroupGuid,
+			ExternalPort:    ccTcpRoute.ExternalPort,
+			ContainerPort:   ccTcpRoute.ContainerPort,
+		}
+		if seen[tcpRoute] {
+			continue
+		}
+		seen[tcpRoute] = true
+
+		// run every check, so that each problem is reported
+		name := fmt.Sprintf("tcp route %s:%d", tcpRoute.RouterGroupGuid, tcpRoute.ExternalPort)
+		validRouterGroup := validator.checkRouterGroup(name, tcpRoute.RouterGroupGuid)
+		validExternalPort := validator.checkExternalPort(name, tcpRoute.ExternalPort)
+		validContainerPort := validator.checkContainerPort(name, tcpRoute.ContainerPort)
+
+		if validRouterGroup && validExternalPort && validContainerPort {
+			tcpRoutes = append(tcpRoutes, tcpRoute)
+		}
 	}
 
 	tcpRoutingInfoPtr := tcpRoutes.RoutingInfo()
@@ -71,31 +125,74 @@ func constructTcpRoutes(ccRoutes cc_messages.CCRouteInfo) (models.Routes, error)
 	return tcpRoutingInfo, nil
 }
 
-func constructHttpRoutes(ccRoutes cc_messages.CCRouteInfo, defaultPort uint32) (models.Routes, error) {
+// constructHttpRoutes groups CC's http routes by port and route service URL.
+// The groups are ordered by port and then route service URL, and the
+// hostnames in each keep the order in which CC first lists them, so that the
+// same routes from CC always marshal to the same JSON.
+func constructHttpRoutes(ccRoutes *json.RawMessage, defaultPort uint32, validator *routeValidator) (models.Routes, error) {
 	var httpRoutes cc_messages.CCHTTPRoutes
 	cfRoutes := make(cfroutes.CFRoutes, 0)
 	routeServiceMap := make(map[routingKey][]string)
+	keys := []routingKey{}
 
-	err := json.Unmarshal(*ccRoutes[cc_messages.CC_HTTP_ROUTES], &httpRoutes)
+	err := json.Unmarshal(*ccRoutes, &httpRoutes)
 	if err != nil {
 		return nil, err
 	}
 
+	rejectedKeys := map[routingKey]bool{}
+
 	for _, httpRoute := range httpRoutes {
 		key := routingKey{Port: httpRoute.Port, RouteServiceUrl: httpRoute.RouteServiceUrl}
 		if key.Port == 0 {
 			key.Port = defaultPort
 		}
-		list := routeServiceMap[key]
-		routeServiceMap[key] = append(list, httpRoute.Hostname)
+
+		if rejectedKeys[key] || !validator.checkHostname(httpRoute.Hostname) {
+			continue
+		}
+
+		list, ok := routeServiceMap[key]
+		if !ok {
+			if !validator.checkContainerPort(fmt.Sprintf("http routes on port %d", key.Port), key.Port) {
+				rejectedKeys[key] = true
+				continue
+			}
+			keys = append(keys, key)
+		}
+		if !containsString(list, httpRoute.Hostname) {
+			routeServiceMap[key] = append(list, httpRoute.Hostname)
+		}
 	}
 
-	for key, hostnames := range routeServiceMap {
+	sort.Sort(routingKeys(keys))
+
+	for _, key := range keys {
 		cfRoutes = append(cfRoutes, cfroutes.CFRoute{
-			Hostnames: hostnames, Port: key.Port, RouteServiceUrl: key.RouteServiceUrl,
+			Hostnames: routeServiceMap[key], Port: key.Port, RouteServiceUrl: key.RouteServiceUrl,
 		})
 	}
 
 	httpRoutingInfo := cfRoutes.RoutingInfo()
 	return httpRoutingInfo, nil
 }
+
+type routingKeys []routingKey
+
+func (k routingKeys) Len() int      { return len(k) }
+func (k routingKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k routingKeys) Less(i, j int) bool {
+	if k[i].Port != k[j].Port {
+		return k[i].Port < k[j].Port
+	}
+	return k[i].RouteServiceUrl < k[j].RouteServiceUrl
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -50,6 +50,49 @@ var _ = Describe("Routing Helpers", func() {
 			})
 		})
 
+		Context("when http routes span several ports and route services", func() {
+			var routeInfo cc_messages.CCRouteInfo
+
+			BeforeEach(func() {
+				var err error
+				routeInfo, err = cc_messages.CCHTTPRoutes{
+					{Hostname: "route4", Port: 9090},
+					{Hostname: "route3", RouteServiceUrl: "https://rs-b.example.com"},
+					{Hostname: "route2"},
+					{Hostname: "route5", RouteServiceUrl: "https://rs-a.example.com"},
+					{Hostname: "route1"},
+					{Hostname: "route2", Port: 8080},
+				}.CCRouteInfo()
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("orders them by port and route service url, keeping the order of hostnames", func() {
+				routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+				Expect(err).NotTo(HaveOccurred())
+
+				expectedPayload, err := json.Marshal(cfroutes.CFRoutes{
+					{Hostnames: []string{"route2", "route1"}, Port: 8080},
+					{Hostnames: []string{"route5"}, Port: 8080, RouteServiceUrl: "https://rs-a.example.com"},
+					{Hostnames: []string{"route3"}, Port: 8080, RouteServiceUrl: "https://rs-b.example.com"},
+					{Hostnames: []string{"route4"}, Port: 9090},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(string(*routes[cfroutes.CF_ROUTER])).To(Equal(string(expectedPayload)))
+			})
+
+			It("produces the same routes every time", func() {
+				first, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+				Expect(err).NotTo(HaveOccurred())
+
+				for i := 0; i < 20; i++ {
+					routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(*routes[cfroutes.CF_ROUTER])).To(Equal(string(*first[cfroutes.CF_ROUTER])))
+				}
+			})
+		})
+
 		Context("when there are only tcp routes", func() {
 			var routeInfo cc_messages.CCRouteInfo
 
@@ -76,7 +119,7 @@ var _ = Describe("Routing Helpers", func() {
 			})
 
 			It("returns an empty list of http routes", func() {
-				routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+				routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{5222, 6000})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(routes).To(HaveLen(2))
 
@@ -176,6 +219,103 @@ var _ = Describe("Routing Helpers", func() {
 			})
 		})
 
+		Context("when routes are invalid", func() {
+			routeInfoFor := func(httpRoutes cc_messages.CCHTTPRoutes, tcpRoutes cc_messages.CCTCPRoutes) cc_messages.CCRouteInfo {
+				httpRouteInfo, err := httpRoutes.CCRouteInfo()
+				Expect(err).NotTo(HaveOccurred())
+				tcpRouteInfo, err := tcpRoutes.CCRouteInfo()
+				Expect(err).NotTo(HaveOccurred())
+
+				return cc_messages.CCRouteInfo{
+					cc_messages.CC_HTTP_ROUTES: httpRouteInfo[cc_messages.CC_HTTP_ROUTES],
+					cc_messages.CC_TCP_ROUTES:  tcpRouteInfo[cc_messages.CC_TCP_ROUTES],
+				}
+			}
+
+			It("drops them and reports every problem in a RouteValidationError", func() {
+				routeInfo := routeInfoFor(
+					cc_messages.CCHTTPRoutes{
+						{Hostname: "bad_host-.example.com"},
+						{Hostname: "route1", Port: 9090},
+					},
+					cc_messages.CCTCPRoutes{
+						{RouterGroupGuid: "guid-1", ExternalPort: 70000, ContainerPort: 8080},
+						{RouterGroupGuid: "", ExternalPort: 1883, ContainerPort: 6000},
+					},
+				)
+
+				routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+				Expect(err).To(Equal(helpers.RouteValidationError{Problems: []string{
+					`invalid hostname "bad_host-.example.com"`,
+					"http routes on port 9090: port 9090 is not exposed by the app",
+					"tcp route guid-1:70000: external port 70000 is out of range",
+					"tcp route :1883: router group guid is required",
+					"tcp route :1883: port 6000 is not exposed by the app",
+				}}))
+
+				test_helpers.VerifyHttpRoutes(routes, cfroutes.CFRoutes{})
+				test_helpers.VerifyTcpRoutes(routes, tcp_routes.TCPRoutes{})
+			})
+
+			It("keeps the valid routes", func() {
+				routeInfo := routeInfoFor(
+					cc_messages.CCHTTPRoutes{
+						{Hostname: "bad host"},
+						{Hostname: "route1"},
+						{Hostname: "route2", Port: 9090},
+					},
+					cc_messages.CCTCPRoutes{
+						{RouterGroupGuid: "guid-1", ExternalPort: 5222, ContainerPort: 8080},
+						{RouterGroupGuid: "guid-1", ExternalPort: 0, ContainerPort: 8080},
+					},
+				)
+
+				routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+				Expect(err).To(BeAssignableToTypeOf(helpers.RouteValidationError{}))
+
+				test_helpers.VerifyHttpRoutes(routes, cfroutes.CFRoutes{
+					{Hostnames: []string{"route1"}, Port: 8080},
+				})
+				test_helpers.VerifyTcpRoutes(routes, tcp_routes.TCPRoutes{
+					{RouterGroupGuid: "guid-1", ExternalPort: 5222, ContainerPort: 8080},
+				})
+			})
+
+			It("accepts wildcard hostnames", func() {
+				routeInfo := routeInfoFor(cc_messages.CCHTTPRoutes{{Hostname: "*.example.com"}}, cc_messages.CCTCPRoutes{})
+
+				_, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("when routes are repeated", func() {
+			It("collapses them", func() {
+				routeInfo, err := cc_messages.CCHTTPRoutes{
+					{Hostname: "route1"},
+					{Hostname: "route1", Port: 8080},
+				}.CCRouteInfo()
+				Expect(err).NotTo(HaveOccurred())
+
+				tcpRouteInfo, err := cc_messages.CCTCPRoutes{
+					{RouterGroupGuid: "guid-1", ExternalPort: 5222, ContainerPort: 8080},
+					{RouterGroupGuid: "guid-1", ExternalPort: 5222, ContainerPort: 8080},
+				}.CCRouteInfo()
+				Expect(err).NotTo(HaveOccurred())
+				routeInfo[cc_messages.CC_TCP_ROUTES] = tcpRouteInfo[cc_messages.CC_TCP_ROUTES]
+
+				routes, err := helpers.CCRouteInfoToRoutes(routeInfo, []uint32{8080})
+				Expect(err).NotTo(HaveOccurred())
+
+				test_helpers.VerifyHttpRoutes(routes, cfroutes.CFRoutes{
+					{Hostnames: []string{"route1"}, Port: 8080},
+				})
+				test_helpers.VerifyTcpRoutes(routes, tcp_routes.TCPRoutes{
+					{RouterGroupGuid: "guid-1", ExternalPort: 5222, ContainerPort: 8080},
+				})
+			})
+		})
+
 		Context("when CCRouteInfo is malformed", func() {
 			Context("when it fails to unmarshal", func() {
 				It("returns an error", func() {
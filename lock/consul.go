@@ -0,0 +1,32 @@
+package lock
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-incubator/nsync"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+type consulBackend struct {
+	serviceClient nsync.ServiceClient
+	shardIndex    int
+	sharded       bool
+}
+
+func NewConsulBackend(serviceClient nsync.ServiceClient) Backend {
+	return &consulBackend{serviceClient: serviceClient}
+}
+
+// NewConsulShardBackend holds the lock for one shard of a sharded bulker.
+func NewConsulShardBackend(serviceClient nsync.ServiceClient, shardIndex int) Backend {
+	return &consulBackend{serviceClient: serviceClient, shardIndex: shardIndex, sharded: true}
+}
+
+func (b *consulBackend) NewLockRunner(logger lager.Logger, ownerID string, retryInterval, lockTTL time.Duration) ifrit.Runner {
+	if b.sharded {
+		return b.serviceClient.NewNsyncBulkerShardLockRunner(logger, ownerID, b.shardIndex, retryInterval, lockTTL)
+	}
+
+	return b.serviceClient.NewNsyncBulkerLockRunner(logger, ownerID, retryInterval, lockTTL)
+}
@@ -0,0 +1,146 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/nsync/lock"
+)
+
+type FakeLeaseTable struct {
+	AcquireStub        func(key, owner string, expiresAt time.Time) (bool, error)
+	acquireMutex       sync.RWMutex
+	acquireArgsForCall []struct {
+		key       string
+		owner     string
+		expiresAt time.Time
+	}
+	acquireReturns struct {
+		result1 bool
+		result2 error
+	}
+	RenewStub        func(key, owner string, expiresAt time.Time) error
+	renewMutex       sync.RWMutex
+	renewArgsForCall []struct {
+		key       string
+		owner     string
+		expiresAt time.Time
+	}
+	renewReturns struct {
+		result1 error
+	}
+	ReleaseStub        func(key, owner string) error
+	releaseMutex       sync.RWMutex
+	releaseArgsForCall []struct {
+		key   string
+		owner string
+	}
+	releaseReturns struct {
+		result1 error
+	}
+}
+
+func (fake *FakeLeaseTable) Acquire(key string, owner string, expiresAt time.Time) (bool, error) {
+	fake.acquireMutex.Lock()
+	fake.acquireArgsForCall = append(fake.acquireArgsForCall, struct {
+		key       string
+		owner     string
+		expiresAt time.Time
+	}{key, owner, expiresAt})
+	fake.acquireMutex.Unlock()
+	if fake.AcquireStub != nil {
+		return fake.AcquireStub(key, owner, expiresAt)
+	} else {
+		return fake.acquireReturns.result1, fake.acquireReturns.result2
+	}
+}
+
+func (fake *FakeLeaseTable) AcquireCallCount() int {
+	fake.acquireMutex.RLock()
+	defer fake.acquireMutex.RUnlock()
+	return len(fake.acquireArgsForCall)
+}
+
+func (fake *FakeLeaseTable) AcquireArgsForCall(i int) (string, string, time.Time) {
+	fake.acquireMutex.RLock()
+	defer fake.acquireMutex.RUnlock()
+	return fake.acquireArgsForCall[i].key, fake.acquireArgsForCall[i].owner, fake.acquireArgsForCall[i].expiresAt
+}
+
+func (fake *FakeLeaseTable) AcquireReturns(result1 bool, result2 error) {
+	fake.AcquireStub = nil
+	fake.acquireReturns = struct {
+		result1 bool
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLeaseTable) Renew(key string, owner string, expiresAt time.Time) error {
+	fake.renewMutex.Lock()
+	fake.renewArgsForCall = append(fake.renewArgsForCall, struct {
+		key       string
+		owner     string
+		expiresAt time.Time
+	}{key, owner, expiresAt})
+	fake.renewMutex.Unlock()
+	if fake.RenewStub != nil {
+		return fake.RenewStub(key, owner, expiresAt)
+	} else {
+		return fake.renewReturns.result1
+	}
+}
+
+func (fake *FakeLeaseTable) RenewCallCount() int {
+	fake.renewMutex.RLock()
+	defer fake.renewMutex.RUnlock()
+	return len(fake.renewArgsForCall)
+}
+
+func (fake *FakeLeaseTable) RenewArgsForCall(i int) (string, string, time.Time) {
+	fake.renewMutex.RLock()
+	defer fake.renewMutex.RUnlock()
+	return fake.renewArgsForCall[i].key, fake.renewArgsForCall[i].owner, fake.renewArgsForCall[i].expiresAt
+}
+
+func (fake *FakeLeaseTable) RenewReturns(result1 error) {
+	fake.RenewStub = nil
+	fake.renewReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeLeaseTable) Release(key string, owner string) error {
+	fake.releaseMutex.Lock()
+	fake.releaseArgsForCall = append(fake.releaseArgsForCall, struct {
+		key   string
+		owner string
+	}{key, owner})
+	fake.releaseMutex.Unlock()
+	if fake.ReleaseStub != nil {
+		return fake.ReleaseStub(key, owner)
+	} else {
+		return fake.releaseReturns.result1
+	}
+}
+
+func (fake *FakeLeaseTable) ReleaseCallCount() int {
+	fake.releaseMutex.RLock()
+	defer fake.releaseMutex.RUnlock()
+	return len(fake.releaseArgsForCall)
+}
+
+func (fake *FakeLeaseTable) ReleaseArgsForCall(i int) (string, string) {
+	fake.releaseMutex.RLock()
+	defer fake.releaseMutex.RUnlock()
+	return fake.releaseArgsForCall[i].key, fake.releaseArgsForCall[i].owner
+}
+
+func (fake *FakeLeaseTable) ReleaseReturns(result1 error) {
+	fake.ReleaseStub = nil
+	fake.releaseReturns = struct {
+		result1 error
+	}{result1}
+}
+
+var _ lock.LeaseTable = new(FakeLeaseTable)
@@ -0,0 +1,91 @@
+package lock
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+type fileBackend struct {
+	path  string
+	clock clock.Clock
+}
+
+// NewFileBackend locks a file with flock(2), for deployments where every
+// bulker runs on the same host. The lock is released by the kernel if the
+// process dies, so the TTL is not used.
+func NewFileBackend(path string, clock clock.Clock) Backend {
+	return &fileBackend{path: path, clock: clock}
+}
+
+func (b *fileBackend) NewLockRunner(logger lager.Logger, ownerID string, retryInterval, lockTTL time.Duration) ifrit.Runner {
+	return &leaseRunner{
+		logger:        logger,
+		backend:       "file",
+		lease:         &fileLease{path: b.path, ownerID: ownerID},
+		clock:         b.clock,
+		retryInterval: retryInterval,
+	}
+}
+
+type fileLease struct {
+	path    string
+	ownerID string
+	file    *os.File
+}
+
+func (l *fileLease) Acquire() (bool, error) {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return false, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return false, nil
+	} else if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	// record the holder for operators; the lock itself is the flock
+	if file.Truncate(0) == nil {
+		file.WriteAt([]byte(l.ownerID+"\n"), 0)
+	}
+
+	l.file = file
+	return true, nil
+}
+
+// Renew checks that the locked file is still the one at the path; if it was
+// removed or replaced, another bulker may lock the new file.
+func (l *fileLease) Renew() error {
+	held, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	current, err := os.Stat(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrLockLost
+		}
+		return err
+	}
+
+	if !os.SameFile(held, current) {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+func (l *fileLease) Release() error {
+	defer l.file.Close()
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,89 @@
+package lock_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry-incubator/nsync/lock"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("File lock backend", func() {
+	var (
+		tmpDir  string
+		backend lock.Backend
+		logger  *lagertest.TestLogger
+
+		process ifrit.Process
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "lock")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("test")
+		backend = lock.NewFileBackend(filepath.Join(tmpDir, "bulker.lock"), clock.NewClock())
+		process = ifrit.Invoke(backend.NewLockRunner(logger, "bulker-1", 10*time.Millisecond, time.Second))
+	})
+
+	AfterEach(func() {
+		ginkgomon.Interrupt(process)
+		os.RemoveAll(tmpDir)
+	})
+
+	It("becomes ready once it holds the lock", func() {
+		Eventually(process.Ready()).Should(BeClosed())
+	})
+
+	Context("when another bulker holds the lock", func() {
+		var other ifrit.Process
+
+		BeforeEach(func() {
+			Eventually(process.Ready()).Should(BeClosed())
+			other = ifrit.Background(backend.NewLockRunner(logger, "bulker-2", 10*time.Millisecond, time.Second))
+		})
+
+		AfterEach(func() {
+			ginkgomon.Interrupt(other)
+		})
+
+		It("waits until the lock is released", func() {
+			Consistently(other.Ready()).ShouldNot(BeClosed())
+
+			ginkgomon.Interrupt(process)
+			Eventually(other.Ready()).Should(BeClosed())
+		})
+	})
+
+	Context("when the lock file is removed", func() {
+		It("exits with an error", func() {
+			Eventually(process.Ready()).Should(BeClosed())
+
+			Expect(os.Remove(filepath.Join(tmpDir, "bulker.lock"))).To(Succeed())
+			Eventually(process.Wait()).Should(Receive(Equal(lock.ErrLockLost)))
+		})
+
+		It("unlocks the removed file", func() {
+			Eventually(process.Ready()).Should(BeClosed())
+
+			removed, err := os.Open(filepath.Join(tmpDir, "bulker.lock"))
+			Expect(err).NotTo(HaveOccurred())
+			defer removed.Close()
+
+			Expect(os.Remove(filepath.Join(tmpDir, "bulker.lock"))).To(Succeed())
+			Eventually(process.Wait()).Should(Receive())
+
+			Expect(syscall.Flock(int(removed.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)).To(Succeed())
+		})
+	})
+})
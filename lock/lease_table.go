@@ -0,0 +1,162 @@
+package lock
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+//go:generate counterfeiter -o fakes/fake_lease_table.go . LeaseTable
+
+// LeaseTable stores expiring leases on named locks, in the style of the BBS
+// SQL lock table.
+type LeaseTable interface {
+	// Acquire takes the lease if it is free, expired or already held by the
+	// owner, and reports whether the owner now holds it.
+	Acquire(key, owner string, expiresAt time.Time) (bool, error)
+	// Renew extends a lease held by the owner, returning ErrLockLost if it
+	// no longer holds it.
+	Renew(key, owner string, expiresAt time.Time) error
+	Release(key, owner string) error
+}
+
+type leaseBackend struct {
+	table LeaseTable
+	key   string
+	clock clock.Clock
+}
+
+// NewLeaseBackend holds the lock as a lease in the table, renewed before it
+// expires after the lock TTL.
+func NewLeaseBackend(table LeaseTable, key string, clock clock.Clock) Backend {
+	return &leaseBackend{table: table, key: key, clock: clock}
+}
+
+func (b *leaseBackend) NewLockRunner(logger lager.Logger, ownerID string, retryInterval, lockTTL time.Duration) ifrit.Runner {
+	return &leaseRunner{
+		logger:  logger,
+		backend: "lease",
+		lease: &tableLease{
+			table:   b.table,
+			key:     b.key,
+			ownerID: ownerID,
+			ttl:     lockTTL,
+			clock:   b.clock,
+		},
+		clock:         b.clock,
+		retryInterval: retryInterval,
+		lockTTL:       lockTTL,
+	}
+}
+
+type tableLease struct {
+	table   LeaseTable
+	key     string
+	ownerID string
+	ttl     time.Duration
+	clock   clock.Clock
+}
+
+func (l *tableLease) Acquire() (bool, error) {
+	return l.table.Acquire(l.key, l.ownerID, l.clock.Now().Add(l.ttl))
+}
+
+func (l *tableLease) Renew() error {
+	return l.table.Renew(l.key, l.ownerID, l.clock.Now().Add(l.ttl))
+}
+
+func (l *tableLease) Release() error {
+	return l.table.Release(l.key, l.ownerID)
+}
+
+// SQLLeaseTableDriver is the only database/sql driver the SQL lease table
+// supports: its queries use MySQL's ? placeholders.
+const SQLLeaseTableDriver = "mysql"
+
+type sqlLeaseTable struct {
+	db        *sql.DB
+	tableName string
+	clock     clock.Clock
+}
+
+// NewSQLLeaseTable stores leases in the named table, creating it if needed.
+// The database must be MySQL; see SQLLeaseTableDriver. Expiry is judged by
+// the bulkers' clocks, which must be roughly in sync.
+func NewSQLLeaseTable(db *sql.DB, tableName string, clock clock.Clock) (LeaseTable, error) {
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		lock_key VARCHAR(255) PRIMARY KEY,
+		owner VARCHAR(255) NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`, tableName))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlLeaseTable{db: db, tableName: tableName, clock: clock}, nil
+}
+
+func (t *sqlLeaseTable) Acquire(key, owner string, expiresAt time.Time) (bool, error) {
+	result, err := t.db.Exec(
+		fmt.Sprintf(`UPDATE %s SET owner = ?, expires_at = ? WHERE lock_key = ? AND (owner = ? OR expires_at < ?)`, t.tableName),
+		owner, expiresAt.UnixNano(), key, owner, t.clock.Now().UnixNano(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if updated > 0 {
+		return true, nil
+	}
+
+	_, err = t.db.Exec(
+		fmt.Sprintf(`INSERT INTO %s (lock_key, owner, expires_at) VALUES (?, ?, ?)`, t.tableName),
+		key, owner, expiresAt.UnixNano(),
+	)
+	if err == nil {
+		return true, nil
+	}
+
+	// the insert fails if another owner holds the lease
+	var holder string
+	queryErr := t.db.QueryRow(fmt.Sprintf(`SELECT owner FROM %s WHERE lock_key = ?`, t.tableName), key).Scan(&holder)
+	if queryErr == nil && holder != owner {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func (t *sqlLeaseTable) Renew(key, owner string, expiresAt time.Time) error {
+	result, err := t.db.Exec(
+		fmt.Sprintf(`UPDATE %s SET expires_at = ? WHERE lock_key = ? AND owner = ?`, t.tableName),
+		expiresAt.UnixNano(), key, owner,
+	)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+func (t *sqlLeaseTable) Release(key, owner string) error {
+	_, err := t.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE lock_key = ? AND owner = ?`, t.tableName), key, owner)
+	return err
+}
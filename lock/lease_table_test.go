@@ -0,0 +1,127 @@
+package lock_test
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-incubator/nsync/lock"
+	"github.com/cloudfoundry-incubator/nsync/lock/fakes"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lease lock backend", func() {
+	var (
+		table   *fakes.FakeLeaseTable
+		logger  *lagertest.TestLogger
+		lockTTL time.Duration
+		clk     clock.Clock
+
+		process ifrit.Process
+	)
+
+	BeforeEach(func() {
+		table = new(fakes.FakeLeaseTable)
+		logger = lagertest.NewTestLogger("test")
+		lockTTL = 30 * time.Millisecond
+		clk = clock.NewClock()
+	})
+
+	JustBeforeEach(func() {
+		backend := lock.NewLeaseBackend(table, "nsync_bulker_lock", clk)
+		process = ifrit.Background(backend.NewLockRunner(logger, "bulker-1", 10*time.Millisecond, lockTTL))
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive())
+	})
+
+	Context("when the lease is free", func() {
+		BeforeEach(func() {
+			table.AcquireReturns(true, nil)
+		})
+
+		It("takes the lease for the lock TTL and becomes ready", func() {
+			Eventually(process.Ready()).Should(BeClosed())
+
+			key, owner, expiresAt := table.AcquireArgsForCall(0)
+			Expect(key).To(Equal("nsync_bulker_lock"))
+			Expect(owner).To(Equal("bulker-1"))
+			Expect(expiresAt).To(BeTemporally("~", time.Now().Add(lockTTL), lockTTL))
+		})
+
+		It("renews the lease", func() {
+			Eventually(table.RenewCallCount).Should(BeNumerically(">=", 2))
+		})
+
+		It("releases the lease when signalled", func() {
+			Eventually(process.Ready()).Should(BeClosed())
+
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+
+			key, owner := table.ReleaseArgsForCall(0)
+			Expect(key).To(Equal("nsync_bulker_lock"))
+			Expect(owner).To(Equal("bulker-1"))
+		})
+
+		Context("and another owner takes it", func() {
+			BeforeEach(func() {
+				table.RenewReturns(lock.ErrLockLost)
+			})
+
+			It("exits with an error", func() {
+				Eventually(process.Wait()).Should(Receive(Equal(lock.ErrLockLost)))
+			})
+
+			It("releases what is left of the lease", func() {
+				Eventually(process.Wait()).Should(Receive())
+				Expect(table.ReleaseCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("and renewals keep failing", func() {
+			var fakeClock *fakeclock.FakeClock
+
+			BeforeEach(func() {
+				table.RenewReturns(errors.New("connection refused"))
+
+				fakeClock = fakeclock.NewFakeClock(time.Now())
+				clk = fakeClock
+			})
+
+			It("gives up before the lease expires", func() {
+				Eventually(process.Ready()).Should(BeClosed())
+
+				Eventually(fakeClock.WatcherCount).Should(Equal(1))
+				fakeClock.Increment(10 * time.Millisecond)
+				Eventually(table.RenewCallCount).Should(Equal(1))
+				Consistently(process.Wait()).ShouldNot(Receive())
+
+				// the lease would expire before a renewal 10ms later
+				Eventually(fakeClock.WatcherCount).Should(Equal(1))
+				fakeClock.Increment(10 * time.Millisecond)
+				Eventually(process.Wait()).Should(Receive(Equal(lock.ErrLockLost)))
+				Expect(table.ReleaseCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Context("when another owner holds the lease", func() {
+		BeforeEach(func() {
+			table.AcquireReturns(false, nil)
+		})
+
+		It("keeps trying without becoming ready", func() {
+			Eventually(table.AcquireCallCount).Should(BeNumerically(">=", 2))
+			Consistently(process.Ready()).ShouldNot(BeClosed())
+		})
+	})
+})
@@ -0,0 +1,123 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+var ErrLockLost = errors.New("lock lost")
+
+// Backend creates runners that hold the bulker's lock. A runner is ready once
+// it holds the lock, exits with an error if it loses it, and releases it when
+// signalled.
+type Backend interface {
+	NewLockRunner(logger lager.Logger, ownerID string, retryInterval, lockTTL time.Duration) ifrit.Runner
+}
+
+// lease is a single owner's hold on a lock.
+type lease interface {
+	// Acquire attempts to take the lock without blocking.
+	Acquire() (bool, error)
+	// Renew extends the hold; it returns ErrLockLost if another owner has
+	// taken the lock.
+	Renew() error
+	// Release gives up the lock, and is also called once it is lost.
+	Release() error
+}
+
+type leaseRunner struct {
+	logger        lager.Logger
+	backend       string
+	lease         lease
+	clock         clock.Clock
+	retryInterval time.Duration
+	lockTTL       time.Duration
+}
+
+func (r *leaseRunner) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := r.logger.Session("lock", lager.Data{"backend": r.backend})
+	logger.Info("starting")
+	defer logger.Info("done")
+
+	// a held lock is renewed well within its TTL, so that a single failed
+	// renewal does not lose it
+	renewInterval := r.lockTTL / 3
+	if renewInterval <= 0 || renewInterval > r.retryInterval {
+		renewInterval = r.retryInterval
+	}
+
+	acquired := false
+	var lastRenewed time.Time
+
+	for {
+		// the lease runs from when it was written, which is no later than
+		// when the call began
+		attempted := r.clock.Now()
+
+		if !acquired {
+			ok, err := r.lease.Acquire()
+			if err != nil {
+				logger.Error("failed-acquiring-lock", err)
+			} else if ok {
+				logger.Info("acquired-lock")
+				acquired = true
+				lastRenewed = attempted
+				close(ready)
+			}
+		} else {
+			err := r.lease.Renew()
+			switch {
+			case err == ErrLockLost:
+				return r.lost(logger, err)
+			case err != nil:
+				logger.Error("failed-renewing-lock", err)
+				// give up while the lease is still held rather than once it
+				// has expired, as another owner may take it from then on
+				if r.lockTTL > 0 && r.clock.Since(lastRenewed)+renewInterval >= r.lockTTL {
+					return r.lost(logger, ErrLockLost)
+				}
+			default:
+				lastRenewed = attempted
+			}
+		}
+
+		interval := r.retryInterval
+		if acquired {
+			interval = renewInterval
+		}
+
+		timer := r.clock.NewTimer(interval)
+
+		select {
+		case <-signals:
+			timer.Stop()
+			if acquired {
+				err := r.lease.Release()
+				if err != nil {
+					logger.Error("failed-releasing-lock", err)
+				}
+			}
+			return nil
+
+		case <-timer.C():
+		}
+	}
+}
+
+// lost releases what remains of a lost lock, such as an open lock file, so
+// that it does not outlive the runner.
+func (r *leaseRunner) lost(logger lager.Logger, err error) error {
+	logger.Error("lost-lock", err)
+
+	releaseErr := r.lease.Release()
+	if releaseErr != nil {
+		logger.Error("failed-releasing-lost-lock", releaseErr)
+	}
+
+	return ErrLockLost
+}
@@ -187,15 +187,9 @@ func (b *BuildpackRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestF
 	}
 
 	if desiredApp.AllowSSH {
-		hostKeyPair, err := b.config.KeyFactory.NewKeyPair(1024)
+		sshKeys, err := b.config.sshKeys(lrpGuid)
 		if err != nil {
-			buildLogger.Error("new-host-key-pair-failed", err)
-			return nil, err
-		}
-
-		userKeyPair, err := b.config.KeyFactory.NewKeyPair(1024)
-		if err != nil {
-			buildLogger.Error("new-user-key-pair-failed", err)
+			buildLogger.Error("ssh-keys-failed", err)
 			return nil, err
 		}
 
@@ -204,8 +198,8 @@ func (b *BuildpackRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestF
 			Path: "/tmp/lifecycle/diego-sshd",
 			Args: []string{
 				"-address=" + fmt.Sprintf("0.0.0.0:%d", DefaultSSHPort),
-				"-hostKey=" + hostKeyPair.PEMEncodedPrivateKey(),
-				"-authorizedKey=" + userKeyPair.AuthorizedKey(),
+				"-hostKey=" + sshKeys.HostPrivateKey,
+				"-authorizedKey=" + sshKeys.UserAuthorizedKey,
 				"-inheritDaemonEnv",
 				"-logLevel=fatal",
 			},
@@ -217,8 +211,8 @@ func (b *BuildpackRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestF
 
 		sshRoutePayload, err := json.Marshal(ssh_routes.SSHRoute{
 			ContainerPort:   2222,
-			PrivateKey:      userKeyPair.PEMEncodedPrivateKey(),
-			HostFingerprint: hostKeyPair.Fingerprint(),
+			PrivateKey:      sshKeys.UserPrivateKey,
+			HostFingerprint: sshKeys.HostFingerprint,
 		})
 
 		if err != nil {
@@ -258,7 +252,7 @@ func (b *BuildpackRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestF
 
 		MetricsGuid: desiredApp.LogGuid,
 
-		EnvironmentVariables: containerEnvVars,
+		EnvironmentVariables: append(containerEnvVars, recipeVersionVar(b.config)),
 		CachedDependencies:   cachedDependencies,
 		Setup:                models.WrapAction(setupAction),
 		Action:               models.WrapAction(actionAction),
@@ -3,6 +3,8 @@ package recipebuilder_test
 import (
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"os"
 	"time"
 
 	"github.com/cloudfoundry-incubator/bbs/models"
@@ -130,6 +132,21 @@ var _ = Describe("Buildpack Recipe Builder", func() {
 			})
 		})
 
+		Context("when a recipe revision is configured", func() {
+			BeforeEach(func() {
+				builder = recipebuilder.NewBuildpackRecipeBuilder(logger, recipebuilder.Config{
+					Lifecycles:     lifecycles,
+					FileServerURL:  "http://file-server.com",
+					KeyFactory:     fakeKeyFactory,
+					RecipeRevision: "new-lifecycle",
+				})
+			})
+
+			It("records the revision with the recipe version", func() {
+				Expect(recipebuilder.RecipeStampOf(desiredLRP)).To(Equal("1+new-lifecycle"))
+			})
+		})
+
 		Context("when everything is correct", func() {
 			It("does not error", func() {
 				Expect(err).NotTo(HaveOccurred())
@@ -153,6 +170,7 @@ var _ = Describe("Buildpack Recipe Builder", func() {
 
 				Expect(desiredLRP.EnvironmentVariables).To(ConsistOf(
 					&models.EnvironmentVariable{Name: "LANG", Value: recipebuilder.DefaultLANG},
+					&models.EnvironmentVariable{Name: recipebuilder.RecipeVersionEnv, Value: "1"},
 				))
 
 				Expect(desiredLRP.MetricsGuid).To(Equal("the-log-id"))
@@ -450,6 +468,36 @@ var _ = Describe("Buildpack Recipe Builder", func() {
 						Expect(err).To(HaveOccurred())
 					})
 				})
+
+				Context("when a key store is configured", func() {
+					var keyDir string
+
+					BeforeEach(func() {
+						var err error
+						keyDir, err = ioutil.TempDir("", "ssh-keys")
+						Expect(err).NotTo(HaveOccurred())
+
+						builder = recipebuilder.NewBuildpackRecipeBuilder(logger, recipebuilder.Config{
+							Lifecycles:    lifecycles,
+							FileServerURL: "http://file-server.com",
+							KeyFactory:    fakeKeyFactory,
+							KeyStore:      recipebuilder.NewFileSSHKeyStore(keyDir, fakeKeyFactory),
+						})
+					})
+
+					AfterEach(func() {
+						os.RemoveAll(keyDir)
+					})
+
+					It("reuses the keys when the recipe is rebuilt", func() {
+						rebuilt, err := builder.Build(&desiredAppReq)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(rebuilt.Routes).To(Equal(desiredLRP.Routes))
+						Expect(rebuilt.Action).To(Equal(desiredLRP.Action))
+						Expect(fakeKeyFactory.NewKeyPairCallCount()).To(Equal(2))
+					})
+				})
 			})
 
 			Context("and it is setting the CPU weight", func() {
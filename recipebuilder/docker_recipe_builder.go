@@ -195,15 +195,9 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 	}
 
 	if desiredApp.AllowSSH {
-		hostKeyPair, err := b.config.KeyFactory.NewKeyPair(1024)
+		sshKeys, err := b.config.sshKeys(lrpGuid)
 		if err != nil {
-			buildLogger.Error("new-host-key-pair-failed", err)
-			return nil, err
-		}
-
-		userKeyPair, err := b.config.KeyFactory.NewKeyPair(1024)
-		if err != nil {
-			buildLogger.Error("new-user-key-pair-failed", err)
+			buildLogger.Error("ssh-keys-failed", err)
 			return nil, err
 		}
 
@@ -212,8 +206,8 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 			Path: "/tmp/lifecycle/diego-sshd",
 			Args: []string{
 				"-address=" + fmt.Sprintf("0.0.0.0:%d", DefaultSSHPort),
-				"-hostKey=" + hostKeyPair.PEMEncodedPrivateKey(),
-				"-authorizedKey=" + userKeyPair.AuthorizedKey(),
+				"-hostKey=" + sshKeys.HostPrivateKey,
+				"-authorizedKey=" + sshKeys.UserAuthorizedKey,
 				"-inheritDaemonEnv",
 				"-logLevel=fatal",
 			},
@@ -225,8 +219,8 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 
 		sshRoutePayload, err := json.Marshal(ssh_routes.SSHRoute{
 			ContainerPort:   2222,
-			PrivateKey:      userKeyPair.PEMEncodedPrivateKey(),
-			HostFingerprint: hostKeyPair.Fingerprint(),
+			PrivateKey:      sshKeys.UserPrivateKey,
+			HostFingerprint: sshKeys.HostFingerprint,
 		})
 
 		if err != nil {
@@ -265,7 +259,7 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 
 		MetricsGuid: desiredApp.LogGuid,
 
-		EnvironmentVariables: containerEnvVars,
+		EnvironmentVariables: append(containerEnvVars, recipeVersionVar(b.config)),
 		CachedDependencies:   cachedDependencies,
 		Action:               models.WrapAction(actionAction),
 		Monitor:              models.WrapAction(monitor),
@@ -184,7 +184,9 @@ var _ = Describe("Docker Recipe Builder", func() {
 				Expect(desiredLRP.LogGuid).To(Equal("the-log-id"))
 				Expect(desiredLRP.LogSource).To(Equal("CELL"))
 
-				Expect(desiredLRP.EnvironmentVariables).To(BeEmpty())
+				Expect(desiredLRP.EnvironmentVariables).To(ConsistOf(
+					&models.EnvironmentVariable{Name: recipebuilder.RecipeVersionEnv, Value: "1"},
+				))
 
 				Expect(desiredLRP.MetricsGuid).To(Equal("the-log-id"))
 
@@ -790,7 +792,11 @@ var _ = Describe("Docker Recipe Builder", func() {
 			})
 
 			It("does not set the container's LANG", func() {
-				Expect(desiredLRP.EnvironmentVariables).To(BeEmpty())
+				varNames := []string{}
+				for _, envVar := range desiredLRP.EnvironmentVariables {
+					varNames = append(varNames, envVar.Name)
+				}
+				Expect(varNames).NotTo(ContainElement("LANG"))
 			})
 		})
 
@@ -42,6 +42,15 @@ type Config struct {
 	FileServerURL        string
 	KeyFactory           keys.SSHKeyFactory
 	PrivilegedContainers bool
+
+	// KeyStore, when set, keeps the SSH keys of LRPs across builds.
+	// Otherwise every build generates fresh keys with KeyFactory.
+	KeyStore SSHKeyStore
+
+	// RecipeRevision is set by operators to migrate existing LRPs when
+	// something outside the code changes their recipe, such as a new
+	// lifecycle bundle served from the same path.
+	RecipeRevision string
 }
 
 //go:generate counterfeiter -o ../bulk/fakes/fake_recipe_builder.go . RecipeBuilder
@@ -60,6 +69,14 @@ func (err Error) Error() string {
 	return err.Message
 }
 
+func (c Config) sshKeys(processGuid string) (SSHKeys, error) {
+	if c.KeyStore != nil {
+		return c.KeyStore.Keys(processGuid)
+	}
+
+	return NewSSHKeys(c.KeyFactory)
+}
+
 func lifecycleDownloadURL(lifecyclePath string, fileServerURL string) string {
 	return urljoiner.Join(fileServerURL, "/v1/static", lifecyclePath)
 }
@@ -0,0 +1,42 @@
+package recipebuilder
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+)
+
+// RecipeVersion is bumped whenever a change to the builders changes the
+// DesiredLRPs they build, so that the bulker can migrate existing LRPs.
+const RecipeVersion = 1
+
+// RecipeVersionEnv is the container environment variable that records the
+// recipe version an LRP was built with. The version is kept out of the LRP's
+// routes, which belong to the routers.
+const RecipeVersionEnv = "NSYNC_RECIPE_VERSION"
+
+// RecipeStamp returns the version the builders record on LRPs built with
+// this config: RecipeVersion, followed by the operator's RecipeRevision.
+func (c Config) RecipeStamp() string {
+	if c.RecipeRevision == "" {
+		return fmt.Sprintf("%d", RecipeVersion)
+	}
+
+	return fmt.Sprintf("%d+%s", RecipeVersion, c.RecipeRevision)
+}
+
+// RecipeStampOf returns the version recorded on an LRP, or "" when it is
+// unknown because the LRP was built before versions were recorded.
+func RecipeStampOf(lrp *models.DesiredLRP) string {
+	for _, envVar := range lrp.EnvironmentVariables {
+		if envVar.Name == RecipeVersionEnv {
+			return envVar.Value
+		}
+	}
+
+	return ""
+}
+
+func recipeVersionVar(config Config) *models.EnvironmentVariable {
+	return &models.EnvironmentVariable{Name: RecipeVersionEnv, Value: config.RecipeStamp()}
+}
@@ -0,0 +1,144 @@
+package recipebuilder
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/pivotal-golang/lager"
+)
+
+// Registry holds the buildpack and docker recipe builders for a Config that
+// can be replaced at runtime. Reloading swaps every builder at once; builds
+// already in progress finish with the builders they started with.
+type Registry struct {
+	logger lager.Logger
+
+	reloadLock sync.Mutex
+	current    atomic.Value // *registryState
+}
+
+type registryState struct {
+	config   Config
+	builders map[string]RecipeBuilder
+}
+
+func NewRegistry(logger lager.Logger, config Config) *Registry {
+	r := &Registry{logger: logger}
+	r.current.Store(newRegistryState(logger, config))
+	return r
+}
+
+func newRegistryState(logger lager.Logger, config Config) *registryState {
+	return &registryState{
+		config: config,
+		builders: map[string]RecipeBuilder{
+			"buildpack": NewBuildpackRecipeBuilder(logger, config),
+			"docker":    NewDockerRecipeBuilder(logger, config),
+		},
+	}
+}
+
+// Builders returns builders that always delegate to the registry's current
+// builders, for consumers that hold on to them.
+func (r *Registry) Builders() map[string]RecipeBuilder {
+	return map[string]RecipeBuilder{
+		"buildpack": registryBuilder{registry: r, name: "buildpack"},
+		"docker":    registryBuilder{registry: r, name: "docker"},
+	}
+}
+
+func (r *Registry) Config() Config {
+	return r.state().config
+}
+
+// Reload rebuilds the builders from config and returns the changes it made,
+// which are also logged.
+func (r *Registry) Reload(config Config) []string {
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	logger := r.logger.Session("reload-recipe-config")
+
+	changes := configChanges(r.state().config, config)
+	if len(changes) == 0 {
+		logger.Info("unchanged")
+		return nil
+	}
+
+	r.current.Store(newRegistryState(r.logger, config))
+	logger.Info("reloaded", lager.Data{"changes": changes})
+
+	return changes
+}
+
+func (r *Registry) state() *registryState {
+	return r.current.Load().(*registryState)
+}
+
+func configChanges(previous, next Config) []string {
+	changes := []string{}
+
+	if previous.FileServerURL != next.FileServerURL {
+		changes = append(changes, fmt.Sprintf("fileServerURL: %q -> %q", previous.FileServerURL, next.FileServerURL))
+	}
+
+	if previous.PrivilegedContainers != next.PrivilegedContainers {
+		changes = append(changes, fmt.Sprintf("privilegedContainers: %t -> %t", previous.PrivilegedContainers, next.PrivilegedContainers))
+	}
+
+	if previous.RecipeRevision != next.RecipeRevision {
+		changes = append(changes, fmt.Sprintf("recipeRevision: %q -> %q", previous.RecipeRevision, next.RecipeRevision))
+	}
+
+	lifecycles := []string{}
+	for lifecycle := range previous.Lifecycles {
+		lifecycles = append(lifecycles, lifecycle)
+	}
+	for lifecycle := range next.Lifecycles {
+		if _, ok := previous.Lifecycles[lifecycle]; !ok {
+			lifecycles = append(lifecycles, lifecycle)
+		}
+	}
+	sort.Strings(lifecycles)
+
+	for _, lifecycle := range lifecycles {
+		before, hadBefore := previous.Lifecycles[lifecycle]
+		after, hasAfter := next.Lifecycles[lifecycle]
+
+		switch {
+		case !hadBefore:
+			changes = append(changes, fmt.Sprintf("lifecycle %s: added %q", lifecycle, after))
+		case !hasAfter:
+			changes = append(changes, fmt.Sprintf("lifecycle %s: removed %q", lifecycle, before))
+		case before != after:
+			changes = append(changes, fmt.Sprintf("lifecycle %s: %q -> %q", lifecycle, before, after))
+		}
+	}
+
+	return changes
+}
+
+type registryBuilder struct {
+	registry *Registry
+	name     string
+}
+
+func (b registryBuilder) builder() RecipeBuilder {
+	return b.registry.state().builders[b.name]
+}
+
+func (b registryBuilder) Build(desiredApp *cc_messages.DesireAppRequestFromCC) (*models.DesiredLRP, error) {
+	return b.builder().Build(desiredApp)
+}
+
+func (b registryBuilder) BuildTask(task *cc_messages.TaskRequestFromCC) (*models.TaskDefinition, error) {
+	return b.builder().BuildTask(task)
+}
+
+func (b registryBuilder) ExtractExposedPorts(desiredApp *cc_messages.DesireAppRequestFromCC) ([]uint32, error) {
+	return b.builder().ExtractExposedPorts(desiredApp)
+}
@@ -0,0 +1,129 @@
+package recipebuilder_test
+
+import (
+	"encoding/json"
+
+	"github.com/cloudfoundry-incubator/diego-ssh/keys/fake_keys"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		logger     *lagertest.TestLogger
+		config     recipebuilder.Config
+		registry   *recipebuilder.Registry
+		builders   map[string]recipebuilder.RecipeBuilder
+		desiredApp cc_messages.DesireAppRequestFromCC
+	)
+
+	buildSetup := func() string {
+		desiredLRP, err := builders["buildpack"].Build(&desiredApp)
+		Expect(err).NotTo(HaveOccurred())
+
+		setup, err := json.Marshal(desiredLRP.Setup)
+		Expect(err).NotTo(HaveOccurred())
+		return string(setup)
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		config = recipebuilder.Config{
+			Lifecycles: map[string]string{
+				"buildpack/some-stack": "some-lifecycle.tgz",
+			},
+			FileServerURL: "http://file-server.com",
+			KeyFactory:    &fake_keys.FakeSSHKeyFactory{},
+		}
+
+		registry = recipebuilder.NewRegistry(logger, config)
+		builders = registry.Builders()
+
+		desiredApp = cc_messages.DesireAppRequestFromCC{
+			ProcessGuid:  "the-app-guid-the-app-version",
+			DropletUri:   "http://the-droplet.uri.com",
+			Stack:        "some-stack",
+			StartCommand: "the-start-command",
+			MemoryMB:     128,
+			DiskMB:       512,
+			NumInstances: 1,
+			LogGuid:      "the-log-id",
+		}
+	})
+
+	It("builds with the initial config", func() {
+		Expect(buildSetup()).To(ContainSubstring("http://file-server.com/v1/static/some-lifecycle.tgz"))
+		Expect(registry.Config()).To(Equal(config))
+	})
+
+	Describe("Reload", func() {
+		var reloaded recipebuilder.Config
+
+		BeforeEach(func() {
+			reloaded = config
+			reloaded.FileServerURL = "http://new-file-server.com"
+			reloaded.Lifecycles = map[string]string{
+				"buildpack/some-stack":  "new-lifecycle.tgz",
+				"buildpack/other-stack": "other-lifecycle.tgz",
+			}
+		})
+
+		It("switches builders already handed out to the new config", func() {
+			registry.Reload(reloaded)
+			Expect(buildSetup()).To(ContainSubstring("http://new-file-server.com/v1/static/new-lifecycle.tgz"))
+			Expect(registry.Config()).To(Equal(reloaded))
+		})
+
+		It("returns and logs what changed", func() {
+			changes := registry.Reload(reloaded)
+			Expect(changes).To(Equal([]string{
+				`fileServerURL: "http://file-server.com" -> "http://new-file-server.com"`,
+				`lifecycle buildpack/other-stack: added "other-lifecycle.tgz"`,
+				`lifecycle buildpack/some-stack: "some-lifecycle.tgz" -> "new-lifecycle.tgz"`,
+			}))
+			Expect(logger.TestSink.Buffer).To(gbytes.Say("reload-recipe-config.reloaded"))
+		})
+
+		Context("when the recipe revision changes", func() {
+			BeforeEach(func() {
+				reloaded = config
+				reloaded.RecipeRevision = "new-lifecycles"
+			})
+
+			It("stamps new LRPs with it", func() {
+				changes := registry.Reload(reloaded)
+				Expect(changes).To(Equal([]string{`recipeRevision: "" -> "new-lifecycles"`}))
+
+				desiredLRP, err := builders["buildpack"].Build(&desiredApp)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(recipebuilder.RecipeStampOf(desiredLRP)).To(Equal(reloaded.RecipeStamp()))
+			})
+		})
+
+		Context("when a lifecycle is removed", func() {
+			BeforeEach(func() {
+				reloaded.Lifecycles = map[string]string{}
+			})
+
+			It("stops building apps for it", func() {
+				changes := registry.Reload(reloaded)
+				Expect(changes).To(ContainElement(`lifecycle buildpack/some-stack: removed "some-lifecycle.tgz"`))
+
+				_, err := builders["buildpack"].Build(&desiredApp)
+				Expect(err).To(Equal(recipebuilder.ErrNoLifecycleDefined))
+			})
+		})
+
+		Context("when nothing changed", func() {
+			It("keeps the builders", func() {
+				Expect(registry.Reload(config)).To(BeEmpty())
+				Expect(buildSetup()).To(ContainSubstring("http://file-server.com/v1/static/some-lifecycle.tgz"))
+			})
+		})
+	})
+})
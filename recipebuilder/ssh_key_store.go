@@ -0,0 +1,195 @@
+package recipebuilder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/diego-ssh/keys"
+)
+
+const sshKeyBits = 1024
+
+// SSHKeys are the parts of an LRP's host and user key pairs that its recipe
+// embeds.
+type SSHKeys struct {
+	HostPrivateKey    string `json:"host_private_key"`
+	HostFingerprint   string `json:"host_fingerprint"`
+	UserPrivateKey    string `json:"user_private_key"`
+	UserAuthorizedKey string `json:"user_authorized_key"`
+}
+
+// NewSSHKeys generates a host and a user key pair.
+func NewSSHKeys(factory keys.SSHKeyFactory) (SSHKeys, error) {
+	hostKeyPair, err := factory.NewKeyPair(sshKeyBits)
+	if err != nil {
+		return SSHKeys{}, fmt.Errorf("failed to generate host key: %s", err)
+	}
+
+	userKeyPair, err := factory.NewKeyPair(sshKeyBits)
+	if err != nil {
+		return SSHKeys{}, fmt.Errorf("failed to generate user key: %s", err)
+	}
+
+	return SSHKeys{
+		HostPrivateKey:    hostKeyPair.PEMEncodedPrivateKey(),
+		HostFingerprint:   hostKeyPair.Fingerprint(),
+		UserPrivateKey:    userKeyPair.PEMEncodedPrivateKey(),
+		UserAuthorizedKey: userKeyPair.AuthorizedKey(),
+	}, nil
+}
+
+//go:generate counterfeiter -o ../bulk/fakes/fake_ssh_key_store.go . SSHKeyStore
+
+// SSHKeyStore keeps each LRP's SSH keys, so that rebuilding its recipe keeps
+// the host fingerprint users have pinned.
+type SSHKeyStore interface {
+	// Keys returns the keys for the process guid, generating and saving
+	// them the first time.
+	Keys(processGuid string) (SSHKeys, error)
+
+	// Rotate replaces the keys for the process guid. LRPs built before
+	// keep the old keys until they are replaced.
+	Rotate(processGuid string) (SSHKeys, error)
+
+	// Delete forgets the keys for the process guid once its LRP is gone.
+	// Deleting keys that do not exist is not an error.
+	Delete(processGuid string) error
+}
+
+// FileSSHKeyStore keeps SSH keys in a local directory, one file per process
+// guid. It stands in for a shared store, so nsync processes only agree on an
+// LRP's keys if they share the directory.
+type FileSSHKeyStore struct {
+	dir     string
+	factory keys.SSHKeyFactory
+	lock    sync.Mutex
+}
+
+func NewFileSSHKeyStore(dir string, factory keys.SSHKeyFactory) *FileSSHKeyStore {
+	return &FileSSHKeyStore{
+		dir:     dir,
+		factory: factory,
+	}
+}
+
+func (s *FileSSHKeyStore) Keys(processGuid string) (SSHKeys, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path, err := s.path(processGuid)
+	if err != nil {
+		return SSHKeys{}, err
+	}
+
+	sshKeys, err := s.read(processGuid, path)
+	if !os.IsNotExist(err) {
+		return sshKeys, err
+	}
+
+	sshKeys, err = s.generate(path, false)
+	if os.IsExist(err) {
+		// another process sharing the directory saved keys first
+		return s.read(processGuid, path)
+	}
+
+	return sshKeys, err
+}
+
+func (s *FileSSHKeyStore) Rotate(processGuid string) (SSHKeys, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path, err := s.path(processGuid)
+	if err != nil {
+		return SSHKeys{}, err
+	}
+
+	return s.generate(path, true)
+}
+
+func (s *FileSSHKeyStore) Delete(processGuid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path, err := s.path(processGuid)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileSSHKeyStore) read(processGuid, path string) (SSHKeys, error) {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return SSHKeys{}, err
+	}
+
+	var sshKeys SSHKeys
+	err = json.Unmarshal(payload, &sshKeys)
+	if err != nil {
+		return SSHKeys{}, fmt.Errorf("invalid ssh keys for %s: %s", processGuid, err)
+	}
+
+	return sshKeys, nil
+}
+
+func (s *FileSSHKeyStore) path(processGuid string) (string, error) {
+	if processGuid == "" || strings.ContainsAny(processGuid, `/\`) || processGuid == "." || processGuid == ".." {
+		return "", fmt.Errorf("invalid process guid %q", processGuid)
+	}
+
+	return filepath.Join(s.dir, processGuid+".json"), nil
+}
+
+// generate saves new keys to path. Keys already at path are replaced
+// atomically if replace is set; otherwise generate fails with an error
+// satisfying os.IsExist, so that processes sharing the directory never
+// overwrite each other's keys.
+func (s *FileSSHKeyStore) generate(path string, replace bool) (SSHKeys, error) {
+	sshKeys, err := NewSSHKeys(s.factory)
+	if err != nil {
+		return SSHKeys{}, err
+	}
+
+	payload, err := json.Marshal(sshKeys)
+	if err != nil {
+		return SSHKeys{}, err
+	}
+
+	file, err := ioutil.TempFile(s.dir, "ssh-keys")
+	if err != nil {
+		return SSHKeys{}, err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(payload)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return SSHKeys{}, err
+	}
+
+	if replace {
+		err = os.Rename(file.Name(), path)
+	} else {
+		// unlike renaming, linking fails if path exists
+		err = os.Link(file.Name(), path)
+	}
+	if err != nil {
+		return SSHKeys{}, err
+	}
+
+	return sshKeys, nil
+}
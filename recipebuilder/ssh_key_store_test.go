@@ -0,0 +1,140 @@
+package recipebuilder_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cloudfoundry-incubator/diego-ssh/keys"
+	"github.com/cloudfoundry-incubator/diego-ssh/keys/fake_keys"
+	"github.com/cloudfoundry-incubator/nsync/recipebuilder"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileSSHKeyStore", func() {
+	var (
+		dir        string
+		keyFactory *fake_keys.FakeSSHKeyFactory
+		store      *recipebuilder.FileSSHKeyStore
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "ssh-keys")
+		Expect(err).NotTo(HaveOccurred())
+
+		generated := 0
+		keyFactory = &fake_keys.FakeSSHKeyFactory{}
+		keyFactory.NewKeyPairStub = func(bits int) (keys.KeyPair, error) {
+			generated++
+
+			keyPair := &fake_keys.FakeKeyPair{}
+			keyPair.PEMEncodedPrivateKeyReturns(fmt.Sprintf("private-key-%d", generated))
+			keyPair.FingerprintReturns(fmt.Sprintf("fingerprint-%d", generated))
+			keyPair.AuthorizedKeyReturns(fmt.Sprintf("authorized-key-%d", generated))
+			return keyPair, nil
+		}
+
+		store = recipebuilder.NewFileSSHKeyStore(dir, keyFactory)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("generates keys the first time and reuses them after", func() {
+		sshKeys, err := store.Keys("process-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sshKeys).To(Equal(recipebuilder.SSHKeys{
+			HostPrivateKey:    "private-key-1",
+			HostFingerprint:   "fingerprint-1",
+			UserPrivateKey:    "private-key-2",
+			UserAuthorizedKey: "authorized-key-2",
+		}))
+
+		reloaded, err := recipebuilder.NewFileSSHKeyStore(dir, keyFactory).Keys("process-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloaded).To(Equal(sshKeys))
+		Expect(keyFactory.NewKeyPairCallCount()).To(Equal(2))
+	})
+
+	It("keeps separate keys for each process guid", func() {
+		sshKeys, err := store.Keys("process-guid")
+		Expect(err).NotTo(HaveOccurred())
+
+		otherKeys, err := store.Keys("other-process-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(otherKeys).NotTo(Equal(sshKeys))
+	})
+
+	It("replaces the keys when rotated", func() {
+		sshKeys, err := store.Keys("process-guid")
+		Expect(err).NotTo(HaveOccurred())
+
+		rotated, err := store.Rotate("process-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rotated).NotTo(Equal(sshKeys))
+
+		Expect(store.Keys("process-guid")).To(Equal(rotated))
+	})
+
+	It("keeps the keys another process saved first", func() {
+		var saved recipebuilder.SSHKeys
+
+		otherFactory := &fake_keys.FakeSSHKeyFactory{}
+		otherFactory.NewKeyPairStub = func(bits int) (keys.KeyPair, error) {
+			if otherFactory.NewKeyPairCallCount() == 1 {
+				var err error
+				saved, err = store.Keys("process-guid")
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return &fake_keys.FakeKeyPair{}, nil
+		}
+
+		sshKeys, err := recipebuilder.NewFileSSHKeyStore(dir, otherFactory).Keys("process-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sshKeys).To(Equal(saved))
+		Expect(store.Keys("process-guid")).To(Equal(saved))
+	})
+
+	It("forgets deleted keys", func() {
+		sshKeys, err := store.Keys("process-guid")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.Delete("process-guid")).To(Succeed())
+
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+
+		Expect(store.Keys("process-guid")).NotTo(Equal(sshKeys))
+	})
+
+	It("ignores deleting keys it does not have", func() {
+		Expect(store.Delete("process-guid")).To(Succeed())
+	})
+
+	It("rejects process guids that are not file names", func() {
+		_, err := store.Keys("../process-guid")
+		Expect(err).To(MatchError(`invalid process guid "../process-guid"`))
+	})
+
+	Context("when generating a key fails", func() {
+		BeforeEach(func() {
+			keyFactory.NewKeyPairStub = func(bits int) (keys.KeyPair, error) {
+				return nil, errors.New("boom")
+			}
+		})
+
+		It("saves nothing", func() {
+			_, err := store.Keys("process-guid")
+			Expect(err).To(HaveOccurred())
+
+			files, err := ioutil.ReadDir(dir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+	})
+})
@@ -19,3 +19,35 @@ var Routes = rata.Routes{
 	{Path: "/v1/tasks", Method: "POST", Name: TasksRoute},
 	{Path: "/v1/tasks/:task_guid", Method: "DELETE", Name: CancelTaskRoute},
 }
+
+const (
+	SyncStatusRoute = "SyncStatus"
+	SyncLRPsRoute   = "SyncLRPs"
+	SyncTasksRoute  = "SyncTasks"
+	PauseSyncRoute  = "PauseSync"
+	ResumeSyncRoute = "ResumeSync"
+
+	TaskFailureRoute = "TaskFailure"
+
+	ReloadConfigRoute = "ReloadConfig"
+
+	RotateSSHKeysRoute = "RotateSSHKeys"
+)
+
+var BulkerRoutes = rata.Routes{
+	{Path: "/v1/sync", Method: "GET", Name: SyncStatusRoute},
+	{Path: "/v1/sync/lrps", Method: "POST", Name: SyncLRPsRoute},
+	{Path: "/v1/sync/tasks", Method: "POST", Name: SyncTasksRoute},
+	{Path: "/v1/sync/pause", Method: "POST", Name: PauseSyncRoute},
+	{Path: "/v1/sync/resume", Method: "POST", Name: ResumeSyncRoute},
+
+	{Path: "/v1/task_failures/:task_guid", Method: "GET", Name: TaskFailureRoute},
+
+	{Path: "/v1/config/reload", Method: "POST", Name: ReloadConfigRoute},
+
+	{Path: "/v1/ssh_keys/:process_guid/rotate", Method: "POST", Name: RotateSSHKeysRoute},
+}
+
+var ListenerAdminRoutes = rata.Routes{
+	{Path: "/v1/config/reload", Method: "POST", Name: ReloadConfigRoute},
+}
@@ -1,6 +1,7 @@
 package nsync
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/cloudfoundry-incubator/consuladapter"
@@ -16,8 +17,19 @@ func NysncBulkerLockSchemaPath() string {
 	return locket.LockSchemaPath(NysncBulkerLockSchemaKey)
 }
 
+// NsyncBulkerShardLockSchemaKey is the lock held by the bulker working on a
+// shard, when the work is sharded across several bulkers.
+func NsyncBulkerShardLockSchemaKey(shardIndex int) string {
+	return fmt.Sprintf("%s_shard_%d", NysncBulkerLockSchemaKey, shardIndex)
+}
+
+func NsyncBulkerShardLockSchemaPath(shardIndex int) string {
+	return locket.LockSchemaPath(NsyncBulkerShardLockSchemaKey(shardIndex))
+}
+
 type ServiceClient interface {
 	NewNsyncBulkerLockRunner(logger lager.Logger, bulkerID string, retryInterval, lockTTL time.Duration) ifrit.Runner
+	NewNsyncBulkerShardLockRunner(logger lager.Logger, bulkerID string, shardIndex int, retryInterval, lockTTL time.Duration) ifrit.Runner
 }
 
 type serviceClient struct {
@@ -35,3 +47,7 @@ func NewServiceClient(consulClient consuladapter.Client, clock clock.Clock) Serv
 func (c serviceClient) NewNsyncBulkerLockRunner(logger lager.Logger, bulkerID string, retryInterval, lockTTL time.Duration) ifrit.Runner {
 	return locket.NewLock(logger, c.consulClient, NysncBulkerLockSchemaPath(), []byte(bulkerID), c.clock, retryInterval, lockTTL)
 }
+
+func (c serviceClient) NewNsyncBulkerShardLockRunner(logger lager.Logger, bulkerID string, shardIndex int, retryInterval, lockTTL time.Duration) ifrit.Runner {
+	return locket.NewLock(logger, c.consulClient, NsyncBulkerShardLockSchemaPath(shardIndex), []byte(bulkerID), c.clock, retryInterval, lockTTL)
+}